@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+
+	"github.com/MostafaSensei106/GoPix/internal/cache"
+	"github.com/MostafaSensei106/GoPix/internal/stats"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the persistent conversion cache",
+	Long: `Inspect and clean the conversion cache.
+
+The cache remembers which output every source produced with which settings,
+so unchanged images are skipped instantly when a folder is converted again.`,
+}
+
+var cacheStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show what the conversion cache holds",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := cache.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open cache: %v", err)
+		}
+
+		cacheStats := store.Stats()
+		color.Cyan("📦 Conversion cache: %s", cacheStats.Path)
+		color.White("💾 Size on disk: %s", stats.FormatBytes(cacheStats.FileSize))
+		color.White("🖼️  Sources: %d (%d missing)", cacheStats.Sources, cacheStats.MissingSources)
+		color.White("🆕 Outputs: %d (%d missing)", cacheStats.Outputs, cacheStats.MissingOutputs)
+		if cacheStats.MissingSources > 0 || cacheStats.MissingOutputs > 0 {
+			color.Yellow("🧹 Run 'gopix cache prune' to drop entries of missing files")
+		}
+		return nil
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Drop cache entries of files that no longer exist",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := cache.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open cache: %v", err)
+		}
+
+		removed, err := store.Prune()
+		if err != nil {
+			return fmt.Errorf("failed to prune cache: %v", err)
+		}
+
+		color.Green("🧹 Removed %d stale cache entries", removed)
+		return nil
+	},
+}
+
+var cacheClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Delete the whole conversion cache",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := cache.Clear(); err != nil {
+			return fmt.Errorf("failed to clear cache: %v", err)
+		}
+
+		color.Green("🗑️  Conversion cache cleared")
+		return nil
+	},
+}
+
+func init() {
+	cacheCmd.AddCommand(cacheStatsCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+	cacheCmd.AddCommand(cacheClearCmd)
+}
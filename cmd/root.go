@@ -1,17 +1,23 @@
 package cmd
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 
 	"github.com/MostafaSensei106/GoPix/internal/batch"
+	"github.com/MostafaSensei106/GoPix/internal/cache"
 	"github.com/MostafaSensei106/GoPix/internal/config"
 	"github.com/MostafaSensei106/GoPix/internal/converter"
 	"github.com/MostafaSensei106/GoPix/internal/logger"
@@ -22,6 +28,13 @@ import (
 	"github.com/MostafaSensei106/GoPix/internal/worker"
 )
 
+// The conversion cache is written back during a run so a crash loses at most
+// this many conversions or this much time of cache entries.
+const (
+	cacheSaveEvery    = 50
+	cacheSaveInterval = 30 * time.Second
+)
+
 var (
 	Version   = "v1.5.4"
 	BuildTime = time.Now().Format("2006-01-02 3:04:05pm")
@@ -41,6 +54,44 @@ var (
 	rateLimit    float64
 	logToFile    bool
 
+	// Resize flags
+	resizeSpec string
+	resizing   converter.ResizeSpec
+	filter     string
+	noUpscale  bool
+
+	// Variant flags
+	variantSizes    string
+	variantFormats  string
+	variantTemplate string
+	variants        []converter.Variant
+
+	// Safety flags
+	minSimilarity float64
+	onlyIfSmaller string
+	minSavings    float64
+
+	// Quality search flags
+	targetSizeFlag   string
+	targetSize       int64
+	targetSimilarity float64
+
+	// Cache flags
+	noCache         bool
+	changeDetection string
+	sidecar         bool
+
+	// Encoder flags
+	pngCompression  string
+	pngOptimize     string
+	lossless        string
+	frames          string
+	metadata        string
+	colorProfile    string
+	background      string
+	transparency    string
+	encoderSettings config.EncoderSettings
+
 	// Batch processing flags
 	recursiveSearch   bool
 	maxDepth          int
@@ -49,6 +100,8 @@ var (
 	groupByFolder     bool
 	skipEmptyDirs     bool
 	followSymlinks    bool
+	nameTemplate      string
+	onConflict        string
 )
 
 // Pre-allocate common strings to avoid repeated allocations
@@ -84,7 +137,18 @@ GitHub: https://github.com/MostafaSensei106/GoPix`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 
 		if resumeFlag {
-			return handleResume()
+			cmd.SilenceUsage = true
+			return handleResume("")
+		}
+
+		if minSimilarity < 0 || minSimilarity > 1 {
+			return &validator.ValidationError{Field: "verifySimilarity", Message: "must be between 0 and 1"}
+		}
+		if onlyIfSmaller != "" {
+			var err error
+			if minSavings, err = converter.ParseMinSavings(onlyIfSmaller); err != nil {
+				return &validator.ValidationError{Field: "onlyIfSmaller", Message: err.Error()}
+			}
 		}
 
 		// Apply config defaults if not set via flags
@@ -100,44 +164,243 @@ GitHub: https://github.com/MostafaSensei106/GoPix`,
 		if targetFormat == "" {
 			targetFormat = cfg.DefaultFormat
 		}
+		if changeDetection == "" {
+			changeDetection = cfg.ChangeDetection
+		}
+		if changeDetection == "" {
+			changeDetection = converter.ChangeDetectionModTime
+		}
+		if changeDetection != converter.ChangeDetectionModTime && changeDetection != converter.ChangeDetectionHash {
+			return &validator.ValidationError{Field: "changeDetection", Message: fmt.Sprintf("unknown mode %s (mtime, hash)", changeDetection)}
+		}
+
+		// Per-format settings from config.yaml, overridden by explicit flags
+		encoderSettings = cfg.Encoders
+		if cmd.Flags().Changed("quality") {
+			encoderSettings = encoderSettings.OverrideQuality(quality)
+		} else if overridden := encoderSettings.OverriddenQualities(quality); len(overridden) > 0 {
+			color.Yellow("⚠️  Per-format qualities in config.yaml override quality (%d): %s", quality, strings.Join(overridden, ", "))
+		}
+		if pngCompression != "" {
+			if err := config.ValidatePNGCompression(pngCompression); err != nil {
+				return &validator.ValidationError{Field: "pngCompression", Message: err.Error()}
+			}
+			encoderSettings.PNG.Compression = pngCompression
+		}
+		if pngOptimize != "" {
+			if err := config.ValidatePNGOptimize(pngOptimize); err != nil {
+				return &validator.ValidationError{Field: "pngOptimize", Message: err.Error()}
+			}
+			encoderSettings.PNG.Optimize = pngOptimize
+		}
+		if lossless != "" {
+			if err := encoderSettings.WebP.SetLossless(lossless); err != nil {
+				return &validator.ValidationError{Field: "lossless", Message: err.Error()}
+			}
+			if strings.ToLower(targetFormat) != "webp" {
+				color.Yellow("⚠️  --lossless only affects webp output, ignored for %s", targetFormat)
+			}
+		}
+
+		if frames != converter.FramesFirst && frames != converter.FramesAll {
+			return &validator.ValidationError{Field: "frames", Message: fmt.Sprintf("unknown policy %s (first, all)", frames)}
+		}
+
+		if metadata == "" {
+			metadata = cfg.Metadata
+		}
+		if metadata == "" {
+			metadata = converter.MetadataStripAll
+		}
+		metadata = strings.ToLower(metadata)
+		if !slices.Contains(converter.MetadataPolicies, metadata) {
+			return &validator.ValidationError{Field: "metadata", Message: fmt.Sprintf("unknown policy %s (%s)", metadata, strings.Join(converter.MetadataPolicies, ", "))}
+		}
+		if colorProfile == "" {
+			colorProfile = cfg.ColorProfile
+		}
+		if colorProfile == "" {
+			colorProfile = converter.ColorProfileEmbed
+		}
+		colorProfile = strings.ToLower(colorProfile)
+		if colorProfile != converter.ColorProfileEmbed && colorProfile != converter.ColorProfileSRGB {
+			return &validator.ValidationError{Field: "colorProfile", Message: fmt.Sprintf("unknown mode %s (embed, srgb)", colorProfile)}
+		}
+		if background == "" {
+			background = cfg.Background
+		}
+		if background == "" {
+			background = converter.DefaultBackground
+		}
+		parsed, err := converter.ParseBackground(background)
+		if err != nil {
+			return &validator.ValidationError{Field: "background", Message: err.Error()}
+		}
+		background = parsed
+		if transparency == "" {
+			transparency = cfg.Transparency
+		}
+		if transparency == "" {
+			transparency = converter.TransparencyWarn
+		}
+		transparency = strings.ToLower(transparency)
+		if !slices.Contains(converter.TransparencyPolicies, transparency) {
+			return &validator.ValidationError{Field: "transparency", Message: fmt.Sprintf("unknown policy %s (%s)", transparency, strings.Join(converter.TransparencyPolicies, ", "))}
+		}
+
+		spec, err := converter.ParseResizeSpec(resizeSpec)
+		if err != nil {
+			return &validator.ValidationError{Field: "resize", Message: err.Error()}
+		}
+		resizing = spec
+		if filter == "" {
+			filter = cfg.Filter
+		}
+		if filter == "" {
+			filter = converter.FilterLanczos
+		}
+		filter = strings.ToLower(filter)
+		if !slices.Contains(converter.Filters, filter) {
+			return &validator.ValidationError{Field: "filter", Message: fmt.Sprintf("unknown filter %s (%s)", filter, strings.Join(converter.Filters, ", "))}
+		}
+
+		if nameTemplate == "" {
+			nameTemplate = cfg.BatchProcessing.NameTemplate
+		}
+		if nameTemplate != "" {
+			if err := batch.ValidateNameTemplate(nameTemplate); err != nil {
+				return &validator.ValidationError{Field: "nameTemplate", Message: err.Error()}
+			}
+		}
+		if onConflict == "" {
+			onConflict = cfg.BatchProcessing.OnConflict
+		}
+		if onConflict == "" {
+			onConflict = batch.ConflictSkip
+		}
+		onConflict = strings.ToLower(onConflict)
+		if !slices.Contains(batch.ConflictPolicies, onConflict) {
+			return &validator.ValidationError{Field: "onConflict", Message: fmt.Sprintf("unknown conflict policy %s (%s)", onConflict, strings.Join(batch.ConflictPolicies, ", "))}
+		}
+
+		if variantSizes != "" {
+			formats := []string{strings.ToLower(targetFormat)}
+			if variantFormats != "" {
+				formats = strings.Split(strings.ToLower(variantFormats), ",")
+			}
+			for i, format := range formats {
+				formats[i] = strings.TrimSpace(format)
+				if !slices.Contains(converter.SupportedFormats, formats[i]) {
+					return &validator.ValidationError{Field: "variantFormats", Message: fmt.Sprintf("format %s is not supported", formats[i])}
+				}
+			}
+			if variants, err = converter.ParseVariants(variantSizes, formats); err != nil {
+				return &validator.ValidationError{Field: "variants", Message: err.Error()}
+			}
+			if variantTemplate == "" {
+				variantTemplate = converter.DefaultVariantTemplate
+			}
+			if err := converter.ValidateVariantTemplate(variantTemplate, variants); err != nil {
+				return &validator.ValidationError{Field: "variantName", Message: err.Error()}
+			}
+		} else if variantFormats != "" || variantTemplate != "" {
+			color.Yellow("⚠️  --variant-formats and --variant-name only apply together with --variants")
+		}
+
+		if targetSizeFlag != "" {
+			if targetSimilarity != 0 {
+				return &validator.ValidationError{Field: "targetSize", Message: "cannot be combined with --target-ssim"}
+			}
+			if targetSize, err = converter.ParseTargetSize(targetSizeFlag); err != nil {
+				return &validator.ValidationError{Field: "targetSize", Message: err.Error()}
+			}
+		}
+		if targetSimilarity < 0 || targetSimilarity > 1 {
+			return &validator.ValidationError{Field: "targetSsim", Message: "must be between 0 and 1"}
+		}
+		if targetSize > 0 || targetSimilarity > 0 {
+			formats := []string{strings.ToLower(targetFormat)}
+			for _, variant := range variants {
+				formats = append(formats, variant.Format)
+			}
+			if !slices.ContainsFunc(formats, func(format string) bool { return format == "jpg" || format == "jpeg" || format == "webp" }) {
+				color.Yellow("⚠️  --target-size and --target-ssim only affect jpg and lossy webp output, ignored for %s", targetFormat)
+			}
+		}
+
+		if metadata != converter.MetadataStripAll && !converter.CanStoreMetadata(strings.ToLower(targetFormat)) {
+			color.Yellow("⚠️  --metadata only affects jpg, png and webp output, %s output carries no metadata", targetFormat)
+		}
 
 		// Validate inputs
-		if err := validator.ValidateInputs(inputDir, targetFormat, cfg.Extentions); err != nil {
+		if err := validator.ValidateInputs(inputDir, targetFormat, converter.SupportedFormats); err != nil {
 			return err
 		}
 
 		logger.Logger.Infof("Starting conversion: %s -> %s", inputDir, targetFormat)
 
-		return runConversion()
+		// Flags are valid, errors from here on are not usage errors
+		cmd.SilenceUsage = true
+
+		return runConversion(nil, nil)
 	},
 }
 
 // runConversion handles the overall image conversion process. It collects all
 // image files from the specified input directory, sets up the necessary
 // resources such as the image converter and worker pool, and processes each
-// file for conversion. The function supports resuming from previous sessions
-// and updates the conversion state accordingly. It also tracks and reports
-// progress and statistics throughout the process, and handles any errors that
-// occur during conversion. On successful completion, it clears the resume
-// state and logs the overall success of the conversion process.
+// file for conversion. When a saved session is passed in, its settings are
+// restored and every file the session journal already records as done is
+// skipped; its lock is then held by the caller and released on abort. The outcome of each file is appended to the session journal as soon
+// as it is known. It also tracks and reports progress and statistics throughout
+// the process, and handles any errors that occur during conversion. On SIGINT
+// or SIGTERM no new files are started, in-flight conversions finish, and the
+// partial report is printed while the session is kept for resuming; a second
+// signal aborts at once after removing half-written outputs. On successful
+// completion, it clears the resume state and logs the overall success of the
+// conversion process.
+
+func runConversion(state *resume.ConversionState, lock *resume.Lock) error {
+	var batchConfig *config.BatchConfig
+	if state != nil {
+		batchConfig = &state.Batch
+	} else {
+		// Create batch processor with configuration
+		batchConfig = &config.BatchConfig{
+			RecursiveSearch:   recursiveSearch,
+			MaxDepth:          maxDepth,
+			PreserveStructure: preserveStructure,
+			OutputDir:         outputDir,
+			GroupByFolder:     groupByFolder,
+			SkipEmptyDirs:     skipEmptyDirs,
+			FollowSymlinks:    followSymlinks,
+			NameTemplate:      nameTemplate,
+			OnConflict:        onConflict,
+		}
 
-func runConversion() error {
-	// Create batch processor with configuration
-	batchConfig := &config.BatchConfig{
-		RecursiveSearch:   recursiveSearch,
-		MaxDepth:          maxDepth,
-		PreserveStructure: preserveStructure,
-		OutputDir:         outputDir,
-		GroupByFolder:     groupByFolder,
-		SkipEmptyDirs:     skipEmptyDirs,
-		FollowSymlinks:    followSymlinks,
-	}
+		// Override with config defaults if flags not set
+		if !recursiveSearch && !preserveStructure && outputDir == "" && !groupByFolder && !skipEmptyDirs && !followSymlinks {
+			batchConfig = &cfg.BatchProcessing
+			batchConfig.NameTemplate = nameTemplate
+			batchConfig.OnConflict = onConflict
+		}
 
-	// Override with config defaults if flags not set
-	if !recursiveSearch && !preserveStructure && outputDir == "" && !groupByFolder && !skipEmptyDirs && !followSymlinks {
-		batchConfig = &cfg.BatchProcessing
+		// Sessions record absolute paths so they can be resumed from any working directory
+		var err error
+		if inputDir, err = filepath.Abs(inputDir); err != nil {
+			return fmt.Errorf("failed to resolve input directory: %v", err)
+		}
+		if batchConfig.OutputDir != "" {
+			if batchConfig.OutputDir, err = filepath.Abs(batchConfig.OutputDir); err != nil {
+				return fmt.Errorf("failed to resolve output directory: %v", err)
+			}
+		}
 	}
 
+	// Sessions that are resumed always keep their journal up to date
+	resuming := state != nil
+	persistSession := cfg.ResumeEnabled || resuming
+
 	batchProcessor := batch.NewBatchProcessor(batchConfig)
 
 	// Validate batch input
@@ -156,12 +419,55 @@ func runConversion() error {
 		return nil
 	}
 
+	// Load the journal of a resumed session to know which files are already done
+	var journalEntries map[string]resume.JournalEntry
+	if state != nil {
+		journalEntries, err = resume.LoadJournal(state.SessionID)
+		if err != nil {
+			return fmt.Errorf("failed to load session journal: %v", err)
+		}
+	}
+
+	// Outputs written earlier in the session are not sources of it
+	produced := make(map[string]bool, len(journalEntries))
+	for _, entry := range journalEntries {
+		for _, output := range entry.Outputs() {
+			if output != entry.Path {
+				produced[output] = true
+			}
+		}
+	}
+	if len(produced) > 0 {
+		sources := fileInfos[:0]
+		for _, fileInfo := range fileInfos {
+			if !produced[fileInfo.Path] {
+				sources = append(sources, fileInfo)
+			}
+		}
+		fileInfos = sources
+	}
+
 	// Convert FileInfo to string paths for compatibility - pre-allocate with exact size
 	files := make([]string, 0, len(fileInfos))
+	alreadyDone := 0
 	for _, fileInfo := range fileInfos {
+		if entry, ok := journalEntries[fileInfo.Path]; ok && entry.IsDone() {
+			alreadyDone++
+			continue
+		}
 		files = append(files, fileInfo.Path)
 	}
 
+	if alreadyDone > 0 {
+		color.Cyan("⏭️  Skipping %d files already processed in this session", alreadyDone)
+	}
+
+	if len(files) == 0 {
+		color.Green("✅ All files of this session have already been processed")
+		finishSession(state)
+		return nil
+	}
+
 	color.Cyan("🔍 Found %d image files to process", len(files))
 
 	// Show batch processing info
@@ -175,23 +481,6 @@ func runConversion() error {
 		color.Cyan("📤 Output directory: %s", batchConfig.OutputDir)
 	}
 
-	// Setup conversion state for resume capability
-	sessionID := generateSessionID()
-	conversionState := &resume.ConversionState{
-		ProcessedFiles: []string{},
-		StartTime:      time.Now(),
-		InputDir:       inputDir,
-		TargetFormat:   targetFormat,
-		TotalFiles:     len(files),
-		SessionID:      sessionID,
-	}
-
-	if cfg.ResumeEnabled {
-		if err := resume.SaveState(conversionState); err != nil {
-			logger.Logger.Warnf("Failed to save initial state: %v", err)
-		}
-	}
-
 	// Setup converter
 	converterOptions := converter.ConvertOptions{
 		Quality:      quality,
@@ -199,12 +488,124 @@ func runConversion() error {
 		KeepOriginal: keepOriginal,
 		DryRun:       dryRun,
 		Backup:       backup,
+
+		MinSimilarity: minSimilarity,
+		OnlyIfSmaller: onlyIfSmaller != "",
+		MinSavings:    minSavings,
+
+		TargetSize:       targetSize,
+		TargetSimilarity: targetSimilarity,
+
+		ChangeDetection: changeDetection,
+		Sidecar:         sidecar,
+
+		Encoders:     encoderSettings,
+		Frames:       frames,
+		Metadata:     metadata,
+		ColorProfile: colorProfile,
+		Background:   background,
+		Transparency: transparency,
+
+		Resize:    resizing,
+		Filter:    filter,
+		NoUpscale: noUpscale,
+
+		Variants:        variants,
+		VariantTemplate: variantTemplate,
+	}
+
+	// Setup conversion state for resume capability
+	if state == nil {
+		state = &resume.ConversionState{
+			StartTime:    time.Now(),
+			InputDir:     inputDir,
+			TargetFormat: targetFormat,
+			TotalFiles:   len(files),
+			SessionID:    generateSessionID(),
+			Options:      converterOptions,
+			Batch:        *batchConfig,
+			Workers:      workers,
+			RateLimit:    rateLimit,
+		}
+	} else {
+		converterOptions = state.Options
 	}
 
 	imageConverter := converter.NewImageConverter(converterOptions)
 
+	// Reuse outputs of earlier runs for sources that did not change. With
+	// --no-cache every source is converted, but the outputs are still recorded
+	// so later runs recognise them as their own
+	conversionCache, err := cache.Open()
+	if err != nil {
+		logger.Logger.Warnf("Conversion cache disabled: %v", err)
+	} else {
+		imageConverter.SetCache(conversionCache, !noCache)
+		defer saveCache(conversionCache)
+	}
+
+	// Compute every output path up front and settle clashes before anything is written
+	outputPaths, conflicts, err := resolveConflicts(imageConverter, conversionCache, journalEntries, files,
+		planOutputPaths(batchProcessor, imageConverter, fileInfos, files), batchConfig.OnConflict)
+	if err != nil {
+		return err
+	}
+
+	var journal *resume.Journal
+	if persistSession {
+		// Resumed sessions are already locked by handleResume
+		if lock == nil {
+			lock, err = resume.AcquireLock(state.SessionID)
+			if err != nil {
+				return fmt.Errorf("failed to lock session %s: %w", state.SessionID, err)
+			}
+			defer lock.Release()
+		}
+
+		if err := resume.SaveState(state); err != nil {
+			logger.Logger.Warnf("Failed to save initial state: %v", err)
+		}
+
+		journal, err = resume.OpenJournal(state.SessionID)
+		if err != nil {
+			logger.Logger.Warnf("Failed to open session journal: %v", err)
+		} else {
+			defer journal.Close()
+		}
+	}
+
+	// Cancel the run on SIGINT/SIGTERM so in-flight conversions can finish cleanly
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopSignals := watchInterrupts(cancel, func() {
+		// Second interrupt: abort immediately without leaving broken files behind
+		removed := imageConverter.RemovePartialOutputs()
+		if journal != nil {
+			journal.Close()
+		}
+		if conversionCache != nil {
+			saveCache(conversionCache)
+		}
+		// os.Exit skips the deferred cleanup, so the session is saved and
+		// unlocked here to keep it resumable
+		if persistSession {
+			if err := resume.SaveState(state); err != nil {
+				logger.Logger.Warnf("Failed to save state: %v", err)
+			}
+		}
+		if lock != nil {
+			if err := lock.Release(); err != nil {
+				logger.Logger.Warnf("Failed to release session lock: %v", err)
+			}
+		}
+		color.Red("\n🛑 Conversion aborted, removed %d partially written files", removed)
+		color.Yellow("▶️  Resume later with: gopix sessions resume %s", state.SessionID)
+		os.Exit(130)
+	})
+	defer stopSignals()
+
 	// Setup worker pool
-	pool := worker.NewWorkerPool(workers, imageConverter, rateLimit)
+	pool := worker.NewWorkerPool(ctx, workers, imageConverter, rateLimit)
 
 	// Setup progress tracking
 	progressReporter := progress.NewProgressReporter(uint32(len(files)), "Converting images")
@@ -215,80 +616,139 @@ func runConversion() error {
 	statistics.RecursiveSearch = batchConfig.RecursiveSearch
 	statistics.PreserveStructure = batchConfig.PreserveStructure
 
+	// Sources left alone by the conflict policy are done before the pool starts
+	decisions := make(map[string]string, len(conflicts))
+	for _, conflict := range conflicts {
+		decisions[conflict.Source] = conflict.Decision
+		if !conflict.Skip {
+			continue
+		}
+		statistics.AddResult(&converter.ConversionResult{
+			OriginalPath: conflict.Source,
+			NewPath:      conflict.Output,
+			Conflict:     conflict.Decision,
+			Skipped:      true,
+		})
+		logger.Logger.Warnf("Skipped: %s - %s", conflict.Source, conflict.Decision)
+		progressReporter.UpdateWithMessage(1, "⚔️  "+filepath.Base(conflict.Source))
+		if journal != nil {
+			entry := resume.JournalEntry{Path: conflict.Source, Output: conflict.Output, Outcome: resume.OutcomeSkipped}
+			if err := journal.Record(entry); err != nil {
+				logger.Logger.Warnf("Failed to update journal: %v", err)
+			}
+		}
+	}
+
 	// Start processing
 	pool.Start()
-	defer pool.Stop()
-
-	// Send jobs to worker pool - pre-calculate output paths to reduce allocations
-	outputPaths := make([]string, 0, len(files))
-	for _, file := range files {
-		outputPath := batchProcessor.GetOutputPath(inputDir, file, targetFormat)
-		outputPaths = append(outputPaths, outputPath)
-	}
 
+	// Send jobs to worker pool
 	go func() {
+		// Closing the pool once every job is queued lets the results loop end
+		defer pool.Stop()
+
 		for i, file := range files {
+			if outputPaths[i] == "" {
+				continue
+			}
+
 			// Create output directory if needed
 			if err := batchProcessor.CreateOutputDirectory(outputPaths[i]); err != nil {
 				logger.Logger.Errorf("Failed to create output directory for %s: %v", file, err)
 				continue
 			}
 
-			pool.AddJob(worker.Job{
+			if !pool.AddJob(worker.Job{
 				Path:       file,
 				Format:     targetFormat,
 				OutputPath: outputPaths[i],
-			})
+				Variants:   imageConverter.VariantOutputs(outputPaths[i]),
+			}) {
+				return
+			}
 		}
 	}()
 
-	// Process results - optimize string operations and reduce allocations
-	processedCount := 0
+	// Process results until the pool is drained - optimize string operations and reduce allocations
 	timeout := time.NewTimer(30 * time.Second)
 	defer timeout.Stop()
 
-	for processedCount < len(files) {
+	results := pool.Results()
+	processed := 0
+	lastCacheSave := time.Now()
+	for results != nil {
 		select {
-		case result := <-pool.Results():
-			processedCount++
-
-			// Update statistics
-			statistics.AddResult(result)
+		case jobResults, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			processed++
+
+			// A source failed if any of its outputs failed, and was only
+			// skipped if none of them had to be written
+			entry := resume.JournalEntry{
+				Path:    jobResults[0].OriginalPath,
+				Output:  jobResults[0].NewPath,
+				Outcome: resume.OutcomeSkipped,
+			}
+			for _, result := range jobResults[1:] {
+				entry.Variants = append(entry.Variants, result.NewPath)
+			}
+			for _, result := range jobResults {
+				// Update statistics
+				result.Conflict = decisions[result.OriginalPath]
+				statistics.AddResult(result)
+
+				if result.Error != nil {
+					if entry.Outcome != resume.OutcomeFailed {
+						entry.Outcome = resume.OutcomeFailed
+						entry.Error = result.Error.Error()
+					}
+					logger.Logger.Errorf("Conversion failed: %s - %v", result.OriginalPath, result.Error)
+				} else if result.Skipped {
+					logger.Logger.Infof("Already in target format, skipped: %s", result.OriginalPath)
+				} else if result.NotBeneficial {
+					logger.Logger.Infof("Not beneficial, original kept: %s -> %s", result.OriginalPath, result.NewPath)
+				} else if result.NewSize != 0 && !result.CacheHit {
+					if entry.Outcome == resume.OutcomeSkipped {
+						entry.Outcome = resume.OutcomeSuccess
+					}
+					logger.Logger.Infof("Converted: %s -> %s", result.OriginalPath, result.NewPath)
+					if result.Background != "" {
+						logger.Logger.Warnf("Flattened transparency of %s onto %s", result.OriginalPath, result.Background)
+					}
+				}
+			}
 
 			// Update progress - reuse string builder for efficiency
 			var msgBuilder strings.Builder
-			baseName := filepath.Base(result.OriginalPath)
-
-			if result.Error != nil {
-				msgBuilder.Grow(len(baseName) + 4)
+			baseName := filepath.Base(entry.Path)
+			msgBuilder.Grow(len(baseName) + 4)
+			switch entry.Outcome {
+			case resume.OutcomeFailed:
 				msgBuilder.WriteString("❌ ")
-				msgBuilder.WriteString(baseName)
-				progressReporter.UpdateWithMessage(1, msgBuilder.String())
-				logger.Logger.Errorf("Conversion failed: %s - %v", result.OriginalPath, result.Error)
-			} else if result.NewSize == 0 {
-				msgBuilder.Grow(len(baseName) + 4)
+			case resume.OutcomeSkipped:
 				msgBuilder.WriteString("⏭️  ")
-				msgBuilder.WriteString(baseName)
-				progressReporter.UpdateWithMessage(1, msgBuilder.String())
-			} else {
-				msgBuilder.Grow(len(baseName) + 4)
+			default:
 				msgBuilder.WriteString("✅ ")
-				msgBuilder.WriteString(baseName)
-				progressReporter.UpdateWithMessage(1, msgBuilder.String())
-				logger.Logger.Infof("Converted: %s -> %s", result.OriginalPath, result.NewPath)
-			}
-
-			// Update resume state - batch updates to reduce I/O
-			if cfg.ResumeEnabled {
-				conversionState.ProcessedFiles = append(conversionState.ProcessedFiles, result.OriginalPath)
-				// Only save state every 10 files to reduce I/O overhead
-				if len(conversionState.ProcessedFiles)%10 == 0 {
-					if err := resume.SaveState(conversionState); err != nil {
-						logger.Logger.Warnf("Failed to update state: %v", err)
-					}
+			}
+			msgBuilder.WriteString(baseName)
+			progressReporter.UpdateWithMessage(1, msgBuilder.String())
+
+			// Record the outcome in the session journal
+			if journal != nil {
+				if err := journal.Record(entry); err != nil {
+					logger.Logger.Warnf("Failed to update journal: %v", err)
 				}
 			}
 
+			// Persist new cache entries periodically instead of only at the end
+			if conversionCache != nil && (processed%cacheSaveEvery == 0 || time.Since(lastCacheSave) >= cacheSaveInterval) {
+				saveCache(conversionCache)
+				lastCacheSave = time.Now()
+			}
+
 		case <-timeout.C:
 			logger.Logger.Warn("Processing timeout, continuing...")
 			timeout.Reset(30 * time.Second)
@@ -301,41 +761,275 @@ func runConversion() error {
 	// Print final statistics
 	statistics.PrintReport()
 
-	// Clear resume state on successful completion
-	if cfg.ResumeEnabled {
-		if err := resume.ClearState(); err != nil {
-			logger.Logger.Warnf("Failed to clear state: %v", err)
+	// An interrupted run keeps its state and journal so it can be resumed
+	if ctx.Err() != nil {
+		if journal != nil {
+			if err := journal.Sync(); err != nil {
+				logger.Logger.Warnf("Failed to flush journal: %v", err)
+			}
+		}
+		color.Yellow("\n⏸️  Conversion interrupted after %d of %d files", processed, len(files))
+		if persistSession {
+			color.Yellow("▶️  Resume with: gopix sessions resume %s", state.SessionID)
 		}
+		return fmt.Errorf("conversion interrupted")
 	}
 
+	// Clear resume state on successful completion
+	finishSession(state)
+
 	logger.Logger.Info("Conversion completed successfully")
 	return nil
 }
 
+// planOutputPaths computes the output path of every file before anything is converted.
+// Placeholders of the name template that depend on the image are filled in from its
+// header and metadata; files that cannot be read are named with zero values and fail
+// later during their conversion.
+func planOutputPaths(batchProcessor *batch.BatchProcessor, imageConverter *converter.ImageConverter, fileInfos []batch.FileInfo, files []string) []string {
+	// {index} counts all files of the session, so it stays the same when resuming
+	positions := make(map[string]int, len(fileInfos))
+	for i, fileInfo := range fileInfos {
+		positions[fileInfo.Path] = i + 1
+	}
+
+	needsInfo := batchProcessor.UsesPlaceholder(batch.PlaceholderWidth) ||
+		batchProcessor.UsesPlaceholder(batch.PlaceholderHeight) ||
+		batchProcessor.UsesPlaceholder(batch.PlaceholderDate)
+	needsHash := batchProcessor.UsesPlaceholder(batch.PlaceholderHash8)
+
+	outputPaths := make([]string, 0, len(files))
+	for _, file := range files {
+		fields := batch.NameFields{Index: positions[file], Count: len(fileInfos)}
+		if needsInfo {
+			if info, err := imageConverter.OutputInfo(file); err != nil {
+				logger.Logger.Warnf("Failed to read %s for its output name: %v", file, err)
+			} else {
+				fields.Width, fields.Height, fields.Date = info.Width, info.Height, info.Date
+			}
+		}
+		if needsHash {
+			hash, err := cache.HashFile(file)
+			if err != nil {
+				logger.Logger.Warnf("Failed to hash %s for its output name: %v", file, err)
+			}
+			fields.Hash = hash
+		}
+		outputPaths = append(outputPaths, batchProcessor.GetOutputPath(inputDir, file, targetFormat, fields))
+	}
+	return outputPaths
+}
+
+// resolveConflicts applies the conflict policy to the planned output paths. An output
+// clashes with the outputs of earlier files, counting every variant, and with existing
+// files that neither the cache records as produced from the same source nor the journal
+// of the session records as written. If the policy fails the run, the conflicts are listed.
+func resolveConflicts(imageConverter *converter.ImageConverter, conversionCache *cache.Store, journalEntries map[string]resume.JournalEntry, files, outputPaths []string, policy string) ([]string, []batch.Conflict, error) {
+	expand := func(outputPath string) []string {
+		variants := imageConverter.VariantOutputs(outputPath)
+		if len(variants) == 0 {
+			return []string{outputPath}
+		}
+		paths := make([]string, 0, len(variants))
+		for _, variant := range variants {
+			paths = append(paths, variant.Path)
+		}
+		return paths
+	}
+
+	// Outputs a resumed session wrote itself are not foreign files
+	journalOutputs := make(map[string]bool, len(journalEntries))
+	for _, entry := range journalEntries {
+		for _, output := range entry.Outputs() {
+			if absOutput, err := filepath.Abs(output); err == nil {
+				journalOutputs[absOutput] = true
+			}
+		}
+	}
+
+	exists := func(source, output string) bool {
+		info, err := os.Stat(output)
+		if err != nil {
+			return false
+		}
+		absSource, errSource := filepath.Abs(source)
+		absOutput, errOutput := filepath.Abs(output)
+		if errSource != nil || errOutput != nil {
+			return true
+		}
+		// Sources already in the target format are reported by the converter
+		if absSource == absOutput {
+			return false
+		}
+		if journalOutputs[absOutput] {
+			return false
+		}
+		return conversionCache == nil || !conversionCache.ProducedBy(absOutput, absSource, info)
+	}
+
+	resolved, conflicts, err := batch.ResolveConflicts(files, outputPaths, expand, exists, policy)
+	var conflictErr *batch.ConflictError
+	if errors.As(err, &conflictErr) {
+		const shown = 10
+		color.Red("💥 Conflicting outputs:")
+		for _, conflict := range conflictErr.Conflicts[:min(len(conflictErr.Conflicts), shown)] {
+			color.Red("  • %s: %s", conflict.Source, conflict.Reason())
+		}
+		if len(conflictErr.Conflicts) > shown {
+			color.Red("  • ... and %d more", len(conflictErr.Conflicts)-shown)
+		}
+	}
+	return resolved, conflicts, err
+}
+
+// watchInterrupts cancels the conversion on the first SIGINT/SIGTERM and calls
+// abort on the second one. The returned function stops watching.
+func watchInterrupts(cancel context.CancelFunc, abort func()) func() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-signals:
+			color.Yellow("\n⏳ Interrupt received, finishing in-flight conversions (press Ctrl+C again to abort)...")
+			cancel()
+		case <-done:
+			return
+		}
+
+		select {
+		case <-signals:
+			abort()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// saveCache writes the entries recorded during this run to the conversion cache.
+func saveCache(store *cache.Store) {
+	if err := store.Save(); err != nil {
+		logger.Logger.Warnf("Failed to save conversion cache: %v", err)
+	}
+}
+
+// finishSession clears the resume state and the journal of a completed session.
+func finishSession(state *resume.ConversionState) {
+	if state == nil {
+		return
+	}
+
+	if err := resume.ClearState(state.SessionID); err != nil {
+		logger.Logger.Warnf("Failed to clear state: %v", err)
+	}
+}
+
 // handleResume attempts to load a saved conversion state and, if found, resumes the conversion from where it left off.
-// It will print the saved state details and continue with the normal conversion process.
-func handleResume() error {
-	state, err := resume.LoadState()
+// When sessionID is empty the most recent session that is not in use by another process is resumed.
+// It locks the session, prints the saved state details, restores every option the session was started with and
+// continues the conversion with only the files the session journal does not record as done.
+func handleResume(sessionID string) error {
+	state, err := findResumableState(sessionID)
 	if err != nil {
 		return fmt.Errorf("failed to load resume state: %v", err)
 	}
 
 	if state == nil {
+		if sessionID != "" {
+			return fmt.Errorf("session %s not found", sessionID)
+		}
 		color.Yellow("⚠️  No previous conversion session found to resume")
 		return nil
 	}
 
-	color.Cyan("🔄 Resuming conversion session from %v", state.StartTime.Format("2006-01-02 15:04:05"))
+	lock, err := resume.AcquireLock(state.SessionID)
+	if err != nil {
+		return fmt.Errorf("cannot resume session %s: %w", state.SessionID, err)
+	}
+	defer lock.Release()
+
+	done, _, err := journalProgress(state.SessionID)
+	if err != nil {
+		return fmt.Errorf("failed to load session journal: %v", err)
+	}
+
+	color.Cyan("🔄 Resuming conversion session %s from %v", state.SessionID, state.StartTime.Format("2006-01-02 15:04:05"))
 	color.Cyan("📁 Input directory: %s", state.InputDir)
 	color.Cyan("🎯 Target format: %s", state.TargetFormat)
-	color.Cyan("📊 Progress: %d/%d files processed", len(state.ProcessedFiles), state.TotalFiles)
+	color.Cyan("📊 Progress: %d/%d files processed", done, state.TotalFiles)
 
 	// Set variables from saved state
 	inputDir = state.InputDir
 	targetFormat = state.TargetFormat
+	quality = state.Options.Quality
+	maxDimension = state.Options.MaxDimension
+	keepOriginal = state.Options.KeepOriginal
+	dryRun = state.Options.DryRun
+	backup = state.Options.Backup
+	minSimilarity = state.Options.MinSimilarity
+	minSavings = state.Options.MinSavings
+	onlyIfSmaller = ""
+	if state.Options.OnlyIfSmaller {
+		onlyIfSmaller = fmt.Sprint(minSavings)
+	}
+	targetSize = state.Options.TargetSize
+	targetSimilarity = state.Options.TargetSimilarity
+	changeDetection = state.Options.ChangeDetection
+	sidecar = state.Options.Sidecar
+	encoderSettings = state.Options.Encoders
+	frames = state.Options.Frames
+	metadata = state.Options.Metadata
+	colorProfile = state.Options.ColorProfile
+	background = state.Options.Background
+	transparency = state.Options.Transparency
+	resizing = state.Options.Resize
+	filter = state.Options.Filter
+	noUpscale = state.Options.NoUpscale
+	variants = state.Options.Variants
+	variantTemplate = state.Options.VariantTemplate
+	outputDir = state.Batch.OutputDir
+	workers = state.Workers
+
+	// An explicit --on-conflict replaces the policy the session was started with
+	if onConflict != "" {
+		onConflict = strings.ToLower(onConflict)
+		if !slices.Contains(batch.ConflictPolicies, onConflict) {
+			return &validator.ValidationError{Field: "onConflict", Message: fmt.Sprintf("unknown conflict policy %s (%s)", onConflict, strings.Join(batch.ConflictPolicies, ", "))}
+		}
+		state.Batch.OnConflict = onConflict
+	}
+	rateLimit = state.RateLimit
+	if workers == 0 {
+		workers = cfg.Workers
+	}
+
+	// Continue with the files the journal does not record as done
+	return runConversion(state, lock)
+}
 
-	// Continue with normal conversion (it will skip already processed files)
-	return runConversion()
+// findResumableState loads the state of the given session. Without a session ID
+// it returns the most recent saved session that no running process holds.
+func findResumableState(sessionID string) (*resume.ConversionState, error) {
+	if sessionID != "" {
+		return resume.LoadState(sessionID)
+	}
+
+	states, err := resume.ListStates()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, state := range states {
+		if _, locked := resume.LockOwner(state.SessionID); !locked {
+			return state, nil
+		}
+	}
+	return nil, nil
 }
 
 // generateSessionID generates a random 8-byte session ID as a hexadecimal string.
@@ -361,22 +1055,45 @@ func Execute() {
 
 func init() {
 	// Input/Output flags
-	rootCmd.Flags().StringVarP(&inputDir, "path", "p", "", "Path to the image folder (required)")
-	rootCmd.Flags().StringVarP(&targetFormat, "to", "t", "", "Target format default: png (png, jpg, jpeg, webp)")
+	rootCmd.Flags().StringVarP(&inputDir, "path", "p", "", "Path to the image folder (required unless --resume)")
+	rootCmd.Flags().StringVarP(&targetFormat, "to", "t", "", "Target format default: png (png, jpg, jpeg, webp, gif, bmp, tif, tiff, avif)")
 	rootCmd.Flags().BoolVar(&keepOriginal, "keep", false, "Keep original images after conversion")
 	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Preview changes without converting")
 
 	// Quality and processing flags
-	rootCmd.Flags().Uint16VarP(&quality, "quality", "q", 0, "Output quality (1-100, default 80)")
+	rootCmd.Flags().Uint16VarP(&quality, "quality", "q", 0, "Output quality (1-100, default 80), overrides output_settings")
+	rootCmd.Flags().StringVar(&lossless, "lossless", "", "WebP lossless mode: true, false, auto (lossless for graphics with transparency or few colours, lossy for photos) or near (lossless after moving colours by at most 2 levels, for smaller files)")
+	rootCmd.Flags().Lookup("lossless").NoOptDefVal = "true"
+	rootCmd.Flags().StringVar(&frames, "frames", converter.FramesFirst, "Animated or multi-page sources whose target cannot animate: first (flatten to the first frame) or all (fail instead of dropping frames)")
+	rootCmd.Flags().StringVar(&metadata, "metadata", "", "EXIF/XMP/ICC metadata of JPEG, PNG and WebP outputs: strip-all, keep-all, keep-copyright-only or strip-gps (default: config metadata, strip-all)")
+	rootCmd.Flags().StringVar(&colorProfile, "color-profile", "", "Sources with a wide-gamut ICC profile (Display P3, Adobe RGB): embed (keep the profile) or srgb (convert the colours) (default: config color_profile, embed)")
+	rootCmd.Flags().StringVar(&background, "background", "", "Colour transparent areas are flattened onto for JPEG and GIF outputs: #rrggbb, #rgb, white, black or auto (from the corner pixels) (default: config background, white)")
+	rootCmd.Flags().StringVar(&transparency, "transparency", "", "Sources with transparency converted to a format without alpha: warn (flatten onto --background and report) or refuse (fail and keep the source) (default: config transparency, warn)")
+	rootCmd.Flags().StringVar(&pngCompression, "png-compression", "", "PNG compression: default, no_compression, best_speed, best_compression (default: output_settings.png.compression)")
+	rootCmd.Flags().StringVar(&pngOptimize, "png-optimize", "", "PNG optimisation: none, lossless (smallest colour type and filters) or lossy (256-colour dithered palette) (default: output_settings.png.optimize)")
+	rootCmd.Flags().StringVar(&targetSizeFlag, "target-size", "", "Largest size of each jpg and lossy webp output (e.g. 200KB), the quality is searched per image to fit")
+	rootCmd.Flags().Float64Var(&targetSimilarity, "target-ssim", 0, "Lowest similarity (0-1, e.g. 0.95) of each jpg and lossy webp output to its source, reached at the lowest quality searched per image")
 	rootCmd.Flags().Uint16Var(&maxDimension, "max-size", 0, "Maximum width/height in pixels default no limit")
+	rootCmd.Flags().StringVar(&resizeSpec, "resize", "", "Resize images: exact:WxH, fit:WxH (within the box), fill:WxH (cover the box and crop) or N% (scale), --max-size still applies")
+	rootCmd.Flags().StringVar(&filter, "filter", "", "Resampling filter for resizing: nearest, bilinear, bicubic or lanczos (default: config filter, lanczos)")
+	rootCmd.Flags().BoolVar(&noUpscale, "no-upscale", false, "Never enlarge images smaller than the --resize target")
+	rootCmd.Flags().StringVar(&variantSizes, "variants", "", "Write several renditions of each source from one decode: comma separated widths or resize specs, optionally named (e.g. 320,640,1280 or thumb=fill:128x128)")
+	rootCmd.Flags().StringVar(&variantFormats, "variant-formats", "", "Comma separated formats of every --variants size (default: the target format)")
+	rootCmd.Flags().StringVar(&variantTemplate, "variant-name", "", "File name template of variants with {name}, {variant} and {format} (default: "+converter.DefaultVariantTemplate+")")
 	rootCmd.Flags().Uint8VarP(&workers, "workers", "w", 0, "Number of parallel workers Default: Max CPU Cores Available")
 	rootCmd.Flags().Float64Var(&rateLimit, "rate-limit", 0, "Operations per second limit Default: No limit")
 
 	// Feature flags
 	rootCmd.Flags().BoolVar(&backup, "backup", false, "Create backup of original files")
-	rootCmd.Flags().BoolVar(&resumeFlag, "resume", false, "Resume previous interrupted conversion")
+	rootCmd.Flags().StringVar(&onlyIfSmaller, "only-if-smaller", "", "Keep the source instead of outputs that are not smaller, optionally by at least this percentage (e.g. --only-if-smaller=10)")
+	rootCmd.Flags().Lookup("only-if-smaller").NoOptDefVal = "0"
+	rootCmd.Flags().Float64Var(&minSimilarity, "verify-similarity", 0, "Minimum similarity (0-1) between source and output required before deleting the original (0 = only check it decodes with the right size)")
+	rootCmd.Flags().BoolVar(&resumeFlag, "resume", false, "Resume previous interrupted conversion with its original options")
 	// rootCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging")
 	rootCmd.Flags().BoolVar(&logToFile, "log-file", false, "Save logs to file")
+	rootCmd.Flags().BoolVar(&noCache, "no-cache", false, "Convert every file even if an up-to-date output is recorded in the cache")
+	rootCmd.Flags().StringVar(&changeDetection, "change-detection", "", "How unchanged files are detected: mtime (fast) or hash (content, survives rsync/checkouts) default: mtime")
+	rootCmd.Flags().BoolVar(&sidecar, "sidecar", false, "Write a <output>.gopix.json file recording the source and output hashes")
 
 	// Batch processing flags
 	rootCmd.Flags().BoolVar(&recursiveSearch, "recursive", true, "Search subdirectories recursively (default: true)")
@@ -386,13 +1103,17 @@ func init() {
 	rootCmd.Flags().BoolVar(&groupByFolder, "group-by-folder", false, "Group results by source folder")
 	rootCmd.Flags().BoolVar(&skipEmptyDirs, "skip-empty", true, "Skip directories with no images (default: true)")
 	rootCmd.Flags().BoolVar(&followSymlinks, "follow-symlinks", false, "Follow symbolic links")
+	rootCmd.Flags().StringVar(&onConflict, "on-conflict", "", "What to do when outputs clash with each other or with existing files: fail, skip, overwrite or rename (default: skip, or the policy of a resumed session)")
+	rootCmd.Flags().StringVar(&nameTemplate, "name-template", "", "Output path relative to the output directory, with {name} {ext} {dir} {width} {height} {date} {hash8} {index} (e.g. \"{dir}/{name}-{width}w.{ext}\")")
 
-	// Mark required flags
-	rootCmd.MarkFlagRequired("path")
+	// The path flag is required unless resuming, which restores it from the saved session.
+	// validator.ValidateInputs reports a missing path for regular runs.
 
 	// Set version
 	rootCmd.Version = Version
 	rootCmd.SetVersionTemplate("GoPix {{.Version}}\n")
 
 	rootCmd.AddCommand(upgradeCmd)
+	rootCmd.AddCommand(sessionsCmd)
+	rootCmd.AddCommand(cacheCmd)
 }
@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+
+	"github.com/MostafaSensei106/GoPix/internal/resume"
+)
+
+var sessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "Manage saved conversion sessions",
+	Long: `List, inspect, resume and drop saved conversion sessions.
+
+Every conversion run is saved as its own session, so several runs on different
+folders can be interrupted and resumed independently.`,
+}
+
+var sessionsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List saved conversion sessions",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		states, err := resume.ListStates()
+		if err != nil {
+			return fmt.Errorf("failed to list sessions: %v", err)
+		}
+
+		if len(states) == 0 {
+			color.Yellow("⚠️  No saved conversion sessions")
+			return nil
+		}
+
+		color.Cyan("📋 Saved conversion sessions")
+		for _, state := range states {
+			done, _, err := journalProgress(state.SessionID)
+			if err != nil {
+				color.Red("❌ %s: %v", state.SessionID, err)
+				continue
+			}
+
+			status := "idle"
+			if pid, locked := resume.LockOwner(state.SessionID); locked && pid > 0 {
+				status = fmt.Sprintf("running (pid %d)", pid)
+			} else if locked {
+				status = "locked"
+			}
+
+			color.White("  • %s  %s  %s -> %s  %d/%d files  %s",
+				state.SessionID,
+				state.StartTime.Format("2006-01-02 15:04:05"),
+				state.InputDir,
+				state.TargetFormat,
+				done,
+				state.TotalFiles,
+				status)
+		}
+		return nil
+	},
+}
+
+var sessionsShowCmd = &cobra.Command{
+	Use:   "show <id>",
+	Short: "Show the details of a saved conversion session",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		state, err := resume.LoadState(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to load session: %v", err)
+		}
+		if state == nil {
+			return fmt.Errorf("session %s not found", args[0])
+		}
+
+		entries, err := resume.LoadJournal(state.SessionID)
+		if err != nil {
+			return fmt.Errorf("failed to load session journal: %v", err)
+		}
+
+		counts := make(map[resume.Outcome]int, 3)
+		failed := make([]resume.JournalEntry, 0)
+		for _, entry := range entries {
+			counts[entry.Outcome]++
+			if entry.Outcome == resume.OutcomeFailed {
+				failed = append(failed, entry)
+			}
+		}
+
+		color.Cyan("📋 Session %s", state.SessionID)
+		color.White("🕒 Started: %s", state.StartTime.Format("2006-01-02 15:04:05"))
+		color.White("📁 Input directory: %s", state.InputDir)
+		color.White("🎯 Target format: %s", state.TargetFormat)
+		color.White("⚙️  Quality: %d, max size: %d, workers: %d, keep: %t, backup: %t",
+			state.Options.Quality,
+			state.Options.MaxDimension,
+			state.Workers,
+			state.Options.KeepOriginal,
+			state.Options.Backup)
+		if state.Options.Resize.Mode != "" {
+			color.White("📐 Resize: %s, filter: %s, no upscale: %t",
+				state.Options.Resize,
+				state.Options.Filter,
+				state.Options.NoUpscale)
+		}
+		if len(state.Options.Variants) > 0 {
+			names := make([]string, 0, len(state.Options.Variants))
+			for _, variant := range state.Options.Variants {
+				names = append(names, variant.Name+" "+variant.Format)
+			}
+			color.White("🖼️  Variants: %s", strings.Join(names, ", "))
+		}
+		if state.Batch.OutputDir != "" {
+			color.White("📤 Output directory: %s", state.Batch.OutputDir)
+		}
+		if pid, locked := resume.LockOwner(state.SessionID); locked && pid > 0 {
+			color.Yellow("🔒 In use by process %d", pid)
+		} else if locked {
+			color.Yellow("🔒 Locked, but the lock file is unreadable")
+		}
+
+		color.Green("✅ Succeeded: %d", counts[resume.OutcomeSuccess])
+		color.Yellow("⏭️ Skipped: %d", counts[resume.OutcomeSkipped])
+		color.Red("❌ Failed: %d", counts[resume.OutcomeFailed])
+		color.Cyan("📊 Progress: %d/%d files processed", counts[resume.OutcomeSuccess]+counts[resume.OutcomeSkipped], state.TotalFiles)
+
+		if len(failed) > 0 {
+			sort.Slice(failed, func(i, j int) bool { return failed[i].Path < failed[j].Path })
+			color.Red("\n🔍 Failed files (retried on resume)")
+			for _, entry := range failed {
+				color.Red("  • %s: %s", entry.Path, entry.Error)
+			}
+		}
+		return nil
+	},
+}
+
+var sessionsResumeCmd = &cobra.Command{
+	Use:   "resume <id>",
+	Short: "Resume a saved conversion session",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		return handleResume(args[0])
+	},
+}
+
+var sessionsDropCmd = &cobra.Command{
+	Use:   "drop <id>",
+	Short: "Delete a saved conversion session",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		state, err := resume.LoadState(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to load session: %v", err)
+		}
+		if state == nil {
+			return fmt.Errorf("session %s not found", args[0])
+		}
+
+		lock, err := resume.AcquireLock(state.SessionID)
+		if err != nil {
+			return fmt.Errorf("cannot drop session %s: %w", state.SessionID, err)
+		}
+		defer lock.Release()
+
+		if err := resume.ClearState(state.SessionID); err != nil {
+			return fmt.Errorf("failed to drop session: %v", err)
+		}
+
+		color.Green("🗑️  Dropped session %s", state.SessionID)
+		return nil
+	},
+}
+
+// journalProgress returns the number of files the journal of a session records
+// as done and as failed.
+func journalProgress(sessionID string) (int, int, error) {
+	entries, err := resume.LoadJournal(sessionID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	done, failed := 0, 0
+	for _, entry := range entries {
+		if entry.IsDone() {
+			done++
+		} else {
+			failed++
+		}
+	}
+	return done, failed, nil
+}
+
+func init() {
+	sessionsCmd.AddCommand(sessionsListCmd)
+	sessionsCmd.AddCommand(sessionsShowCmd)
+	sessionsCmd.AddCommand(sessionsResumeCmd)
+	sessionsCmd.AddCommand(sessionsDropCmd)
+
+	sessionsResumeCmd.Flags().StringVar(&onConflict, "on-conflict", "", "What to do when outputs clash with existing files: fail, skip, overwrite or rename (default: the policy the session was started with)")
+}
@@ -199,8 +199,14 @@ func (bp *BatchProcessor) CollectFiles(inputDir string, supportedExts []string)
 	return bp.CollectFilesNonRecursive(inputDir, supportedExts)
 }
 
-// GetOutputPath calculates the output path for a file based on batch processing settings
-func (bp *BatchProcessor) GetOutputPath(inputDir, filePath, targetFormat string) string {
+// GetOutputPath calculates the output path for a file based on batch processing settings.
+// A name template replaces the directory structure settings, fields holds the values of its
+// placeholders that depend on the source contents.
+func (bp *BatchProcessor) GetOutputPath(inputDir, filePath, targetFormat string, fields NameFields) string {
+	if bp.config.NameTemplate != "" {
+		return bp.templateOutputPath(inputDir, filePath, targetFormat, fields)
+	}
+
 	// Calculate relative path from input directory
 	relPath, err := filepath.Rel(inputDir, filePath)
 	if err != nil {
@@ -0,0 +1,170 @@
+package batch
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Policies for outputs that clash with the output of another source or with a
+// file that already exists, see config.BatchConfig.OnConflict.
+const (
+	// ConflictFail converts nothing and lists the conflicts.
+	ConflictFail = "fail"
+	// ConflictSkip leaves the source unconverted.
+	ConflictSkip = "skip"
+	// ConflictOverwrite replaces existing files. Sources sharing an output
+	// still fail the run, as only one of their outputs could survive.
+	ConflictOverwrite = "overwrite"
+	// ConflictRename appends -1, -2, ... to the output name until it is free.
+	ConflictRename = "rename"
+)
+
+// ConflictPolicies lists the accepted conflict policies.
+var ConflictPolicies = []string{ConflictFail, ConflictSkip, ConflictOverwrite, ConflictRename}
+
+// maxRenames bounds the search for a free name.
+const maxRenames = 10000
+
+// Conflict is a source whose output clashes with another output or with an
+// existing file, together with how the policy resolved it.
+type Conflict struct {
+	Source   string
+	Output   string // The contested output path
+	Owner    string // Source that claimed Output first, empty if Output already exists
+	Decision string // What was done about it, including the reason
+	Skip     bool   // The source is left unconverted
+}
+
+// Reason describes the clash.
+func (c *Conflict) Reason() string {
+	if c.Owner != "" {
+		return fmt.Sprintf("%s is also the output of %s", c.Output, c.Owner)
+	}
+	return fmt.Sprintf("%s already exists", c.Output)
+}
+
+// ConflictError is returned when the conflict policy does not allow the run
+// to continue. It holds the conflicts that could not be resolved.
+type ConflictError struct {
+	Policy    string
+	Conflicts []Conflict
+}
+
+// Error implements the error interface.
+func (e *ConflictError) Error() string {
+	hint := "use --on-conflict skip, rename or overwrite"
+	if e.Policy == ConflictOverwrite {
+		hint = "use --on-conflict skip or rename, or {dir}, {hash8} or {index} in --name-template"
+	}
+	return fmt.Sprintf("%d files have conflicting outputs, %s", len(e.Conflicts), hint)
+}
+
+// ResolveConflicts checks the planned outputs of the sources against each other
+// and against existing files and applies policy. outputPaths[i] is the planned
+// output of sources[i]. expand returns every path written for an output path,
+// which differs from it for variants, and exists reports whether an output of
+// a source is taken by a file that the source did not produce itself.
+//
+// Outputs are claimed in order, so the first source keeps a contested path.
+// It returns the output paths to write, with renamed ones replaced and skipped
+// ones empty, and every conflict found, or a *ConflictError if the policy lets
+// the run fail.
+func ResolveConflicts(sources, outputPaths []string, expand func(string) []string, exists func(source, output string) bool, policy string) ([]string, []Conflict, error) {
+	resolved := slices.Clone(outputPaths)
+	claimed := make(map[string]int, len(sources))
+	var conflicts, unresolved []Conflict
+
+	// clash returns the first output of source i that is already taken
+	clash := func(i int, outputs []string) (Conflict, bool) {
+		for _, output := range outputs {
+			if owner, ok := claimed[pathKey(output)]; ok && owner != i {
+				return Conflict{Source: sources[i], Output: output, Owner: sources[owner]}, true
+			}
+			if exists(sources[i], output) {
+				return Conflict{Source: sources[i], Output: output}, true
+			}
+		}
+		return Conflict{}, false
+	}
+	claim := func(i int, outputs []string) {
+		for _, output := range outputs {
+			if _, ok := claimed[pathKey(output)]; !ok {
+				claimed[pathKey(output)] = i
+			}
+		}
+	}
+
+	for i := range sources {
+		outputs := expand(resolved[i])
+		// Sources already in the target format are left as they are
+		if len(outputs) == 1 && pathKey(outputs[0]) == pathKey(sources[i]) {
+			continue
+		}
+		conflict, found := clash(i, outputs)
+		if !found {
+			claim(i, outputs)
+			continue
+		}
+
+		switch policy {
+		case ConflictSkip:
+			conflict.Decision = "skipped, " + conflict.Reason()
+			conflict.Skip = true
+			resolved[i] = ""
+		case ConflictOverwrite:
+			if conflict.Owner != "" {
+				conflict.Decision = conflict.Reason()
+				unresolved = append(unresolved, conflict)
+			} else {
+				conflict.Decision = "overwrote " + conflict.Output + ", which already existed"
+			}
+			claim(i, outputs)
+		case ConflictRename:
+			renamed := false
+			for n := 1; n <= maxRenames && !renamed; n++ {
+				candidate := numberedPath(resolved[i], n)
+				candidateOutputs := expand(candidate)
+				if _, taken := clash(i, candidateOutputs); !taken {
+					conflict.Decision = "renamed to " + candidate + ", " + conflict.Reason()
+					resolved[i] = candidate
+					claim(i, candidateOutputs)
+					renamed = true
+				}
+			}
+			if !renamed {
+				conflict.Decision = "no free name found, " + conflict.Reason()
+				unresolved = append(unresolved, conflict)
+			}
+		default:
+			conflict.Decision = conflict.Reason()
+			unresolved = append(unresolved, conflict)
+			claim(i, outputs)
+		}
+		conflicts = append(conflicts, conflict)
+	}
+
+	if len(unresolved) > 0 {
+		return nil, conflicts, &ConflictError{Policy: policy, Conflicts: unresolved}
+	}
+	return resolved, conflicts, nil
+}
+
+// numberedPath inserts -n before the extension of path.
+func numberedPath(path string, n int) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + strconv.Itoa(n) + ext
+}
+
+// pathKey identifies the file at path. Paths are compared case insensitively
+// on Windows and macOS, whose file systems usually are.
+func pathKey(path string) string {
+	path = filepath.Clean(path)
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		path = strings.ToLower(path)
+	}
+	return path
+}
@@ -0,0 +1,103 @@
+package batch
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Placeholders of output name templates, see config.BatchConfig.NameTemplate.
+const (
+	PlaceholderName   = "{name}"   // File name of the source without its extension
+	PlaceholderExt    = "{ext}"    // Extension of the target format
+	PlaceholderDir    = "{dir}"    // Directory of the source relative to the input directory
+	PlaceholderWidth  = "{width}"  // Width of the output
+	PlaceholderHeight = "{height}" // Height of the output
+	PlaceholderDate   = "{date}"   // Date the photo was taken, as YYYY-MM-DD
+	PlaceholderHash8  = "{hash8}"  // First 8 hex digits of the SHA-256 of the source
+	PlaceholderIndex  = "{index}"  // Position of the source among all sources, from 1
+)
+
+// Placeholders lists the placeholders of output name templates.
+var Placeholders = []string{
+	PlaceholderName, PlaceholderExt, PlaceholderDir, PlaceholderWidth,
+	PlaceholderHeight, PlaceholderDate, PlaceholderHash8, PlaceholderIndex,
+}
+
+// placeholderPattern matches anything that looks like a placeholder.
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// NameFields holds the values of the placeholders that depend on the source
+// contents rather than on its path. Only the fields used by the template
+// need to be set.
+type NameFields struct {
+	Width  int
+	Height int
+	Date   time.Time
+	Hash   string // Hex encoded SHA-256 of the source
+	Index  int    // Position of the source, from 1
+	Count  int    // Number of sources, {index} is padded to its number of digits
+}
+
+// ValidateNameTemplate checks that template only holds known placeholders and
+// stays within the output directory.
+func ValidateNameTemplate(template string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		if !slices.Contains(Placeholders, placeholder) {
+			return fmt.Errorf("unknown placeholder %s in name template %q (%s)", placeholder, template, strings.Join(Placeholders, " "))
+		}
+	}
+
+	// {dir} never leaves the input directory, so only the literal parts matter
+	path := filepath.FromSlash(placeholderPattern.ReplaceAllString(template, "x"))
+	if filepath.IsAbs(path) || !filepath.IsLocal(path) {
+		return fmt.Errorf("name template %q must be a relative path within the output directory", template)
+	}
+	return nil
+}
+
+// UsesPlaceholder reports whether the name template contains placeholder.
+func (bp *BatchProcessor) UsesPlaceholder(placeholder string) bool {
+	return strings.Contains(bp.config.NameTemplate, placeholder)
+}
+
+// templateOutputPath names the output of filePath by the name template. The
+// result is relative to the output directory, or the input directory if none
+// is set.
+func (bp *BatchProcessor) templateOutputPath(inputDir, filePath, targetFormat string, fields NameFields) string {
+	relPath, err := filepath.Rel(inputDir, filePath)
+	if err != nil {
+		relPath = filepath.Base(filePath)
+	}
+	dir := filepath.Dir(relPath)
+	if dir == "." {
+		dir = ""
+	}
+	base := filepath.Base(relPath)
+
+	hash8 := fields.Hash
+	if len(hash8) > 8 {
+		hash8 = hash8[:8]
+	}
+
+	name := strings.NewReplacer(
+		PlaceholderName, strings.TrimSuffix(base, filepath.Ext(base)),
+		PlaceholderExt, targetFormat,
+		PlaceholderDir, filepath.ToSlash(dir),
+		PlaceholderWidth, strconv.Itoa(fields.Width),
+		PlaceholderHeight, strconv.Itoa(fields.Height),
+		PlaceholderDate, fields.Date.Format(time.DateOnly),
+		PlaceholderHash8, hash8,
+		PlaceholderIndex, fmt.Sprintf("%0*d", len(strconv.Itoa(fields.Count)), fields.Index),
+	).Replace(bp.config.NameTemplate)
+
+	root := bp.config.OutputDir
+	if root == "" {
+		root = inputDir
+	}
+	return filepath.Join(root, filepath.FromSlash(name))
+}
@@ -0,0 +1,519 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// cacheVersion is bumped whenever the on-disk layout changes incompatibly.
+const cacheVersion = 1
+
+// compactMinLogSize is the size the cache log must reach before it is merged
+// into the cache file. Past it, the log is merged once it outgrows the file,
+// so the whole cache is rewritten only a logarithmic number of times.
+const compactMinLogSize = 1 << 20
+
+// SourceEntry remembers the content hash of a source file together with the
+// size and modification time it had when it was hashed.
+type SourceEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+// OutputEntry describes an output produced from a source with given settings.
+type OutputEntry struct {
+	SourcePath    string    `json:"source_path"`
+	SourceHash    string    `json:"source_hash"`
+	OutputPath    string    `json:"output_path"`
+	OutputHash    string    `json:"output_hash,omitempty"`
+	OutputSize    int64     `json:"output_size"`
+	OutputModTime time.Time `json:"output_mod_time"`
+	Format        string    `json:"format"`
+	ConfigHash    string    `json:"config_hash"`
+	Created       time.Time `json:"created"`
+}
+
+// Stats summarises the contents of the cache.
+type Stats struct {
+	Path           string
+	FileSize       int64
+	Sources        int
+	Outputs        int
+	MissingOutputs int
+	MissingSources int
+}
+
+// cacheFile is the on-disk representation of the cache.
+type cacheFile struct {
+	Version int                    `json:"version"`
+	Sources map[string]SourceEntry `json:"sources"`
+	Outputs map[string]OutputEntry `json:"outputs"`
+}
+
+// logRecord is a line of the cache log. It holds either a changed source or
+// a changed output; a deleted output has no entry.
+type logRecord struct {
+	Source      string       `json:"source,omitempty"`
+	SourceEntry *SourceEntry `json:"source_entry,omitempty"`
+	Output      string       `json:"output,omitempty"`
+	OutputEntry *OutputEntry `json:"output_entry,omitempty"`
+}
+
+// Store is a persistent conversion cache shared by all gopix runs.
+//
+// It is loaded into memory once. Save appends the entries changed by this
+// process to a log next to the cache file, so saving costs as much as the
+// changes and concurrent runs on different folders do not drop each other's
+// entries. The log is merged into the cache file once it grows large.
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	logPath string
+	data    cacheFile
+
+	// saveMu serialises Save calls, which write outside of mu
+	saveMu sync.Mutex
+
+	dirtySources map[string]bool
+	dirtyOutputs map[string]bool
+
+	// producers maps output paths to the entries recording them, built on
+	// first use by ProducedBy
+	producers map[string][]OutputEntry
+}
+
+// Open loads the cache from the user's cache directory. A missing or
+// unreadable cache file results in an empty cache.
+func Open() (*Store, error) {
+	cacheDir := getCacheDir()
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	store := &Store{
+		path:         filepath.Join(cacheDir, "cache.json"),
+		logPath:      filepath.Join(cacheDir, "cache.log"),
+		dirtySources: make(map[string]bool),
+		dirtyOutputs: make(map[string]bool),
+	}
+	store.data = loadCache(store.path, store.logPath)
+	return store, nil
+}
+
+// Key builds the cache key of an output. It combines the content hash of the
+// source, the target format, the conversion settings and the output location,
+// so the same picture stored under two names is tracked separately.
+func Key(sourceHash, format, configHash, outputPath string) string {
+	hasher := sha256.New()
+	for _, part := range []string{sourceHash, format, configHash, outputPath} {
+		hasher.Write([]byte(part))
+		hasher.Write([]byte{0})
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// HashFile returns the hex encoded SHA-256 of the file's content.
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// SourceHash returns the content hash of the source file at path. If
+// trustModTime is set, the file is only read when its size or modification
+// time differs from the recorded one; otherwise it is always hashed again.
+func (s *Store) SourceHash(path string, info os.FileInfo, trustModTime bool) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	entry, ok := s.data.Sources[absPath]
+	s.mu.Unlock()
+
+	if trustModTime && ok && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		return entry.Hash, nil
+	}
+
+	hash, err := HashFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.data.Sources[absPath] = SourceEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Hash:    hash,
+	}
+	s.dirtySources[absPath] = true
+	s.mu.Unlock()
+
+	return hash, nil
+}
+
+// Lookup returns the output recorded under key.
+func (s *Store) Lookup(key string) (OutputEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.data.Outputs[key]
+	return entry, ok
+}
+
+// Put records an output under key.
+func (s *Store) Put(key string, entry OutputEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Outputs[key] = entry
+	s.dirtyOutputs[key] = true
+	if s.producers != nil {
+		s.producers[entry.OutputPath] = append(s.producers[entry.OutputPath], entry)
+	}
+}
+
+// ProducedBy reports whether the file at outputPath, described by info, is
+// recorded as produced from sourcePath and unchanged since, so it was written
+// by an earlier run rather than by someone else. Both paths are absolute.
+func (s *Store) ProducedBy(outputPath, sourcePath string, info os.FileInfo) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.producers == nil {
+		s.producers = make(map[string][]OutputEntry, len(s.data.Outputs))
+		for _, entry := range s.data.Outputs {
+			s.producers[entry.OutputPath] = append(s.producers[entry.OutputPath], entry)
+		}
+	}
+	return slices.ContainsFunc(s.producers[outputPath], func(entry OutputEntry) bool {
+		return entry.SourcePath == sourcePath && entry.OutputSize == info.Size() && entry.OutputModTime.Equal(info.ModTime())
+	})
+}
+
+// Delete removes the output recorded under key.
+func (s *Store) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.Outputs, key)
+	s.dirtyOutputs[key] = true
+}
+
+// Save appends the entries changed by this process since the last save to
+// the cache log. The changes are copied under the lock and written without
+// it, so conversions running in parallel are not held up by the disk.
+func (s *Store) Save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	records := make([]logRecord, 0, len(s.dirtySources)+len(s.dirtyOutputs))
+	for path := range s.dirtySources {
+		entry := s.data.Sources[path]
+		records = append(records, logRecord{Source: path, SourceEntry: &entry})
+	}
+	for key := range s.dirtyOutputs {
+		record := logRecord{Output: key}
+		if entry, ok := s.data.Outputs[key]; ok {
+			record.OutputEntry = &entry
+		}
+		records = append(records, record)
+	}
+	s.dirtySources = make(map[string]bool)
+	s.dirtyOutputs = make(map[string]bool)
+	s.mu.Unlock()
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := appendCacheLog(s.logPath, records); err != nil {
+		// Keep the changes for the next save
+		s.mu.Lock()
+		for _, record := range records {
+			if record.Source != "" {
+				s.dirtySources[record.Source] = true
+			} else {
+				s.dirtyOutputs[record.Output] = true
+			}
+		}
+		s.mu.Unlock()
+		return err
+	}
+
+	return s.compactIfLarge()
+}
+
+// compactIfLarge merges the cache log into the cache file once the log has
+// grown past compactMinLogSize and past the size of the cache file.
+func (s *Store) compactIfLarge() error {
+	logInfo, err := os.Stat(s.logPath)
+	if err != nil || logInfo.Size() < compactMinLogSize {
+		return nil
+	}
+	if info, err := os.Stat(s.path); err == nil && logInfo.Size() < info.Size() {
+		return nil
+	}
+
+	_, err = compactCache(s.path, s.logPath, nil)
+	return err
+}
+
+// Stats reports how many entries the cache holds and how many of them refer to
+// files that no longer exist.
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := Stats{
+		Path:    s.path,
+		Sources: len(s.data.Sources),
+		Outputs: len(s.data.Outputs),
+	}
+	for _, path := range []string{s.path, s.logPath} {
+		if info, err := os.Stat(path); err == nil {
+			stats.FileSize += info.Size()
+		}
+	}
+
+	for path := range s.data.Sources {
+		if _, err := os.Stat(path); err != nil {
+			stats.MissingSources++
+		}
+	}
+	for _, entry := range s.data.Outputs {
+		if _, err := os.Stat(entry.OutputPath); err != nil {
+			stats.MissingOutputs++
+		}
+	}
+
+	return stats
+}
+
+// Prune drops every entry whose source or output no longer exists, as well as
+// outputs that were overwritten since, and writes the result to disk. It
+// returns the number of removed entries.
+func (s *Store) Prune() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	data, err := compactCache(s.path, s.logPath, func(data *cacheFile) {
+		for path := range data.Sources {
+			if _, err := os.Stat(path); err != nil {
+				delete(data.Sources, path)
+				removed++
+			}
+		}
+		for key, entry := range data.Outputs {
+			outStat, outErr := os.Stat(entry.OutputPath)
+			_, srcErr := os.Stat(entry.SourcePath)
+
+			// Outputs overwritten since they were recorded can never be reused either
+			if outErr != nil || srcErr != nil ||
+				outStat.Size() != entry.OutputSize || !outStat.ModTime().Equal(entry.OutputModTime) {
+				delete(data.Outputs, key)
+				removed++
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.data = data
+	s.dirtySources = make(map[string]bool)
+	s.dirtyOutputs = make(map[string]bool)
+	s.producers = nil
+	return removed, nil
+}
+
+// Clear deletes the cache file and its log.
+func Clear() error {
+	cacheDir := getCacheDir()
+	for _, name := range []string{"cache.json", "cache.log", "cache.log" + compactingSuffix} {
+		if err := os.Remove(filepath.Join(cacheDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactingSuffix marks a cache log that is being merged into the cache file.
+// A log left behind with it by a crash is read like the current log.
+const compactingSuffix = ".compacting"
+
+// loadCache reads the cache file and replays the cache logs onto it.
+func loadCache(path, logPath string) cacheFile {
+	data := readCacheFile(path)
+	replayCacheLog(logPath+compactingSuffix, &data)
+	replayCacheLog(logPath, &data)
+	return data
+}
+
+// compactCache merges the cache log into the cache file, applying edit to the
+// merged entries first if it is not nil, and returns the merged entries.
+//
+// The log is moved aside before it is read, so entries that other runs append
+// meanwhile go to a fresh log instead of being lost.
+func compactCache(path, logPath string, edit func(*cacheFile)) (cacheFile, error) {
+	compactingPath := logPath + compactingSuffix
+	if err := os.Rename(logPath, compactingPath); err != nil && !os.IsNotExist(err) {
+		return cacheFile{}, fmt.Errorf("failed to move cache log: %w", err)
+	}
+
+	data := readCacheFile(path)
+	replayCacheLog(compactingPath, &data)
+	if edit != nil {
+		edit(&data)
+	}
+
+	if err := writeCacheFile(path, &data); err != nil {
+		return cacheFile{}, err
+	}
+	if err := os.Remove(compactingPath); err != nil && !os.IsNotExist(err) {
+		return cacheFile{}, fmt.Errorf("failed to remove cache log: %w", err)
+	}
+	return data, nil
+}
+
+// readCacheFile loads the cache file at path. Missing, corrupt or outdated
+// files yield an empty cache, as everything in it can be rebuilt.
+func readCacheFile(path string) cacheFile {
+	data := cacheFile{
+		Version: cacheVersion,
+		Sources: make(map[string]SourceEntry),
+		Outputs: make(map[string]OutputEntry),
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return data
+	}
+
+	var loaded cacheFile
+	if err := json.Unmarshal(raw, &loaded); err != nil || loaded.Version != cacheVersion {
+		return data
+	}
+	if loaded.Sources != nil {
+		data.Sources = loaded.Sources
+	}
+	if loaded.Outputs != nil {
+		data.Outputs = loaded.Outputs
+	}
+	return data
+}
+
+// replayCacheLog applies the records of the cache log at path to data. A
+// missing log and lines cut short by a crash are ignored.
+func replayCacheLog(path string, data *cacheFile) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record logRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		switch {
+		case record.Source != "" && record.SourceEntry != nil:
+			data.Sources[record.Source] = *record.SourceEntry
+		case record.Output != "" && record.OutputEntry != nil:
+			data.Outputs[record.Output] = *record.OutputEntry
+		case record.Output != "":
+			delete(data.Outputs, record.Output)
+		}
+	}
+}
+
+// appendCacheLog appends records to the cache log at path in a single write
+// and syncs it.
+func appendCacheLog(path string, records []logRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			return fmt.Errorf("failed to marshal cache log: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open cache log: %w", err)
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write cache log: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync cache log: %w", err)
+	}
+	return file.Close()
+}
+
+// writeCacheFile writes the cache through a temporary file and renames it into
+// place, so a crash never leaves a truncated cache behind.
+func writeCacheFile(path string, data *cacheFile) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".tmp_cache")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName) // Clean up on error
+
+	if _, err := tmpFile.Write(raw); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to sync cache: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return nil
+}
+
+// getCacheDir returns the path to the directory holding the conversion cache.
+// The directory is located in the user's home directory and is named ".gopix/cache".
+func getCacheDir() string {
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".gopix", "cache")
+}
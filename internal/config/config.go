@@ -22,19 +22,40 @@ type Config struct {
 	KeepOriginal   bool                   `yaml:"keep_original"`
 	DryRun         bool                   `yaml:"dry_run"`
 	Verbose        bool                   `yaml:"verbose"`
+	// How unchanged files are recognised: "mtime" or "hash"
+	ChangeDetection string `yaml:"change_detection"`
+	// Which EXIF, XMP and ICC data outputs keep: "strip-all", "keep-all",
+	// "keep-copyright-only" or "strip-gps"
+	Metadata string `yaml:"metadata"`
+	// How sources with a non-sRGB ICC profile are converted: "embed" keeps
+	// the profile in the output, "srgb" converts the pixels to sRGB
+	ColorProfile string `yaml:"color_profile"`
+	// Resampling filter used for resizing: "nearest", "bilinear", "bicubic"
+	// or "lanczos"
+	Filter string `yaml:"filter"`
+	// Colour transparent areas are flattened onto for formats without alpha:
+	// "#rrggbb", "#rgb", "white", "black" or "auto" (from the corner pixels)
+	Background string `yaml:"background"`
+	// Sources with transparency converted to a format without alpha: "warn"
+	// flattens them onto the background, "refuse" fails them
+	Transparency string `yaml:"transparency"`
+	// Typed form of OutputSettings, filled in and validated by LoadConfig
+	Encoders EncoderSettings `yaml:"-"`
 	// Batch processing options
 	BatchProcessing BatchConfig `yaml:"batch_processing"`
 }
 
 // BatchConfig contains configuration for batch processing features
 type BatchConfig struct {
-	RecursiveSearch   bool   `yaml:"recursive_search"`   // Search subdirectories recursively
-	MaxDepth          int    `yaml:"max_depth"`          // Maximum directory depth to search (0 = unlimited)
-	PreserveStructure bool   `yaml:"preserve_structure"` // Preserve directory structure in output
-	OutputDir         string `yaml:"output_dir"`         // Custom output directory for batch processing
-	GroupByFolder     bool   `yaml:"group_by_folder"`    // Group results by source folder
-	SkipEmptyDirs     bool   `yaml:"skip_empty_dirs"`    // Skip directories with no images
-	FollowSymlinks    bool   `yaml:"follow_symlinks"`    // Follow symbolic links
+	RecursiveSearch   bool   `yaml:"recursive_search" json:"recursive_search"`     // Search subdirectories recursively
+	MaxDepth          int    `yaml:"max_depth" json:"max_depth"`                   // Maximum directory depth to search (0 = unlimited)
+	PreserveStructure bool   `yaml:"preserve_structure" json:"preserve_structure"` // Preserve directory structure in output
+	OutputDir         string `yaml:"output_dir" json:"output_dir"`                 // Custom output directory for batch processing
+	GroupByFolder     bool   `yaml:"group_by_folder" json:"group_by_folder"`       // Group results by source folder
+	SkipEmptyDirs     bool   `yaml:"skip_empty_dirs" json:"skip_empty_dirs"`       // Skip directories with no images
+	FollowSymlinks    bool   `yaml:"follow_symlinks" json:"follow_symlinks"`       // Follow symbolic links
+	NameTemplate      string `yaml:"name_template" json:"name_template"`           // Output path template, e.g. "{dir}/{name}-{width}.{ext}"
+	OnConflict        string `yaml:"on_conflict" json:"on_conflict"`               // Outputs that clash: "fail", "skip", "overwrite" or "rename"
 }
 
 // DefaultConfig returns the default configuration for gopix.
@@ -48,19 +69,27 @@ type BatchConfig struct {
 // - Number of workers: the number of CPUs available
 // - Maximum dimension: 0 (no limit)
 // - Log level: info
-// - Supported extentions: png, jpg, jpeg, webp
+// - Supported extentions: png, jpg, jpeg, webp, gif, bmp, tif, tiff, heic, heif, avif
 // - Auto backup: true
 // - Resume enabled: true
+// - Change detection: mtime
+// - Metadata: strip-all
+// - Colour profile: embed
+// - Resampling filter: lanczos
+// - Background: white, transparency: warn
 // - Keep original: false
 // - Dry run: false
 // - Verbose logging: false
 //
-// The output settings are as follows:
+// The output settings are as follows. They set no per-format quality, so
+// JPEG, WebP and AVIF outputs follow the top-level quality.
 //
-// - For PNG: use best speed compression
-// - For JPG: use quality 80
-// - For JPEG: use quality 80
-// - For WebP: use quality 80 and lossless compression
+// - For PNG: use best speed compression without optimisation
+// - For JPG: baseline 4:2:0 with the standard Huffman tables
+// - For JPEG: the same as for JPG
+// - For WebP: use lossy compression
+// - For TIFF: use deflate compression
+// - For AVIF: use encoder speed 8
 func DefaultConfig() *Config {
 	return &Config{
 		DefaultFormat: "png",
@@ -68,7 +97,7 @@ func DefaultConfig() *Config {
 		Workers:       uint8(runtime.NumCPU()),
 		MaxDimension:  0,
 		LogLevel:      "info",
-		Extentions:    []string{"png", "jpg", "jpeg", "webp"},
+		Extentions:    []string{"png", "jpg", "jpeg", "webp", "gif", "bmp", "tif", "tiff", "heic", "heif", "avif"},
 		AutoBackup:    true,
 		ResumeEnabled: true,
 		KeepOriginal:  false,
@@ -77,18 +106,34 @@ func DefaultConfig() *Config {
 		OutputSettings: map[string]interface{}{
 			"png": map[string]interface{}{
 				"compression": "best_speed",
+				"optimize":    "none",
 			},
 			"jpg": map[string]interface{}{
-				"quality": 80,
+				"progressive":      false,
+				"subsampling":      "4:2:0",
+				"optimize_huffman": false,
 			},
 			"jpeg": map[string]interface{}{
-				"quality": 80,
+				"progressive":      false,
+				"subsampling":      "4:2:0",
+				"optimize_huffman": false,
 			},
 			"webp": map[string]interface{}{
-				"quality":  80,
 				"lossless": false,
 			},
+			"tiff": map[string]interface{}{
+				"compression": "deflate",
+			},
+			"avif": map[string]interface{}{
+				"speed": 8,
+			},
 		},
+		ChangeDetection: "mtime",
+		Metadata:        "strip-all",
+		ColorProfile:    "embed",
+		Filter:          "lanczos",
+		Background:      "#ffffff",
+		Transparency:    "warn",
 		BatchProcessing: BatchConfig{
 			RecursiveSearch:   true,
 			MaxDepth:          0, // 0 = unlimited depth
@@ -97,6 +142,7 @@ func DefaultConfig() *Config {
 			GroupByFolder:     false,
 			SkipEmptyDirs:     true,
 			FollowSymlinks:    false,
+			OnConflict:        "skip",
 		},
 	}
 }
@@ -124,7 +170,7 @@ func LoadConfig() (*Config, error) {
 		if err := defaultConfig.Save(); err != nil {
 			return nil, fmt.Errorf("failed to save default config: %v", err)
 		}
-		return defaultConfig, nil
+		return defaultConfig, defaultConfig.parseOutputSettings()
 	}
 
 	//load existing config - use ReadFile for better performance
@@ -137,9 +183,22 @@ func LoadConfig() (*Config, error) {
 	if err := yaml.Unmarshal(data, &conf); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config file: %v", err)
 	}
+	if err := conf.parseOutputSettings(); err != nil {
+		return nil, err
+	}
 	return &conf, nil
 }
 
+// parseOutputSettings validates OutputSettings and stores its typed form in Encoders.
+func (c *Config) parseOutputSettings() error {
+	encoders, err := ParseEncoderSettings(c.OutputSettings)
+	if err != nil {
+		return fmt.Errorf("invalid output settings: %v", err)
+	}
+	c.Encoders = encoders
+	return nil
+}
+
 // Save writes the current configuration to a YAML file in the user's config directory.
 // It marshals the Config struct to YAML format and saves it as "config.yaml".
 // If the marshaling or file writing fails, it returns an error detailing the failure.
@@ -0,0 +1,388 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PNG compression levels accepted in output_settings.png.compression.
+var pngCompressionLevels = []string{"default", "no_compression", "best_speed", "best_compression"}
+
+// PNG optimisation levels accepted in output_settings.png.optimize.
+const (
+	// PNGOptimizeNone encodes PNGs with the configured compression only.
+	PNGOptimizeNone = "none"
+	// PNGOptimizeLossless picks the smallest colour type, bit depth and
+	// filters that store the pixels exactly.
+	PNGOptimizeLossless = "lossless"
+	// PNGOptimizeLossy quantises images with more than 256 colours to a
+	// dithered palette before optimising them losslessly.
+	PNGOptimizeLossy = "lossy"
+)
+
+var pngOptimizeLevels = []string{PNGOptimizeNone, PNGOptimizeLossless, PNGOptimizeLossy}
+
+// Chroma subsampling modes accepted in output_settings.jpg.subsampling.
+const (
+	Subsampling444 = "4:4:4"
+	Subsampling422 = "4:2:2"
+	Subsampling420 = "4:2:0"
+	// SubsamplingAuto keeps full chroma resolution for graphics and
+	// subsamples photos.
+	SubsamplingAuto = "auto"
+)
+
+var jpegSubsamplings = []string{Subsampling444, Subsampling422, Subsampling420, SubsamplingAuto}
+
+// TIFF compressions accepted in output_settings.tiff.compression.
+var tiffCompressions = []string{"none", "deflate"}
+
+// AVIF encoder speeds accepted in output_settings.avif.speed, from the slowest
+// and smallest to the fastest.
+const (
+	MinAVIFSpeed = 1
+	MaxAVIFSpeed = 10
+)
+
+// EncoderSettings holds the typed per-format encoder options parsed from the
+// output_settings section of the configuration file.
+type EncoderSettings struct {
+	PNG  PNGSettings  `json:"png"`
+	JPEG JPEGSettings `json:"jpeg"`
+	WebP WebPSettings `json:"webp"`
+	TIFF TIFFSettings `json:"tiff"`
+	AVIF AVIFSettings `json:"avif"`
+}
+
+// PNGSettings contains the options of the PNG encoder.
+type PNGSettings struct {
+	Compression string `json:"compression"` // default, no_compression, best_speed or best_compression
+	Optimize    string `json:"optimize"`    // none, lossless or lossy; overrides Compression
+}
+
+// JPEGSettings contains the options of the JPEG encoder.
+type JPEGSettings struct {
+	Quality         int    `json:"quality"` // 1-100, 0 = use the global quality
+	Progressive     bool   `json:"progressive"`
+	Subsampling     string `json:"subsampling"`      // 4:4:4, 4:2:2, 4:2:0 or auto
+	OptimizeHuffman bool   `json:"optimize_huffman"` // Progressive JPEGs always optimize
+}
+
+// TIFFSettings contains the options of the TIFF encoder.
+type TIFFSettings struct {
+	Compression string `json:"compression"` // none or deflate
+}
+
+// AVIFSettings contains the options of the AVIF encoder.
+type AVIFSettings struct {
+	Quality int `json:"quality"` // 1-100, 0 = use the global quality; 100 is lossless
+	Speed   int `json:"speed"`   // 1 (slowest, smallest) to 10 (fastest)
+}
+
+// WebPSettings contains the options of the WebP encoder.
+type WebPSettings struct {
+	Quality  int  `json:"quality"` // 1-100, 0 = use the global quality
+	Lossless bool `json:"lossless"`
+	Exact    bool `json:"exact"` // Preserve RGB values under fully transparent pixels
+
+	// AutoLossless picks lossless per image, for graphics such as PNGs with
+	// transparency or few colours, and lossy for photos. It overrides Lossless.
+	AutoLossless bool `json:"auto_lossless"`
+
+	// NearLossless rounds the colour channels of lossless outputs before
+	// encoding them, trading invisible changes for smaller files.
+	NearLossless bool `json:"near_lossless"`
+}
+
+// Lossless modes of output_settings.webp.lossless and --lossless besides
+// true and false.
+const (
+	// LosslessAuto picks lossless or lossy WebP encoding per image.
+	LosslessAuto = "auto"
+	// LosslessNear encodes losslessly after moving every colour channel by
+	// at most 2 levels.
+	LosslessNear = "near"
+)
+
+// SetLossless applies a lossless mode given as "true", "false", "auto" or "near".
+func (ws *WebPSettings) SetLossless(mode string) error {
+	switch strings.ToLower(mode) {
+	case "true":
+		ws.Lossless, ws.AutoLossless, ws.NearLossless = true, false, false
+	case "false":
+		ws.Lossless, ws.AutoLossless, ws.NearLossless = false, false, false
+	case LosslessAuto:
+		ws.Lossless, ws.AutoLossless, ws.NearLossless = false, true, false
+	case LosslessNear:
+		ws.Lossless, ws.AutoLossless, ws.NearLossless = true, false, true
+	default:
+		return fmt.Errorf("unknown lossless mode %q (true, false, auto, near)", mode)
+	}
+	return nil
+}
+
+// LosslessMode returns the lossless mode as "true", "false", "auto" or "near".
+func (ws WebPSettings) LosslessMode() string {
+	switch {
+	case ws.AutoLossless:
+		return LosslessAuto
+	case ws.NearLossless:
+		return LosslessNear
+	}
+	return strconv.FormatBool(ws.Lossless)
+}
+
+// DefaultEncoderSettings returns the encoder settings used when output_settings is empty.
+func DefaultEncoderSettings() EncoderSettings {
+	return EncoderSettings{
+		PNG:  PNGSettings{Compression: "best_speed", Optimize: PNGOptimizeNone},
+		JPEG: JPEGSettings{Subsampling: Subsampling420},
+		TIFF: TIFFSettings{Compression: "deflate"},
+		AVIF: AVIFSettings{Speed: 8},
+	}
+}
+
+// WithQuality returns a copy of the settings in which every per-format quality
+// that is not set falls back to the given global quality.
+func (es EncoderSettings) WithQuality(quality uint16) EncoderSettings {
+	if es.JPEG.Quality == 0 {
+		es.JPEG.Quality = int(quality)
+	}
+	if es.WebP.Quality == 0 {
+		es.WebP.Quality = int(quality)
+	}
+	if es.AVIF.Quality == 0 {
+		es.AVIF.Quality = int(quality)
+	}
+	return es
+}
+
+// OverriddenQualities lists the per-format qualities that are set and differ
+// from the given global quality, e.g. "output_settings.jpg.quality (80)".
+func (es EncoderSettings) OverriddenQualities(quality uint16) []string {
+	var overridden []string
+	for _, setting := range []struct {
+		format  string
+		quality int
+	}{{"jpg", es.JPEG.Quality}, {"webp", es.WebP.Quality}, {"avif", es.AVIF.Quality}} {
+		if setting.quality != 0 && setting.quality != int(quality) {
+			overridden = append(overridden, fmt.Sprintf("output_settings.%s.quality (%d)", setting.format, setting.quality))
+		}
+	}
+	return overridden
+}
+
+// OverrideQuality returns a copy of the settings in which every per-format
+// quality is replaced by the given one, used when -q is passed explicitly.
+func (es EncoderSettings) OverrideQuality(quality uint16) EncoderSettings {
+	es.JPEG.Quality = int(quality)
+	es.WebP.Quality = int(quality)
+	es.AVIF.Quality = int(quality)
+	return es
+}
+
+// ValidatePNGCompression checks that name is a supported PNG compression level.
+func ValidatePNGCompression(name string) error {
+	return validateChoice("png compression", name, pngCompressionLevels)
+}
+
+// ValidatePNGOptimize checks that level is a supported PNG optimisation level.
+func ValidatePNGOptimize(level string) error {
+	return validateChoice("png optimisation level", level, pngOptimizeLevels)
+}
+
+// validateChoice checks that value is one of choices.
+func validateChoice(what, value string, choices []string) error {
+	for _, choice := range choices {
+		if value == choice {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown %s %q (%s)", what, value, strings.Join(choices, ", "))
+}
+
+// ParseEncoderSettings converts the raw output_settings map into typed encoder
+// settings. Unknown formats, unknown keys and out-of-range values are errors,
+// so typos in config.yaml are reported instead of silently ignored.
+//
+// "jpg"/"jpeg" and "tif"/"tiff" configure the same encoder; if both names are
+// present they must agree.
+func ParseEncoderSettings(raw map[string]interface{}) (EncoderSettings, error) {
+	settings := DefaultEncoderSettings()
+
+	// Sort formats so errors are reported deterministically
+	formats := make([]string, 0, len(raw))
+	for format := range raw {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+
+	// jpg and jpeg name the same encoder, jpegSeen records which set each key
+	jpegSeen, tiffSeen := map[string]string{}, ""
+	for _, format := range formats {
+		options, ok := raw[format].(map[string]interface{})
+		if !ok {
+			if raw[format] == nil {
+				continue
+			}
+			return settings, fmt.Errorf("output_settings.%s must be a mapping", format)
+		}
+
+		for key, value := range options {
+			field := "output_settings." + format + "." + key
+			var err error
+
+			// checkJPEGAlias fails if the other name of the JPEG encoder set key differently
+			checkJPEGAlias := func(differs bool) error {
+				if seen, ok := jpegSeen[key]; ok && differs {
+					return fmt.Errorf("%s conflicts with output_settings.%s.%s", field, seen, key)
+				}
+				jpegSeen[key] = format
+				return nil
+			}
+
+			switch format + "." + key {
+			case "png.compression":
+				var name string
+				if name, err = asString(field, value); err == nil {
+					err = ValidatePNGCompression(name)
+					settings.PNG.Compression = name
+				}
+			case "png.optimize":
+				var level string
+				if level, err = asString(field, value); err == nil {
+					err = ValidatePNGOptimize(level)
+					settings.PNG.Optimize = level
+				}
+			case "jpg.quality", "jpeg.quality":
+				var quality int
+				if quality, err = asQuality(field, value); err == nil {
+					err = checkJPEGAlias(settings.JPEG.Quality != quality)
+					settings.JPEG.Quality = quality
+				}
+			case "jpg.progressive", "jpeg.progressive":
+				var progressive bool
+				if progressive, err = asBool(field, value); err == nil {
+					err = checkJPEGAlias(settings.JPEG.Progressive != progressive)
+					settings.JPEG.Progressive = progressive
+				}
+			case "jpg.subsampling", "jpeg.subsampling":
+				var subsampling string
+				if subsampling, err = asString(field, value); err == nil {
+					err = validateChoice("jpeg subsampling", subsampling, jpegSubsamplings)
+					if err == nil {
+						err = checkJPEGAlias(settings.JPEG.Subsampling != subsampling)
+					}
+					settings.JPEG.Subsampling = subsampling
+				}
+			case "jpg.optimize_huffman", "jpeg.optimize_huffman":
+				var optimize bool
+				if optimize, err = asBool(field, value); err == nil {
+					err = checkJPEGAlias(settings.JPEG.OptimizeHuffman != optimize)
+					settings.JPEG.OptimizeHuffman = optimize
+				}
+			case "webp.quality":
+				settings.WebP.Quality, err = asQuality(field, value)
+			case "webp.lossless":
+				switch value {
+				case true, false:
+					settings.WebP.Lossless = value.(bool)
+				case LosslessAuto:
+					settings.WebP.AutoLossless = true
+				case LosslessNear:
+					settings.WebP.Lossless, settings.WebP.NearLossless = true, true
+				default:
+					err = fmt.Errorf("%s must be true, false, auto or near", field)
+				}
+			case "webp.exact":
+				settings.WebP.Exact, err = asBool(field, value)
+			case "tif.compression", "tiff.compression":
+				var name string
+				if name, err = asString(field, value); err == nil {
+					err = validateChoice("tiff compression", name, tiffCompressions)
+					if err == nil && tiffSeen != "" && settings.TIFF.Compression != name {
+						err = fmt.Errorf("%s conflicts with output_settings.%s.compression", field, tiffSeen)
+					}
+					settings.TIFF.Compression = name
+					tiffSeen = format
+				}
+			case "avif.quality":
+				settings.AVIF.Quality, err = asQuality(field, value)
+			case "avif.speed":
+				settings.AVIF.Speed, err = asSpeed(field, value)
+			case "webp.method":
+				err = fmt.Errorf("%s is not supported by the bundled WebP encoder", field)
+			default:
+				err = fmt.Errorf("unknown setting %s", field)
+			}
+
+			if err != nil {
+				return settings, err
+			}
+		}
+	}
+
+	return settings, nil
+}
+
+// asString converts a YAML value to a string.
+func asString(field string, value interface{}) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", field)
+	}
+	return s, nil
+}
+
+// asBool converts a YAML value to a bool.
+func asBool(field string, value interface{}) (bool, error) {
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s must be true or false", field)
+	}
+	return b, nil
+}
+
+// asQuality converts a YAML value to a quality between 1 and 100.
+func asQuality(field string, value interface{}) (int, error) {
+	var quality int
+	switch v := value.(type) {
+	case int:
+		quality = v
+	case float64:
+		quality = int(v)
+		if float64(quality) != v {
+			return 0, fmt.Errorf("%s must be a whole number", field)
+		}
+	default:
+		return 0, fmt.Errorf("%s must be a number", field)
+	}
+
+	if quality < 1 || quality > 100 {
+		return 0, fmt.Errorf("%s must be between 1 and 100", field)
+	}
+	return quality, nil
+}
+
+// asSpeed converts a YAML value to an AVIF encoder speed.
+func asSpeed(field string, value interface{}) (int, error) {
+	var speed int
+	switch v := value.(type) {
+	case int:
+		speed = v
+	case float64:
+		speed = int(v)
+		if float64(speed) != v {
+			return 0, fmt.Errorf("%s must be a whole number", field)
+		}
+	default:
+		return 0, fmt.Errorf("%s must be a number", field)
+	}
+
+	if speed < MinAVIFSpeed || speed > MaxAVIFSpeed {
+		return 0, fmt.Errorf("%s must be between %d and %d", field, MinAVIFSpeed, MaxAVIFSpeed)
+	}
+	return speed, nil
+}
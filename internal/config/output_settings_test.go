@@ -0,0 +1,97 @@
+package config
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TestQualityPrecedence checks which quality each encoder ends up with when
+// config.yaml sets a top-level quality, per-format qualities or both, and -q
+// is given or not.
+func TestQualityPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		yaml       string
+		flag       uint16 // Quality passed with -q, 0 if none
+		jpeg, webp int
+		avif       int
+		overridden int // Number of per-format qualities reported as overriding
+	}{
+		{
+			name: "top-level only",
+			yaml: "quality: 60\n",
+			jpeg: 60, webp: 60, avif: 60,
+		},
+		{
+			name: "per-format overrides top-level",
+			yaml: "quality: 60\noutput_settings:\n  jpg:\n    quality: 90\n  avif:\n    quality: 40\n",
+			jpeg: 90, webp: 60, avif: 40, overridden: 2,
+		},
+		{
+			name: "per-format equal to top-level",
+			yaml: "quality: 70\noutput_settings:\n  webp:\n    quality: 70\n",
+			jpeg: 70, webp: 70, avif: 70,
+		},
+		{
+			name: "flag overrides everything",
+			yaml: "quality: 60\noutput_settings:\n  jpeg:\n    quality: 90\n  webp:\n    quality: 50\n",
+			flag: 75,
+			jpeg: 75, webp: 75, avif: 75,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf Config
+			if err := yaml.Unmarshal([]byte(tt.yaml), &conf); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if err := conf.parseOutputSettings(); err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+
+			// Mirrors the command: -q replaces the per-format qualities, the
+			// converter fills in the ones left unset
+			encoders, quality := conf.Encoders, conf.Quality
+			if tt.flag != 0 {
+				encoders, quality = encoders.OverrideQuality(tt.flag), tt.flag
+			} else if got := len(encoders.OverriddenQualities(quality)); got != tt.overridden {
+				t.Errorf("%d overriding qualities reported, want %d", got, tt.overridden)
+			}
+			encoders = encoders.WithQuality(quality)
+
+			if encoders.JPEG.Quality != tt.jpeg || encoders.WebP.Quality != tt.webp || encoders.AVIF.Quality != tt.avif {
+				t.Errorf("qualities jpeg %d, webp %d, avif %d, want %d, %d, %d",
+					encoders.JPEG.Quality, encoders.WebP.Quality, encoders.AVIF.Quality, tt.jpeg, tt.webp, tt.avif)
+			}
+		})
+	}
+}
+
+// TestDefaultConfigFollowsQuality checks that editing the top-level quality
+// of a freshly written config file changes the quality of every format.
+func TestDefaultConfigFollowsQuality(t *testing.T) {
+	defaults := DefaultConfig()
+	defaults.Quality = 55
+	data, err := yaml.Marshal(defaults)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var conf Config
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if err := conf.parseOutputSettings(); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if overridden := conf.Encoders.OverriddenQualities(conf.Quality); len(overridden) > 0 {
+		t.Errorf("default config overrides the quality with %v", overridden)
+	}
+	encoders := conf.Encoders.WithQuality(conf.Quality)
+	if encoders.JPEG.Quality != 55 || encoders.WebP.Quality != 55 || encoders.AVIF.Quality != 55 {
+		t.Errorf("qualities jpeg %d, webp %d, avif %d, want 55", encoders.JPEG.Quality, encoders.WebP.Quality, encoders.AVIF.Quality)
+	}
+}
@@ -0,0 +1,130 @@
+package converter
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+// Backgrounds that transparency is flattened onto.
+const (
+	// BackgroundAuto takes the background from the corner pixels of the image.
+	BackgroundAuto = "auto"
+	// DefaultBackground is white, the usual page colour behind transparent images.
+	DefaultBackground = "#ffffff"
+)
+
+// Policies for sources with transparency converted to a format without alpha.
+const (
+	// TransparencyWarn flattens the image onto the background and reports it.
+	TransparencyWarn = "warn"
+	// TransparencyRefuse fails the conversion and keeps the source.
+	TransparencyRefuse = "refuse"
+)
+
+// TransparencyPolicies lists the accepted transparency policies.
+var TransparencyPolicies = []string{TransparencyWarn, TransparencyRefuse}
+
+// namedBackgrounds are the colour names accepted besides hex notation.
+var namedBackgrounds = map[string]string{
+	"white": "#ffffff",
+	"black": "#000000",
+}
+
+// ParseBackground checks a background colour given as "#rrggbb", "#rgb", a
+// name (white, black) or "auto" and returns it in canonical form, e.g.
+// "#ffffff" or "auto".
+func ParseBackground(background string) (string, error) {
+	background = strings.ToLower(strings.TrimSpace(background))
+	if background == BackgroundAuto {
+		return background, nil
+	}
+	if named, ok := namedBackgrounds[background]; ok {
+		return named, nil
+	}
+
+	hex := strings.TrimPrefix(background, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if _, err := strconv.ParseUint(hex, 16, 32); err != nil || len(hex) != 6 {
+		return "", fmt.Errorf("invalid background %q (#rrggbb, #rgb, white, black or auto)", background)
+	}
+	return "#" + hex, nil
+}
+
+// storesAlpha reports whether an output of format keeps the transparency of
+// img. JPEG has no alpha channel. GIF encoding maps images onto a fixed
+// palette without a transparent entry, only paletted images keep their own.
+func storesAlpha(format string, img image.Image) bool {
+	switch strings.ToLower(format) {
+	case "jpg", "jpeg":
+		return false
+	case "gif":
+		_, paletted := img.(*image.Paletted)
+		return paletted
+	default:
+		return true
+	}
+}
+
+// backgroundColor returns the colour img is flattened onto. The automatic
+// background averages the colours of the four corners weighted by their
+// opacity, so a solid frame around the image continues behind its transparent
+// parts. Images whose corners are all fully transparent fall back to white.
+func (ic *ImageConverter) backgroundColor(img image.Image) color.NRGBA {
+	background := ic.options.Background
+	if background == "" {
+		background = DefaultBackground
+	}
+
+	if background == BackgroundAuto {
+		bounds := img.Bounds()
+		corners := []image.Point{
+			bounds.Min,
+			{bounds.Max.X - 1, bounds.Min.Y},
+			{bounds.Min.X, bounds.Max.Y - 1},
+			bounds.Max.Sub(image.Pt(1, 1)),
+		}
+		// Premultiplied channels already carry the weight of their alpha
+		var r, g, b, a uint64
+		for _, corner := range corners {
+			cr, cg, cb, ca := img.At(corner.X, corner.Y).RGBA()
+			r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+		}
+		if a == 0 {
+			background = DefaultBackground
+		} else {
+			return color.NRGBA{R: uint8(r * 0xff / a), G: uint8(g * 0xff / a), B: uint8(b * 0xff / a), A: 0xff}
+		}
+	}
+
+	value, _ := strconv.ParseUint(strings.TrimPrefix(background, "#"), 16, 32)
+	return color.NRGBA{R: uint8(value >> 16), G: uint8(value >> 8), B: uint8(value), A: 0xff}
+}
+
+// flattenAlpha composites img onto an opaque background of the given colour.
+// 16-bit images stay 16-bit.
+func flattenAlpha(img image.Image, background color.Color) image.Image {
+	bounds := img.Bounds()
+	rect := image.Rectangle{Max: bounds.Size()}
+
+	var dst draw.Image
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64:
+		dst = image.NewRGBA64(rect)
+	default:
+		dst = image.NewRGBA(rect)
+	}
+	draw.Draw(dst, rect, image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(dst, rect, img, bounds.Min, draw.Over)
+	return dst
+}
+
+// hexColor formats c as "#rrggbb".
+func hexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
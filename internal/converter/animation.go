@@ -0,0 +1,235 @@
+package converter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// animation is a decoded multi-frame image. Every frame is already composed
+// onto the full canvas with the disposal and blending of the source applied,
+// so frames can be resized and re-encoded independently of each other.
+type animation struct {
+	frames []*image.RGBA
+	delays []int // Display duration of each frame in milliseconds
+	loops  int   // Number of times the animation plays, 0 = forever
+	format string
+}
+
+// maxAnimationPixels caps the canvas area times the frame count of an
+// animation. Every frame is kept composed onto the full canvas at 4 bytes per
+// pixel, so a single animation takes at most 1 GiB.
+const maxAnimationPixels = 1 << 28
+
+// canAnimate reports whether format can store more than one frame.
+func canAnimate(format string) bool {
+	return format == "gif" || format == "webp"
+}
+
+// decodeAnimation decodes an animated GIF or WebP from r. For any other input
+// it returns nil without consuming r, so the caller can decode it as a still.
+// GIFs are always returned as an animation, possibly with a single frame,
+// because their frames only make sense composed onto the canvas.
+func decodeAnimation(r *bufio.Reader) (*animation, error) {
+	header, _ := r.Peek(21)
+
+	switch {
+	case bytes.HasPrefix(header, []byte("GIF8")):
+		return decodeGIFAnimation(r)
+	case isAnimatedWebP(header):
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return decodeWebPAnimation(data)
+	}
+	return nil, nil
+}
+
+// decodeGIFAnimation decodes every frame of a GIF and composes it onto the
+// canvas, honouring each frame's disposal method.
+func decodeGIFAnimation(r io.Reader) (*animation, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) == 0 {
+		return nil, fmt.Errorf("gif has no frames")
+	}
+
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+	if err := checkAnimationSize(len(g.Image), bounds); err != nil {
+		return nil, err
+	}
+
+	anim := &animation{
+		frames: make([]*image.RGBA, 0, len(g.Image)),
+		delays: make([]int, 0, len(g.Image)),
+		loops:  gifLoopsToPlays(g.LoopCount),
+		format: "gif",
+	}
+
+	canvas := image.NewRGBA(bounds)
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		anim.frames = append(anim.frames, cloneRGBA(canvas))
+
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i] * 10 // GIF delays are in 1/100 s
+		}
+		anim.delays = append(anim.delays, delay)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return anim, nil
+}
+
+// encodeGIFAnimation writes anim as an animated GIF. Each frame is reduced to
+// the Plan 9 palette with Floyd-Steinberg dithering, like single GIF images.
+func encodeGIFAnimation(w io.Writer, anim *animation) error {
+	bounds := anim.frames[0].Bounds()
+	g := &gif.GIF{
+		Image:     make([]*image.Paletted, 0, len(anim.frames)),
+		Delay:     make([]int, 0, len(anim.frames)),
+		Disposal:  make([]byte, 0, len(anim.frames)),
+		LoopCount: playsToGIFLoops(anim.loops),
+		Config:    image.Config{Width: bounds.Dx(), Height: bounds.Dy()},
+	}
+
+	// Frames cover the whole canvas, so they only have to clear their
+	// predecessor when transparent pixels would otherwise show it
+	disposal := byte(gif.DisposalNone)
+	for _, frame := range anim.frames {
+		if !frame.Opaque() {
+			disposal = gif.DisposalBackground
+			break
+		}
+	}
+
+	for i, frame := range anim.frames {
+		g.Image = append(g.Image, quantizeFrame(frame))
+		g.Delay = append(g.Delay, (anim.delays[i]+5)/10)
+		g.Disposal = append(g.Disposal, disposal)
+	}
+
+	return gif.EncodeAll(w, g)
+}
+
+// quantizeFrame converts a frame to the Plan 9 palette. Frames with
+// transparency give up the last palette entry for a transparent colour.
+func quantizeFrame(frame *image.RGBA) *image.Paletted {
+	if frame.Opaque() {
+		paletted := image.NewPaletted(frame.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, frame.Bounds(), frame, frame.Bounds().Min)
+		return paletted
+	}
+
+	pal := make(color.Palette, 0, 256)
+	pal = append(pal, palette.Plan9[:255]...)
+	pal = append(pal, color.RGBA{})
+	transparent := uint8(len(pal) - 1)
+
+	paletted := image.NewPaletted(frame.Bounds(), pal)
+	draw.FloydSteinberg.Draw(paletted, frame.Bounds(), frame, frame.Bounds().Min)
+
+	// GIF transparency is all or nothing, cut it at half opacity
+	bounds := frame.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if frame.RGBAAt(x, y).A < 0x80 {
+				paletted.SetColorIndex(x, y, transparent)
+			}
+		}
+	}
+	return paletted
+}
+
+// resizeAnimation resizes every frame of the animation according to spec.
+func (ic *ImageConverter) resizeAnimation(anim *animation, spec ResizeSpec) {
+	for i, frame := range anim.frames {
+		resized := ic.resizeImage(frame, spec)
+		if resized == image.Image(frame) {
+			return // All frames share the canvas size
+		}
+		anim.frames[i] = toRGBA(resized)
+	}
+}
+
+// gifLoopsToPlays converts a GIF loop count, where 0 repeats forever, -1 plays
+// once and n repeats n more times, into a number of plays.
+func gifLoopsToPlays(loopCount int) int {
+	switch {
+	case loopCount == 0:
+		return 0
+	case loopCount < 0:
+		return 1
+	default:
+		return loopCount + 1
+	}
+}
+
+// playsToGIFLoops is the inverse of gifLoopsToPlays.
+func playsToGIFLoops(plays int) int {
+	switch plays {
+	case 0:
+		return 0
+	case 1:
+		return -1
+	default:
+		return plays - 1
+	}
+}
+
+// checkAnimationSize fails for animations whose composed frames would exceed
+// maxAnimationPixels, before any of them is allocated.
+func checkAnimationSize(frames int, canvas image.Rectangle) error {
+	pixels := int64(max(frames, 1)) * int64(canvas.Dx()) * int64(canvas.Dy())
+	if pixels > maxAnimationPixels {
+		return fmt.Errorf("animation too large: %d frames of %dx%d exceed %d megapixels in total",
+			frames, canvas.Dx(), canvas.Dy(), maxAnimationPixels/1_000_000)
+	}
+	return nil
+}
+
+// cloneRGBA returns a copy of img.
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	clone := image.NewRGBA(img.Bounds())
+	copy(clone.Pix, img.Pix)
+	return clone
+}
+
+// toRGBA returns img as *image.RGBA, converting it if necessary.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
@@ -0,0 +1,30 @@
+package converter
+
+import (
+	"image"
+	"io"
+
+	"github.com/gen2brain/avif"
+
+	"github.com/MostafaSensei106/GoPix/internal/config"
+)
+
+// avifBrands are the ftyp brands of HEIF files holding AV1 coded images:
+// stills (avif) and sequences (avis).
+//
+// The avif package registers files with either as major brand. Files with a
+// structural HEIF brand are routed to it by sniffHEIF when their compatible
+// brands name AV1. Sequences decode to their first frame.
+var avifBrands = []string{"avif", "avis"}
+
+// encodeAVIF writes img as a still AVIF image with 4:2:0 chroma. Quality 100
+// is lossless, lower speeds take longer to find smaller files of the same
+// quality.
+func encodeAVIF(w io.Writer, img image.Image, settings config.AVIFSettings) error {
+	return avif.Encode(w, img, avif.Options{
+		Quality:           settings.Quality,
+		QualityAlpha:      settings.Quality,
+		Speed:             settings.Speed,
+		ChromaSubsampling: image.YCbCrSubsampleRatio420,
+	})
+}
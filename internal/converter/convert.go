@@ -2,34 +2,102 @@ package converter
 
 import (
 	"bufio"
-	"crypto/md5"
-	"encoding/hex"
+	"bytes"
+	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
+	"image/gif"
 	"image/png"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/chai2010/webp"
-	"github.com/nfnt/resize"
-	// "golang.org/x/image/bmp"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+
+	"github.com/MostafaSensei106/GoPix/internal/cache"
+	"github.com/MostafaSensei106/GoPix/internal/config"
 )
 
 // ConvertOptions contains the settings for the image conversion process.
 type ConvertOptions struct {
-	Quality      uint16
-	MaxDimension uint16
-	KeepOriginal bool
-	DryRun       bool
-	Backup       bool
+	Quality      uint16 `json:"quality"`
+	MaxDimension uint16 `json:"max_dimension"`
+	KeepOriginal bool   `json:"keep_original"`
+	DryRun       bool   `json:"dry_run"`
+	Backup       bool   `json:"backup"`
+
+	// MinSimilarity is the structural similarity (0-1) the output must reach
+	// before the original is deleted; 0 only checks decoding and dimensions.
+	MinSimilarity float64 `json:"min_similarity"`
+
+	// ChangeDetection selects how unchanged sources and outputs are recognised,
+	// see ChangeDetectionModTime and ChangeDetectionHash.
+	ChangeDetection string `json:"change_detection"`
+	// Sidecar writes a "<output>.gopix.json" provenance file next to each output.
+	Sidecar bool `json:"sidecar"`
+
+	// Encoders holds the per-format encoder settings. Qualities left at 0 use Quality.
+	Encoders config.EncoderSettings `json:"encoders"`
+	// Frames is the policy for animated and multi-page sources, see FramesFirst and FramesAll.
+	Frames string `json:"frames"`
+	// Metadata is the policy for EXIF, XMP and ICC data, see MetadataPolicies.
+	Metadata string `json:"metadata"`
+	// ColorProfile selects how non-sRGB sources are handled, see ColorProfileEmbed and ColorProfileSRGB.
+	ColorProfile string `json:"color_profile"`
+
+	// Resize scales images before MaxDimension applies; the zero value keeps their size.
+	Resize ResizeSpec `json:"resize"`
+	// Filter is the resampling filter used for resizing, see Filters.
+	Filter string `json:"filter"`
+	// NoUpscale keeps images smaller than the resize target at their size.
+	NoUpscale bool `json:"no_upscale"`
+
+	// Variants are the renditions written for each source instead of a single
+	// output, see ParseVariants.
+	Variants []Variant `json:"variants,omitempty"`
+	// VariantTemplate names variant outputs, see DefaultVariantTemplate.
+	VariantTemplate string `json:"variant_template,omitempty"`
+
+	// Background is the colour transparent areas are flattened onto for
+	// formats without alpha, see ParseBackground.
+	Background string `json:"background"`
+	// Transparency is the policy for transparent sources converted to formats
+	// without alpha, see TransparencyPolicies.
+	Transparency string `json:"transparency"`
+
+	// TargetSize is the largest size in bytes of JPEG and lossy WebP outputs,
+	// whose quality is searched per image to fit. 0 uses the set quality.
+	TargetSize int64 `json:"target_size,omitempty"`
+	// TargetSimilarity is the structural similarity (0-1) JPEG and lossy WebP
+	// outputs must reach at the lowest quality found per image. 0 uses the set
+	// quality.
+	TargetSimilarity float64 `json:"target_similarity,omitempty"`
+
+	// OnlyIfSmaller discards outputs that are not smaller than their source
+	// by at least MinSavings percent and keeps the source instead.
+	OnlyIfSmaller bool    `json:"only_if_smaller,omitempty"`
+	MinSavings    float64 `json:"min_savings,omitempty"`
 }
 
+// SupportedFormats lists the formats images can be converted to.
+var SupportedFormats = []string{"png", "jpg", "jpeg", "webp", "gif", "bmp", "tif", "tiff", "avif"}
+
+// Change detection modes.
+const (
+	// ChangeDetectionModTime trusts a file whose size and modification time are unchanged.
+	ChangeDetectionModTime = "mtime"
+	// ChangeDetectionHash re-hashes file contents, which survives rsync, git
+	// checkouts and cameras that reset modification times.
+	ChangeDetectionHash = "hash"
+)
+
 // ConversionResult holds the outcome of a single image conversion.
 type ConversionResult struct {
 	OriginalPath string
@@ -38,6 +106,49 @@ type ConversionResult struct {
 	NewSize      int64
 	Duration     time.Duration
 	Error        error
+	CacheHit     bool // Output of an earlier run was reused
+
+	// SourceProfile names the ICC profile of a source with non-sRGB colours,
+	// it is empty for sRGB and untagged sources
+	SourceProfile string
+	// ProfileAction tells what happened to that profile: ProfileEmbedded,
+	// ProfileConverted or ProfileDropped
+	ProfileAction string
+
+	// Variant names the variant of the output, e.g. "640 webp", it is empty
+	// for conversions without variants
+	Variant string
+
+	// Background is the colour the transparency of the source was flattened
+	// onto for a format without alpha, e.g. "#ffffff", it is empty otherwise
+	Background string
+
+	// Quality is the quality found for TargetSize or TargetSimilarity, it is
+	// 0 if the quality was not searched
+	Quality int
+	// QualityMissed is set if no quality met the target, Quality is then the
+	// closest one
+	QualityMissed bool
+
+	// NotBeneficial is set if OnlyIfSmaller discarded the output and kept the
+	// source, NewSize is then the size the output would have had
+	NotBeneficial bool
+
+	// Conflict tells how a clash of the output with another output or an
+	// existing file was resolved, it is empty if there was none
+	Conflict string
+	// Skipped is set for sources left unconverted by the conflict policy and
+	// for sources already in the target format
+	Skipped bool
+}
+
+// encodedOutput describes an output written by convertImageOptimized.
+type encodedOutput struct {
+	reference  image.Image // Image handed to the encoder, the first frame of animations
+	frames     int
+	profile    profileDecision
+	background string         // Colour transparency was flattened onto, empty if there was none
+	search     *qualitySearch // Quality found for the target, nil if it was not searched
 }
 
 // ImageConverter is responsible for converting images.
@@ -45,15 +156,13 @@ type ImageConverter struct {
 	options ConvertOptions
 	bufPool *bufferPool
 
-	cache sync.Map
-}
+	// cache is the persistent conversion cache, nil when caching is disabled
+	cache *cache.Store
+	// reuseCache is set if sources with an up-to-date output in cache are skipped
+	reuseCache bool
 
-// cacheEntry stores metadata about converted images.
-type cacheEntry struct {
-	outputPath   string
-	outputSize   int64
-	lastModified time.Time
-	configHash   string
+	// partialOutputs holds the paths of temporary output files that are currently being written
+	partialOutputs sync.Map
 }
 
 // bufferPool manages reusable buffers to reduce GC pressure using sync.Pool
@@ -82,13 +191,19 @@ func (bp *bufferPool) put(buf []byte) {
 
 // NewImageConverter returns a new ImageConverter instance.
 func NewImageConverter(options ConvertOptions) *ImageConverter {
+	options.Encoders = options.Encoders.WithQuality(options.Quality)
 	return &ImageConverter{
 		options: options,
 		bufPool: newBufferPool(32 * 1024), // 32KB buffers, pool of 10
-		cache:   sync.Map{},
 	}
 }
 
+// SetCache makes the converter record every new output in store. If reuse is
+// set, sources whose output is recorded there and unchanged are skipped.
+func (ic *ImageConverter) SetCache(store *cache.Store, reuse bool) {
+	ic.cache, ic.reuseCache = store, reuse
+}
+
 // Convert converts the image at the given path to the given format.
 func (ic *ImageConverter) Convert(path string, format string) *ConversionResult {
 	return ic.ConvertWithOutputPath(path, format, "")
@@ -96,121 +211,249 @@ func (ic *ImageConverter) Convert(path string, format string) *ConversionResult
 
 // ConvertWithOutputPath converts the image at the given path to the given format with a custom output path.
 func (ic *ImageConverter) ConvertWithOutputPath(path string, format string, outputPath string) *ConversionResult {
+	format = strings.ToLower(format)
+
+	// Use custom output path if provided, otherwise calculate default
+	if outputPath == "" {
+		// Pre-calculate new path using string builder for efficiency
+		basePath := strings.TrimSuffix(path, filepath.Ext(path))
+		outputPath = basePath + "." + format
+	}
+
+	output := VariantOutput{Variant: Variant{Format: format, Resize: ic.options.Resize}, Path: outputPath}
+	return ic.convertOutputs(path, []VariantOutput{output})[0]
+}
+
+// ConvertVariants writes every variant of the image at the given path from a
+// single decode. It returns one result per variant, in the order given. The
+// original is only removed once every variant was written and verified.
+func (ic *ImageConverter) ConvertVariants(path string, variants []VariantOutput) []*ConversionResult {
+	return ic.convertOutputs(path, variants)
+}
+
+// convertOutputs converts the image at path into each of the outputs. Outputs
+// whose cache entry is up to date are skipped, the source is only decoded if
+// at least one output has to be written.
+func (ic *ImageConverter) convertOutputs(path string, outputs []VariantOutput) []*ConversionResult {
 	start := time.Now()
-	result := &ConversionResult{
-		OriginalPath: path,
+	results := make([]*ConversionResult, len(outputs))
+	for i, output := range outputs {
+		results[i] = &ConversionResult{
+			OriginalPath: path,
+			NewPath:      output.Path,
+			Variant:      output.label(),
+		}
 	}
 
 	defer func() {
-		result.Duration = time.Since(start)
+		// The outputs share one decode, so each is charged an equal share
+		duration := time.Since(start) / time.Duration(len(results))
+		for _, result := range results {
+			result.Duration = duration
+		}
 	}()
 
+	// pending holds the indices of the outputs that still have to be written
+	pending := make([]int, 0, len(outputs))
+	fail := func(err error) []*ConversionResult {
+		for _, i := range pending {
+			results[i].Error = err
+		}
+		return results
+	}
+	for i := range outputs {
+		pending = append(pending, i)
+	}
+
 	// Get original file info - use more efficient stat
 	stat, err := os.Stat(path)
 	if err != nil {
-		result.Error = fmt.Errorf("failed to stat file: %w", err)
-		return result
+		return fail(fmt.Errorf("failed to stat file: %w", err))
 	}
-	result.OriginalSize = stat.Size()
 
 	// Optimize string operations - avoid repeated allocations
 	currentExt := getFileExtension(path)
-	format = strings.ToLower(format)
-
-	if isAlreadyInFormat(currentExt, format) {
-		result.Error = fmt.Errorf("file already in target format")
-		return result
+	pending = pending[:0]
+	for i, output := range outputs {
+		results[i].OriginalSize = stat.Size()
+
+		// Variants carry their own name, only a plain conversion would replace the source
+		if output.Name == "" && isAlreadyInFormat(currentExt, output.Format) {
+			results[i].Skipped = true
+		} else if absPath(output.Path) == absPath(path) {
+			results[i].Error = fmt.Errorf("variant %s would overwrite its source", output.label())
+		} else {
+			pending = append(pending, i)
+		}
 	}
 
-	// Use custom output path if provided, otherwise calculate default
-	if outputPath != "" {
-		result.NewPath = outputPath
-	} else {
-		// Pre-calculate new path using string builder for efficiency
-		basePath := strings.TrimSuffix(path, filepath.Ext(path))
-		result.NewPath = basePath + "." + format
+	// Hash the source when the cache or the provenance sidecar needs it
+	var sourceHash string
+	if ic.cache != nil {
+		sourceHash, err = ic.cache.SourceHash(path, stat, ic.options.ChangeDetection != ChangeDetectionHash)
+	} else if ic.options.Sidecar {
+		sourceHash, err = cache.HashFile(path)
 	}
-
-	// Check cache for existing conversion using sync.Map's Load method
-	cacheKey := ic.getCacheKey(path, format)
-	cached, exists := ic.cache.Load(cacheKey)
-
-	if exists {
-		// Type assertion for the cached value
-		cachedEntry, ok := cached.(*cacheEntry)
-		if !ok {
-			// Handle unexpected type, remove invalid entry
-			ic.cache.Delete(cacheKey)
-		} else {
-			if ic.isCacheValid(cachedEntry, stat.ModTime(), result.NewPath) {
-				result.NewSize = cachedEntry.outputSize
-				return result
+	if err != nil {
+		return fail(fmt.Errorf("failed to hash source: %w", err))
+	}
+
+	// Check the persistent cache for identical earlier conversions
+	cacheKeys := make([]string, len(outputs))
+	if ic.cache != nil {
+		uncached := pending[:0]
+		for _, i := range pending {
+			output := outputs[i]
+			configHash := ic.getConfigHash(output.Resize)
+			cacheKeys[i] = cache.Key(sourceHash, output.Format, configHash, absPath(output.Path))
+			if cached, ok := ic.cache.Lookup(cacheKeys[i]); ok && ic.reuseCache {
+				if ic.isCacheValid(cached, configHash) {
+					results[i].NewSize = cached.OutputSize
+					results[i].CacheHit = true
+					continue
+				}
+				// Remove invalid cache entry
+				ic.cache.Delete(cacheKeys[i])
 			}
-			// Remove invalid cache entry
-			ic.cache.Delete(cacheKey)
+			uncached = append(uncached, i)
 		}
+		pending = uncached
 	}
-
-	if newStat, err := os.Stat(result.NewPath); err == nil {
-		result.NewSize = newStat.Size()
-
-		// Store in cache using sync.Map's Store method
-		ic.cache.Store(cacheKey, &cacheEntry{
-			outputPath:   result.NewPath,
-			outputSize:   result.NewSize,
-			lastModified: time.Now(),
-			configHash:   ic.getConfigHash(),
-		})
+	if len(pending) == 0 {
+		return results
 	}
 
 	if ic.options.DryRun {
 		// For dry run, still check if conversion is needed using DecodeConfig
-		needsResize, err := ic.checkIfResizeNeeded(path)
-		if err != nil {
-			result.Error = err
-			return result
+		for _, i := range pending {
+			needsResize, err := ic.checkIfResizeNeeded(path, outputs[i].Resize)
+			if err != nil {
+				results[i].Error = err
+				continue
+			}
+			// Store in result for information (could extend ConversionResult if needed)
+			_ = needsResize // Use the information as needed
 		}
-		// Store in result for information (could extend ConversionResult if needed)
-		_ = needsResize // Use the information as needed
-		return result
+		return results
 	}
 
 	// Create backup if requested
 	if ic.options.Backup {
 		if err := ic.createBackup(path); err != nil {
-			result.Error = fmt.Errorf("backup failed: %w", err)
-			return result
+			return fail(fmt.Errorf("backup failed: %w", err))
 		}
 	}
 
-	// Convert image
-	if err := ic.convertImageOptimized(path, result.NewPath, format); err != nil {
-		result.Error = err
-		return result
+	// Decode once for all outputs
+	src, err := ic.decodeSource(path)
+	if err != nil {
+		return fail(err)
 	}
+	src.size = stat.Size()
 
-	// Get new file size and update cache
-	if newStat, err := os.Stat(result.NewPath); err == nil {
-		result.NewSize = newStat.Size()
+	for _, i := range pending {
+		if err := ic.writeOutput(path, sourceHash, src, outputs[i], cacheKeys[i], results[i]); err != nil {
+			results[i].Error = err
+		}
+	}
 
-		// Store in cache using sync.Map's Store method
-		ic.cache.Store(cacheKey, &cacheEntry{
-			outputPath:   result.NewPath,
-			outputSize:   result.NewSize,
-			lastModified: stat.ModTime(),
-			configHash:   ic.getConfigHash(),
-		})
+	// Remove original if not keeping, unless an output is missing
+	written := !slices.ContainsFunc(results, func(result *ConversionResult) bool {
+		return result.Error != nil || result.NotBeneficial
+	})
+	if !ic.options.KeepOriginal && written {
+		if err := os.Remove(path); err != nil {
+			results[pending[len(pending)-1]].Error = fmt.Errorf("failed to remove original: %w", err)
+		}
+	}
+
+	return results
+}
+
+// writeOutput converts the decoded source into output and fills in result.
+// The output is verified before the original may be removed, and recorded in
+// the cache under cacheKey when the original is kept.
+func (ic *ImageConverter) writeOutput(path, sourceHash string, src *decodedSource, output VariantOutput, cacheKey string, result *ConversionResult) error {
+	// Convert image
+	encoded, err := ic.convertImageOptimized(path, src, output)
+	var notBeneficial *notBeneficialError
+	if errors.As(err, &notBeneficial) {
+		// Nothing was replaced, the source stays as it is
+		result.NotBeneficial, result.NewSize = true, notBeneficial.size
+		return nil
 	}
+	if err != nil {
+		return err
+	}
+	result.SourceProfile, result.ProfileAction = encoded.profile.name, encoded.profile.action
+	result.Background = encoded.background
+	if encoded.search != nil {
+		result.Quality, result.QualityMissed = encoded.search.quality, encoded.search.missed
+	}
+
+	// Get new file size
+	newStat, err := os.Stat(output.Path)
+	if err != nil {
+		return fmt.Errorf("failed to stat output: %w", err)
+	}
+	result.NewSize = newStat.Size()
 
-	// Remove original if not keeping
+	// The original may only be removed once the output passed verification
 	if !ic.options.KeepOriginal {
-		if err := os.Remove(path); err != nil {
-			result.Error = fmt.Errorf("failed to remove original: %w", err)
-			return result
+		if err := ic.verifyOutput(output.Path, encoded.reference, encoded.frames); err != nil {
+			os.Remove(output.Path)
+			return err
+		}
+	}
+
+	var outputHash string
+	if ic.options.ChangeDetection == ChangeDetectionHash || ic.options.Sidecar {
+		outputHash, err = cache.HashFile(output.Path)
+		if err != nil {
+			return fmt.Errorf("failed to hash output: %w", err)
 		}
 	}
 
-	return result
+	// Record which source produced the output next to it
+	configHash := ic.getConfigHash(output.Resize)
+	if ic.options.Sidecar {
+		if err := ic.writeSidecar(path, sourceHash, output.Path, outputHash, output.Format, configHash); err != nil {
+			return err
+		}
+	} else {
+		// A sidecar of an earlier run no longer describes the new output
+		os.Remove(output.Path + SidecarSuffix)
+	}
+
+	// The source is about to be removed, there is nothing left to skip next time
+	if !ic.options.KeepOriginal {
+		return nil
+	}
+
+	// Remember the output so an unchanged source is skipped on the next run
+	if ic.cache != nil {
+		ic.cache.Put(cacheKey, cache.OutputEntry{
+			SourcePath:    absPath(path),
+			SourceHash:    sourceHash,
+			OutputPath:    absPath(output.Path),
+			OutputHash:    outputHash,
+			OutputSize:    result.NewSize,
+			OutputModTime: newStat.ModTime(),
+			Format:        output.Format,
+			ConfigHash:    configHash,
+			Created:       time.Now(),
+		})
+	}
+
+	return nil
+}
+
+// absPath returns the absolute form of path, or path itself if it cannot be resolved.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
 }
 
 // getFileExtension efficiently extracts and normalizes file extension.
@@ -229,14 +472,16 @@ func isAlreadyInFormat(currentExt, targetFormat string) bool {
 	if currentExt == targetFormat {
 		return true
 	}
-	// Handle jpg/jpeg equivalence
+	// Handle jpg/jpeg and tif/tiff equivalence
 	return (currentExt == "jpg" && targetFormat == "jpeg") ||
-		(currentExt == "jpeg" && targetFormat == "jpg")
+		(currentExt == "jpeg" && targetFormat == "jpg") ||
+		(currentExt == "tif" && targetFormat == "tiff") ||
+		(currentExt == "tiff" && targetFormat == "tif")
 }
 
 // checkIfResizeNeeded uses DecodeConfig to efficiently check dimensions without full decode.
-func (ic *ImageConverter) checkIfResizeNeeded(inputPath string) (bool, error) {
-	if ic.options.MaxDimension == 0 {
+func (ic *ImageConverter) checkIfResizeNeeded(inputPath string, spec ResizeSpec) (bool, error) {
+	if ic.options.MaxDimension == 0 && spec.Mode == "" {
 		return false, nil
 	}
 
@@ -252,136 +497,323 @@ func (ic *ImageConverter) checkIfResizeNeeded(inputPath string) (bool, error) {
 		return false, fmt.Errorf("failed to decode config: %w", err)
 	}
 
-	maxDim := int(ic.options.MaxDimension)
-	return config.Width > maxDim || config.Height > maxDim, nil
-}
-
-// getCacheKey generates a unique key for caching based on input path and target format.
-func (ic *ImageConverter) getCacheKey(inputPath, format string) string {
-	// Create hash from path, format, and relevant options
-	hasher := md5.New()
-	hasher.Write([]byte(inputPath))
-	hasher.Write([]byte(format))
-	configHash := ic.getConfigHash()
-	hasher.Write([]byte(configHash))
-	return hex.EncodeToString(hasher.Sum(nil))
+	size := image.Pt(config.Width, config.Height)
+	_, cropped := ic.resizePlan(size, spec)
+	return cropped != size, nil
 }
 
 // getConfigHash creates a hash of conversion settings for cache validation.
-func (ic *ImageConverter) getConfigHash() string {
-	// Pre-allocate string to avoid multiple allocations
-	return strconv.FormatUint(uint64(ic.options.Quality), 10) + "_" + strconv.FormatUint(uint64(ic.options.MaxDimension), 10)
+// It covers the encoder settings of every format, so changing any of them
+// in config.yaml or on the command line produces new outputs. The "orient"
+// marker sets apart outputs written before EXIF orientation was applied.
+// resize is the resize of the output, which variants set on their own.
+func (ic *ImageConverter) getConfigHash(resize ResizeSpec) string {
+	enc := ic.options.Encoders
+	return strconv.FormatUint(uint64(ic.options.Quality), 10) + "_" + strconv.FormatUint(uint64(ic.options.MaxDimension), 10) +
+		fmt.Sprintf("_png:%s:%s_jpeg:%d:%t:%s:%t_webp:%d:%s:%t_tiff:%s_avif:%d:%d_frames:%s_orient_metadata:%s_profile:%s_resize:%s_filter:%s_upscale:%t_background:%s_target:%d:%g",
+			pngCompressionName(enc.PNG.Compression), pngOptimizeName(enc.PNG.Optimize),
+			enc.JPEG.Quality, enc.JPEG.Progressive, jpegSubsamplingName(enc.JPEG.Subsampling), enc.JPEG.OptimizeHuffman,
+			enc.WebP.Quality, enc.WebP.LosslessMode(), enc.WebP.Exact,
+			enc.TIFF.Compression, enc.AVIF.Quality, enc.AVIF.Speed, ic.options.Frames, metadataPolicy(ic.options.Metadata), colorProfileMode(ic.options.ColorProfile),
+			resize, filterName(ic.options.Filter), !ic.options.NoUpscale, ic.options.Background,
+			ic.options.TargetSize, ic.options.TargetSimilarity)
 }
 
-// isCacheValid checks if cached conversion is still valid.
-func (ic *ImageConverter) isCacheValid(cached *cacheEntry, sourceModTime time.Time, expectedOutputPath string) bool {
-	// Check if source file is newer than cache
-	if sourceModTime.After(cached.lastModified) {
+// isCacheValid checks if cached conversion is still valid. The source is known
+// to be unchanged because its content hash is part of the cache key, so only
+// the output has to be checked. In hash mode the output content is compared
+// against the recorded hash, otherwise its size and modification time are.
+// configHash is the current getConfigHash of the output.
+func (ic *ImageConverter) isCacheValid(cached cache.OutputEntry, configHash string) bool {
+	// Check if output file still exists untouched
+	outStat, err := os.Stat(cached.OutputPath)
+	if err != nil || outStat.Size() != cached.OutputSize {
 		return false
 	}
 
-	// Check if output file still exists
-	if _, err := os.Stat(expectedOutputPath); err != nil {
+	if ic.options.ChangeDetection == ChangeDetectionHash {
+		if cached.OutputHash == "" {
+			return false
+		}
+		outputHash, err := cache.HashFile(cached.OutputPath)
+		if err != nil || outputHash != cached.OutputHash {
+			return false
+		}
+	} else if !outStat.ModTime().Equal(cached.OutputModTime) {
 		return false
 	}
 
 	// Check if conversion settings changed
-	if cached.configHash != ic.getConfigHash() {
+	if cached.ConfigHash != configHash {
 		return false
 	}
 
 	return true
 }
 
-// convertImageOptimized converts with DecodeConfig optimization and early dimension checking.
-func (ic *ImageConverter) convertImageOptimized(inputPath, outputPath, format string) error {
+// decodedSource is a source image decoded once for all of its outputs.
+type decodedSource struct {
+	anim   *animation      // Animated GIFs and WebPs with more than one frame
+	img    image.Image     // Upright still image, or the first frame of an animation
+	format string          // Format the source was decoded from
+	meta   *sourceMetadata // Metadata of the still image, or of the animation
+	size   int64           // Size of the source file
+}
+
+// decodeSource decodes the input and applies its EXIF orientation. Animated
+// GIFs and WebPs keep every frame, so outputs that can animate as well keep
+// the animation.
+func (ic *ImageConverter) decodeSource(inputPath string) (*decodedSource, error) {
 	file, err := os.Open(inputPath)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
-	// First, check if we need to resize using DecodeConfig (fast)
-	var needsResize bool
-	var originalConfig image.Config
+	// Use buffered reader for better I/O performance
+	bufferedReader := bufio.NewReaderSize(file, 64*1024)
 
-	if ic.options.MaxDimension > 0 {
-		config, _, err := image.DecodeConfig(file)
-		if err != nil {
-			return fmt.Errorf("failed to decode config: %w", err)
+	anim, err := decodeAnimation(bufferedReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode animation: %w", err)
+	}
+	if anim != nil {
+		// A still GIF, or the first frame of an animation flattened to a still
+		src := &decodedSource{img: anim.frames[0], format: anim.format, meta: &sourceMetadata{orientation: 1}}
+		if len(anim.frames) > 1 {
+			src.anim = anim
+			src.meta, err = readMetadata(inputPath, anim.format)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read metadata: %w", err)
+			}
 		}
-		originalConfig = config
-		maxDim := int(ic.options.MaxDimension)
-		needsResize = config.Width > maxDim || config.Height > maxDim
+		return src, nil
+	}
+
+	img, imgFormat, err := image.Decode(bufferedReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image (%s): %w", imgFormat, err)
+	}
+
+	// Store photos upright, so resizing applies to the displayed size.
+	// The orientation of metadata copied to the output is reset.
+	meta, err := readMetadata(inputPath, imgFormat)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	return &decodedSource{img: orientImage(img, meta.orientation), format: imgFormat, meta: meta}, nil
+}
 
-		// Reset file pointer for actual decode
-		if _, err := file.Seek(0, 0); err != nil {
-			return fmt.Errorf("failed to seek file: %w", err)
+// convertImageOptimized resizes the decoded source for output and encodes it
+// into the output path together with the metadata the policy keeps.
+// It returns the image exactly as it was handed to the encoder, which serves as the reference
+// when the output is verified, together with the number of frames written and how the colour
+// profile was handled. Animations stay animated when the output format can animate as well.
+func (ic *ImageConverter) convertImageOptimized(inputPath string, src *decodedSource, output VariantOutput) (*encodedOutput, error) {
+	format := output.Format
+	img, meta := src.img, src.meta
+	if src.anim != nil {
+		if canAnimate(format) {
+			return ic.convertAnimation(src.anim, meta, output, src.size)
 		}
+		if ic.options.Frames == FramesAll {
+			return nil, framesError(len(src.anim.frames), format)
+		}
+		meta = &sourceMetadata{orientation: 1}
+	} else if err := ic.checkFrames(inputPath, src.format, format); err != nil {
+		// Multi-page TIFFs decode to their first page
+		return nil, err
 	}
+	out := ic.outputMetadata(meta)
 
-	// Use buffered reader for better I/O performance
-	bufferedReader := bufio.NewReaderSize(file, 64*1024)
+	img = ic.resizeImage(img, output.Resize)
 
-	// Decode image with format hint for faster decoding
-	img, imgFormat, err := image.Decode(bufferedReader)
-	if err != nil {
-		return fmt.Errorf("failed to decode image (%s): %w", imgFormat, err)
+	// Convert wide-gamut colours to sRGB, or keep the profile describing them
+	profile := ic.decideColorProfile(meta.icc, format, out)
+	img = profile.apply(img)
+
+	// Transparent areas would turn black in formats without alpha
+	var background string
+	if !storesAlpha(format, img) && hasTransparency(img) {
+		if ic.options.Transparency == TransparencyRefuse {
+			return nil, fmt.Errorf("image has transparency that %s cannot store", format)
+		}
+		bg := ic.backgroundColor(img)
+		img = flattenAlpha(img, bg)
+		background = hexColor(bg)
+	}
+
+	// Find the quality that meets the size or similarity target
+	var search *qualitySearch
+	if ic.searchesQuality(format, img, src.format) {
+		var err error
+		search, err = ic.searchQuality(img, format, src.format, out)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search quality: %w", err)
+		}
 	}
 
-	// Resize only if needed (we already know from DecodeConfig)
-	if needsResize {
-		// Calculate new dimensions maintaining aspect ratio
-		var newWidth, newHeight uint
-		maxDim := uint(ic.options.MaxDimension)
+	// Encode into a temporary file that only replaces the output once it is complete
+	err := ic.writeFileAtomic(output.Path, ic.onlyIfSmaller(src.size, func(w io.Writer) error {
+		// Use buffered writer for better I/O performance
+		bufferedWriter := bufio.NewWriterSize(w, 64*1024)
 
-		if originalConfig.Width > originalConfig.Height {
-			newWidth = maxDim
-			newHeight = 0 // Let resize calculate height
+		var err error
+		if search != nil {
+			// The search already encoded the image and its metadata at the chosen quality
+			_, err = bufferedWriter.Write(search.encoded)
 		} else {
-			newWidth = 0 // Let resize calculate width
-			newHeight = maxDim
+			err = ic.encodeImage(bufferedWriter, img, format, src.format, out)
+		}
+		if err != nil {
+			return err
 		}
-		img = resize.Resize(newWidth, newHeight, img, resize.Lanczos3)
-	}
 
-	// Create output file with optimized flags
-	outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err := bufferedWriter.Flush(); err != nil {
+			return fmt.Errorf("failed to flush output: %w", err)
+		}
+		return nil
+	}))
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+		return nil, err
 	}
-	defer func() {
-		if cerr := outFile.Close(); cerr != nil && err == nil {
-			err = fmt.Errorf("failed to close output file: %w", cerr)
+
+	return &encodedOutput{reference: img, frames: 1, profile: profile, background: background, search: search}, nil
+}
+
+// convertAnimation resizes every frame of anim and encodes it into the output
+// as an animated GIF or WebP. Frame delays and the loop count are kept, WebPs
+// receive the metadata of the source as well. anim itself is left untouched
+// for the other outputs of the source.
+func (ic *ImageConverter) convertAnimation(source *animation, meta *sourceMetadata, output VariantOutput, sourceSize int64) (*encodedOutput, error) {
+	anim := *source
+	anim.frames = slices.Clone(source.frames)
+	ic.resizeAnimation(&anim, output.Resize)
+
+	format := output.Format
+	out := ic.outputMetadata(meta)
+	profile := ic.decideColorProfile(meta.icc, format, out)
+	for i, frame := range anim.frames {
+		anim.frames[i] = toRGBA(profile.apply(frame))
+	}
+
+	err := ic.writeFileAtomic(output.Path, ic.onlyIfSmaller(sourceSize, func(w io.Writer) error {
+		bufferedWriter := bufio.NewWriterSize(w, 64*1024)
+
+		var err error
+		if format == "gif" {
+			err = encodeGIFAnimation(bufferedWriter, &anim)
+		} else {
+			settings := ic.options.Encoders.WebP
+			lossless := ic.webpLossless(anim.frames[0], anim.format)
+			encoded := &anim
+			if lossless && settings.NearLossless {
+				rounded := anim
+				rounded.frames = make([]*image.RGBA, len(anim.frames))
+				for i, frame := range anim.frames {
+					rounded.frames[i] = toRGBA(nearLossless(frame))
+				}
+				encoded = &rounded
+			}
+			err = withMetadata(bufferedWriter, format, out, func(w io.Writer) error {
+				return encodeWebPAnimation(w, encoded, &webp.Options{
+					Lossless: lossless,
+					Quality:  float32(settings.Quality),
+					Exact:    settings.Exact,
+				})
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to encode animation: %w", err)
 		}
-	}()
 
-	// Use buffered writer for better I/O performance
-	bufferedWriter := bufio.NewWriterSize(outFile, 64*1024)
-	defer func() {
-		if ferr := bufferedWriter.Flush(); ferr != nil && err == nil {
-			err = fmt.Errorf("failed to flush output: %w", ferr)
+		if err := bufferedWriter.Flush(); err != nil {
+			return fmt.Errorf("failed to flush output: %w", err)
 		}
-	}()
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
 
-	// Encode based on format with optimized settings
+	return &encodedOutput{reference: anim.frames[0], frames: len(anim.frames), profile: profile}, nil
+}
+
+// encodeImage encodes img into w using the encoder for the given format and
+// adds meta if the format can store it. srcFormat is the format img was
+// decoded from, which the automatic WebP lossless mode takes into account.
+func (ic *ImageConverter) encodeImage(w io.Writer, img image.Image, format, srcFormat string, meta *sourceMetadata) error {
+	return withMetadata(w, strings.ToLower(format), meta, func(w io.Writer) error {
+		return ic.encodePixels(w, img, format, srcFormat)
+	})
+}
+
+// withMetadata runs encode, which writes an image of the given format, and
+// embeds meta into its output before it reaches w. Without metadata to write
+// encode writes to w directly.
+func withMetadata(w io.Writer, format string, meta *sourceMetadata, encode func(w io.Writer) error) error {
+	if meta.empty() || !CanStoreMetadata(format) {
+		return encode(w)
+	}
+
+	var encoded bytes.Buffer
+	if err := encode(&encoded); err != nil {
+		return err
+	}
+	data, err := embedMetadata(encoded.Bytes(), format, meta)
+	if err != nil {
+		return fmt.Errorf("failed to embed metadata: %w", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// encodePixels encodes img into w using the encoder for the given format.
+func (ic *ImageConverter) encodePixels(w io.Writer, img image.Image, format, srcFormat string) error {
+	var err error
+
+	enc := ic.options.Encoders
+
+	// Encode based on format with the configured settings
 	switch strings.ToLower(format) {
 	case "png":
+		if optimize := pngOptimizeName(enc.PNG.Optimize); optimize != config.PNGOptimizeNone {
+			err = encodeOptimizedPNG(w, img, optimize == config.PNGOptimizeLossy)
+			break
+		}
 		encoder := &png.Encoder{
-			CompressionLevel: png.BestSpeed, // Faster compression
+			CompressionLevel: pngCompressionLevel(enc.PNG.Compression),
 		}
-		err = encoder.Encode(bufferedWriter, img)
+		err = encoder.Encode(w, img)
 	case "jpg", "jpeg":
-		err = jpeg.Encode(bufferedWriter, img, &jpeg.Options{
-			Quality: int(ic.options.Quality),
-		})
+		err = ic.encodeJPEG(w, img, enc.JPEG.Quality, srcFormat)
 	case "webp":
-		err = webp.Encode(bufferedWriter, img, &webp.Options{
-			Lossless: false,
-			Quality:  float32(ic.options.Quality),
+		lossless := ic.webpLossless(img, srcFormat)
+		if lossless && enc.WebP.NearLossless {
+			img = nearLossless(img)
+		}
+		err = webp.Encode(w, img, &webp.Options{
+			Lossless: lossless,
+			Quality:  float32(enc.WebP.Quality),
+			Exact:    enc.WebP.Exact,
+		})
+	case "gif":
+		err = gif.Encode(w, img, &gif.Options{
+			NumColors: 256,
 		})
-	// case "bmp":
-	// 	err = bmp.Encode(bufferedWriter, img)
+	case "bmp":
+		err = bmp.Encode(w, img)
+	case "tif", "tiff":
+		compression := tiff.Deflate
+		if enc.TIFF.Compression == "none" {
+			compression = tiff.Uncompressed
+		}
+		err = tiff.Encode(w, img, &tiff.Options{
+			Compression: compression,
+			Predictor:   true,
+		})
+	case "avif":
+		err = encodeAVIF(w, img, enc.AVIF)
 	default:
 		return fmt.Errorf("unsupported format: %s", format)
 	}
@@ -393,6 +825,55 @@ func (ic *ImageConverter) convertImageOptimized(inputPath, outputPath, format st
 	return nil
 }
 
+// pngCompressionName returns the configured PNG compression, or the default
+// best_speed for sessions saved before it could be configured.
+func pngCompressionName(name string) string {
+	if name == "" {
+		return config.DefaultEncoderSettings().PNG.Compression
+	}
+	return name
+}
+
+// pngOptimizeName returns the configured PNG optimisation level, or none for
+// sessions saved before it could be configured.
+func pngOptimizeName(level string) string {
+	if level == "" {
+		return config.PNGOptimizeNone
+	}
+	return level
+}
+
+// pngCompressionLevel maps a PNG compression name from the config to the encoder level.
+func pngCompressionLevel(name string) png.CompressionLevel {
+	switch pngCompressionName(name) {
+	case "default":
+		return png.DefaultCompression
+	case "no_compression":
+		return png.NoCompression
+	case "best_compression":
+		return png.BestCompression
+	default:
+		return png.BestSpeed // Faster compression
+	}
+}
+
+// RemovePartialOutputs deletes the temporary file of every output that is still being written.
+// It is used when a run is aborted while conversions are in flight so that no
+// truncated images are left behind. It returns the number of removed files.
+func (ic *ImageConverter) RemovePartialOutputs() int {
+	removed := 0
+	ic.partialOutputs.Range(func(key, _ interface{}) bool {
+		if path, ok := key.(string); ok {
+			if err := os.Remove(path); err == nil {
+				removed++
+			}
+		}
+		ic.partialOutputs.Delete(key)
+		return true
+	})
+	return removed
+}
+
 // createBackup creates a backup of the specified file in a directory named "backup"
 // in the same directory as the original file. Optimized for performance.
 func (ic *ImageConverter) createBackup(path string) error {
@@ -423,6 +904,24 @@ func (ic *ImageConverter) copyFileOptimized(src, dst string) error {
 	}
 	defer srcFile.Close()
 
+	return ic.writeFileAtomic(dst, func(w io.Writer) error {
+		// Get buffer from pool
+		buf := ic.bufPool.get()
+		defer ic.bufPool.put(buf)
+
+		// Copy with buffered I/O using our buffer
+		if _, err := io.CopyBuffer(w, srcFile, buf); err != nil {
+			return fmt.Errorf("failed to copy data: %w", err)
+		}
+		return nil
+	})
+}
+
+// writeFileAtomic writes dst through a temporary file in the same directory.
+// The temporary file is synced to disk and then renamed over dst, so dst is
+// either the complete new content or left untouched, even if the process
+// crashes or write fails half-way.
+func (ic *ImageConverter) writeFileAtomic(dst string, write func(w io.Writer) error) error {
 	// Create temp file in same directory as destination for atomic rename
 	tmpFile, err := os.CreateTemp(filepath.Dir(dst), ".tmp_"+filepath.Base(dst))
 	if err != nil {
@@ -430,18 +929,18 @@ func (ic *ImageConverter) copyFileOptimized(src, dst string) error {
 	}
 
 	tmpName := tmpFile.Name()
+
+	// Track the file until it is complete so an aborted run can remove it
+	ic.partialOutputs.Store(tmpName, struct{}{})
+	defer ic.partialOutputs.Delete(tmpName)
+
 	defer func() {
 		tmpFile.Close()
 		os.Remove(tmpName) // Clean up on error
 	}()
 
-	// Get buffer from pool
-	buf := ic.bufPool.get()
-	defer ic.bufPool.put(buf)
-
-	// Copy with buffered I/O using our buffer
-	if _, err := io.CopyBuffer(tmpFile, srcFile, buf); err != nil {
-		return fmt.Errorf("failed to copy data: %w", err)
+	if err := write(tmpFile); err != nil {
+		return err
 	}
 
 	// Ensure data is written to disk
@@ -454,6 +953,11 @@ func (ic *ImageConverter) copyFileOptimized(src, dst string) error {
 		return fmt.Errorf("failed to close temp file: %w", err)
 	}
 
+	// CreateTemp uses 0600, give the result the usual permissions
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+
 	// Atomic rename
 	if err := os.Rename(tmpName, dst); err != nil {
 		return fmt.Errorf("failed to rename temp file: %w", err)
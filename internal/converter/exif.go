@@ -0,0 +1,309 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EXIF data is a TIFF structure: a byte order mark followed by a chain of
+// image file directories (IFDs) of 12-byte entries.
+
+// EXIF tags.
+const (
+	exifTagOrientation      = 0x0112
+	exifTagDateTime         = 0x0132 // When the file was last changed
+	exifTagArtist           = 0x013B
+	exifTagCopyright        = 0x8298
+	exifTagExifIFD          = 0x8769 // Offset of the Exif IFD
+	exifTagGPSIFD           = 0x8825 // Offset of the GPS IFD
+	exifTagDateTimeOriginal = 0x9003 // When the photo was taken, in the Exif IFD
+)
+
+// exifDateLayout is the layout of EXIF date and time values.
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// EXIF value types.
+const (
+	exifTypeASCII = 2
+	exifTypeShort = 3
+)
+
+// exifTypeSizes holds the size in bytes of a value of each EXIF type.
+var exifTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// ifdEntry is an entry of an image file directory.
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte // The 4-byte value or offset field
+}
+
+// readTIFFHeader returns the byte order of a TIFF structure and the offset of its first IFD.
+func readTIFFHeader(data []byte) (binary.ByteOrder, uint32, error) {
+	if len(data) < 8 {
+		return nil, 0, fmt.Errorf("truncated tiff header")
+	}
+
+	var order binary.ByteOrder
+	switch string(data[:4]) {
+	case "II\x2A\x00":
+		order = binary.LittleEndian
+	case "MM\x00\x2A":
+		order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("malformed tiff header")
+	}
+	return order, order.Uint32(data[4:]), nil
+}
+
+// readIFD returns the entries of the IFD at offset.
+func readIFD(data []byte, order binary.ByteOrder, offset uint32) ([]ifdEntry, error) {
+	if uint64(offset)+2 > uint64(len(data)) {
+		return nil, fmt.Errorf("ifd offset out of range")
+	}
+	count := int(order.Uint16(data[offset:]))
+	start := int(offset) + 2
+	if start+count*12 > len(data) {
+		return nil, fmt.Errorf("truncated ifd")
+	}
+
+	entries := make([]ifdEntry, count)
+	for i := range entries {
+		entry := data[start+i*12:]
+		entries[i] = ifdEntry{
+			tag:   order.Uint16(entry[0:]),
+			typ:   order.Uint16(entry[2:]),
+			count: order.Uint32(entry[4:]),
+			value: entry[8:12],
+		}
+	}
+	return entries, nil
+}
+
+// exifOrientation returns the Orientation tag of EXIF data, 1 (upright) if the
+// data has none or an invalid one.
+//
+// The values describe how the stored pixels have to be transformed for display:
+// 2 mirrors horizontally, 3 rotates by 180°, 4 mirrors vertically, 5 transposes,
+// 6 rotates clockwise by 90°, 7 transverses and 8 rotates counter-clockwise by 90°.
+func exifOrientation(exif []byte) int {
+	order, offset, err := readTIFFHeader(exif)
+	if err != nil {
+		return 1
+	}
+	entries, err := readIFD(exif, order, offset)
+	if err != nil {
+		return 1
+	}
+
+	for _, entry := range entries {
+		if entry.tag == exifTagOrientation && entry.typ == exifTypeShort && entry.count == 1 {
+			if orientation := int(order.Uint16(entry.value)); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+		}
+	}
+	return 1
+}
+
+// exifDate returns when the photo was taken according to exif, or the time
+// the file was last changed if that is not recorded. It returns the zero time
+// if exif holds neither. EXIF times have no time zone and are read as UTC.
+func exifDate(exif []byte) time.Time {
+	order, offset, err := readTIFFHeader(exif)
+	if err != nil {
+		return time.Time{}
+	}
+	entries, err := readIFD(exif, order, offset)
+	if err != nil {
+		return time.Time{}
+	}
+
+	var modified time.Time
+	for _, entry := range entries {
+		switch entry.tag {
+		case exifTagDateTime:
+			modified = exifTime(exif, order, entry)
+		case exifTagExifIFD:
+			exifEntries, err := readIFD(exif, order, order.Uint32(entry.value))
+			if err != nil {
+				continue
+			}
+			for _, exifEntry := range exifEntries {
+				if exifEntry.tag == exifTagDateTimeOriginal {
+					if taken := exifTime(exif, order, exifEntry); !taken.IsZero() {
+						return taken
+					}
+				}
+			}
+		}
+	}
+	return modified
+}
+
+// exifTime parses the date and time value of an IFD entry, it returns the
+// zero time for malformed values and the blank ones of unknown dates.
+func exifTime(data []byte, order binary.ByteOrder, entry ifdEntry) time.Time {
+	if entry.typ != exifTypeASCII {
+		return time.Time{}
+	}
+	value, err := entryData(data, order, entry)
+	if err != nil {
+		return time.Time{}
+	}
+	t, err := time.Parse(exifDateLayout, strings.TrimRight(string(value), "\x00 "))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// entryData returns the values of an IFD entry, which are stored in the entry
+// itself if they fit into 4 bytes and at the offset it holds otherwise.
+func entryData(data []byte, order binary.ByteOrder, entry ifdEntry) ([]byte, error) {
+	size, ok := exifTypeSizes[entry.typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown exif type %d", entry.typ)
+	}
+	length := uint64(size) * uint64(entry.count)
+	if length <= 4 {
+		return entry.value[:length], nil
+	}
+
+	offset := uint64(order.Uint32(entry.value))
+	if offset+length > uint64(len(data)) {
+		return nil, fmt.Errorf("exif value out of range")
+	}
+	return data[offset : offset+length], nil
+}
+
+// resetExifOrientation returns a copy of exif with the orientation set to 1.
+func resetExifOrientation(exif []byte) []byte {
+	order, offset, err := readTIFFHeader(exif)
+	if err != nil {
+		return nil
+	}
+
+	exif = bytes.Clone(exif)
+	entries, err := readIFD(exif, order, offset)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.tag == exifTagOrientation && entry.typ == exifTypeShort && entry.count == 1 {
+			order.PutUint16(entry.value, 1)
+		}
+	}
+	return exif
+}
+
+// stripExifGPS returns a copy of exif without the GPS IFD. The pointer to it
+// is removed from the first IFD and the GPS IFD itself is zeroed, so the
+// coordinates are gone while every other offset in the data stays valid.
+func stripExifGPS(exif []byte) []byte {
+	order, offset, err := readTIFFHeader(exif)
+	if err != nil {
+		return nil
+	}
+
+	exif = bytes.Clone(exif)
+	entries, err := readIFD(exif, order, offset)
+	if err != nil {
+		return nil
+	}
+
+	for i, entry := range entries {
+		if entry.tag != exifTagGPSIFD {
+			continue
+		}
+
+		if gps := order.Uint32(entry.value); gps != 0 {
+			zeroIFD(exif, order, gps)
+		}
+
+		// Move the following entries and the next IFD offset up by one entry
+		start := int(offset) + 2 + i*12
+		end := int(offset) + 2 + len(entries)*12 + 4
+		if end > len(exif) {
+			return nil
+		}
+		copy(exif[start:], exif[start+12:end])
+		clear(exif[end-12 : end])
+		order.PutUint16(exif[offset:], uint16(len(entries)-1))
+		break
+	}
+	return exif
+}
+
+// zeroIFD overwrites the IFD at offset and the values it points to with zeros.
+func zeroIFD(data []byte, order binary.ByteOrder, offset uint32) {
+	entries, err := readIFD(data, order, offset)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if values, err := entryData(data, order, entry); err == nil {
+			clear(values)
+		}
+	}
+	clear(data[offset:min(int(offset)+2+len(entries)*12+4, len(data))])
+}
+
+// copyrightExif returns new EXIF data that holds only the artist and
+// copyright notice of exif, or nil if it has neither.
+func copyrightExif(exif []byte) []byte {
+	order, offset, err := readTIFFHeader(exif)
+	if err != nil {
+		return nil
+	}
+	entries, err := readIFD(exif, order, offset)
+	if err != nil {
+		return nil
+	}
+
+	var kept []ifdEntry
+	var values [][]byte
+	for _, entry := range entries {
+		if (entry.tag == exifTagArtist || entry.tag == exifTagCopyright) && entry.typ == exifTypeASCII {
+			value, err := entryData(exif, order, entry)
+			if err != nil {
+				continue
+			}
+			kept = append(kept, entry)
+			values = append(values, value)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+
+	// Header, a single IFD and the values that do not fit into their entries
+	dataOffset := 8 + 2 + len(kept)*12 + 4
+	out := make([]byte, dataOffset)
+	copy(out, exif[:4])
+	order.PutUint32(out[4:], 8)
+	order.PutUint16(out[8:], uint16(len(kept)))
+
+	for i, entry := range kept {
+		field := out[10+i*12:]
+		order.PutUint16(field[0:], entry.tag)
+		order.PutUint16(field[2:], entry.typ)
+		order.PutUint32(field[4:], entry.count)
+		if len(values[i]) <= 4 {
+			copy(field[8:12], values[i])
+			continue
+		}
+		order.PutUint32(field[8:], uint32(len(out)))
+		out = append(out, values[i]...)
+		if len(out)&1 == 1 {
+			out = append(out, 0) // Values start on word boundaries
+		}
+	}
+	return out
+}
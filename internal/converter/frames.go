@@ -0,0 +1,89 @@
+package converter
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Multi-frame policies for animated GIFs and WebPs and multi-page TIFFs whose
+// target format cannot hold more than one frame. Animations converted to GIF
+// or WebP always keep every frame.
+const (
+	// FramesFirst flattens a multi-frame source to its first frame or page.
+	FramesFirst = "first"
+	// FramesAll refuses to drop frames: a multi-frame source whose target format
+	// cannot hold all of them fails and the original is kept.
+	FramesAll = "all"
+)
+
+// checkFrames enforces the multi-frame policy for a still source at path that
+// was decoded as srcFormat and is converted to format. Only TIFFs can hold
+// further pages that the decoder skipped.
+func (ic *ImageConverter) checkFrames(path, srcFormat, format string) error {
+	if ic.options.Frames != FramesAll {
+		return nil
+	}
+
+	if srcFormat != "tiff" {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to count frames: %w", err)
+	}
+	defer file.Close()
+
+	pages, err := countTIFFPages(file)
+	if err != nil {
+		return fmt.Errorf("failed to count frames: %w", err)
+	}
+	if pages > 1 {
+		return framesError(pages, format)
+	}
+	return nil
+}
+
+// framesError reports a multi-frame source that cannot be converted to format
+// without dropping frames.
+func framesError(frames int, format string) error {
+	return fmt.Errorf("source has %d frames but %s output keeps only the first (use --frames %s to convert it anyway)", frames, format, FramesFirst)
+}
+
+// countTIFFPages follows the chain of image file directories of a TIFF file.
+// Every directory describes one page.
+func countTIFFPages(r io.ReaderAt) (int, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return 0, fmt.Errorf("failed to read tiff header: %w", err)
+	}
+
+	order, first, err := readTIFFHeader(header)
+	if err != nil {
+		return 0, err
+	}
+
+	// Remember visited directories so a corrupt chain cannot loop forever
+	visited := make(map[int64]bool)
+	offset := int64(first)
+	buf := make([]byte, 4)
+	for offset != 0 {
+		if visited[offset] {
+			return 0, fmt.Errorf("malformed tiff directory chain")
+		}
+		visited[offset] = true
+
+		if _, err := r.ReadAt(buf[:2], offset); err != nil {
+			return 0, fmt.Errorf("failed to read tiff directory: %w", err)
+		}
+		entries := int64(order.Uint16(buf[:2]))
+
+		// Each entry is 12 bytes, the offset of the next directory follows them
+		if _, err := r.ReadAt(buf, offset+2+entries*12); err != nil {
+			return 0, fmt.Errorf("failed to read tiff directory: %w", err)
+		}
+		offset = int64(order.Uint32(buf))
+	}
+	return len(visited), nil
+}
@@ -0,0 +1,109 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"slices"
+
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/heic"
+)
+
+// hevcBrands are the ftyp brands of HEIF files holding HEVC coded images:
+// stills (heic, heix), multi-layer stills (heim, heis) and sequences (hevc,
+// hevx). The x variants carry 10-bit colour, as written by newer phones.
+var hevcBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx"}
+
+// heifStructuralBrands only state that a file is a HEIF image or sequence.
+// Which codec the images use, HEVC or AV1, is told by the compatible brands
+// that follow.
+var heifStructuralBrands = []string{"mif1", "msf1"}
+
+// The heic package registers files with the "heic" ftyp brand only, and its
+// libheif build refuses any major brand but "heic" and "heix". Files with the
+// other HEVC brands, or with a structural brand whose compatible brands name
+// HEVC, are handed to it as "heic" files.
+//
+// HEIF containers can hold several images, such as bursts, thumbnails and
+// depth maps. The decoder always returns the primary image, which is the one
+// the camera shows, with its rotation and mirroring applied.
+func init() {
+	for _, brand := range hevcBrands[1:] {
+		image.RegisterFormat("heic", "????ftyp"+brand, decodeHEIF, decodeHEIFConfig)
+	}
+	for _, brand := range heifStructuralBrands {
+		image.RegisterFormat("heif", "????ftyp"+brand, decodeHEIF, decodeHEIFConfig)
+	}
+}
+
+// heifDecoder decodes the images of one HEIF codec, HEVC or AV1.
+type heifDecoder struct {
+	decode       func(io.Reader) (image.Image, error)
+	decodeConfig func(io.Reader) (image.Config, error)
+}
+
+// decodeHEIF decodes a HEIF file with the decoder its compatible brands name.
+func decodeHEIF(r io.Reader) (image.Image, error) {
+	decoder, r, err := sniffHEIF(r)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.decode(r)
+}
+
+// decodeHEIFConfig returns the dimensions of a HEIF file like decodeHEIF.
+func decodeHEIFConfig(r io.Reader) (image.Config, error) {
+	decoder, r, err := sniffHEIF(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return decoder.decodeConfig(r)
+}
+
+// sniffHEIF reads the ftyp box at the start of r and picks the decoder for
+// the brands it lists. The returned reader yields the whole file again. For
+// HEVC files the major brand is replaced by one the decoder accepts and the
+// file is read into memory; AVIF files are passed through unchanged, since
+// the AVIF decoder checks the compatible brands as well.
+func sniffHEIF(r io.Reader) (heifDecoder, io.Reader, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return heifDecoder{}, nil, fmt.Errorf("heif: failed to read ftyp box: %w", err)
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if string(header[4:]) != "ftyp" || size < 16 || size > 4096 {
+		return heifDecoder{}, nil, fmt.Errorf("heif: invalid ftyp box")
+	}
+	box := make([]byte, size-8)
+	if _, err := io.ReadFull(r, box); err != nil {
+		return heifDecoder{}, nil, fmt.Errorf("heif: failed to read ftyp box: %w", err)
+	}
+
+	// The major brand comes first, the minor version is skipped
+	brands := []string{string(box[:4])}
+	for i := 8; i+4 <= len(box); i += 4 {
+		brands = append(brands, string(box[i:i+4]))
+	}
+	for _, brand := range brands {
+		if slices.Contains(hevcBrands, brand) {
+			if major := brands[0]; major != "heic" && major != "heix" {
+				copy(box, "heic")
+			}
+			// The decoder reads its header in a single call, so the file is not stitched together
+			rest, err := io.ReadAll(r)
+			if err != nil {
+				return heifDecoder{}, nil, fmt.Errorf("heif: failed to read file: %w", err)
+			}
+			full := bytes.NewReader(slices.Concat(header[:], box, rest))
+			return heifDecoder{decode: heic.Decode, decodeConfig: heic.DecodeConfig}, full, nil
+		}
+		if slices.Contains(avifBrands, brand) {
+			full := io.MultiReader(bytes.NewReader(header[:]), bytes.NewReader(box), r)
+			return heifDecoder{decode: avif.Decode, decodeConfig: avif.DecodeConfig}, full, nil
+		}
+	}
+	return heifDecoder{}, nil, fmt.Errorf("heif: no supported codec among brands %v", brands)
+}
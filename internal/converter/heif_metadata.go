@@ -0,0 +1,335 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// heifXMPContentType is the content type of the mime item that holds XMP.
+const heifXMPContentType = "application/rdf+xml"
+
+// heifBox is a box of an ISO base media file, such as HEIC and AVIF files.
+type heifBox struct {
+	kind string
+	data []byte // Payload after the box header
+}
+
+// readHEIFBoxes returns the boxes in data. Reading stops at the first
+// truncated box.
+func readHEIFBoxes(data []byte) []heifBox {
+	var boxes []heifBox
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		kind := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			// The last box extends to the end of the file
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return boxes
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return boxes
+		}
+		boxes = append(boxes, heifBox{kind: kind, data: data[header:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+// heifItem is an item of the meta box, such as an image, EXIF or XMP.
+type heifItem struct {
+	kind        string // Item type, e.g. "hvc1", "Exif" or "mime"
+	contentType string // Content type of mime items
+	extents     [][2]uint64
+	inIDat      bool // Extents are offsets into the idat box instead of the file
+}
+
+// readHEIFMetadata reads the ICC profile, EXIF and XMP of a HEIF file. The ICC
+// profile is the one of the primary image, or else the first one in the
+// file. EXIF and XMP are stored as items of their own.
+func readHEIFMetadata(data []byte, meta *sourceMetadata) {
+	var metaBox []byte
+	for _, box := range readHEIFBoxes(data) {
+		if box.kind == "meta" && len(box.data) >= 4 {
+			// Skip the version and flags of the full box
+			metaBox = box.data[4:]
+			break
+		}
+	}
+
+	var primary uint32
+	var properties [][]byte
+	associations := map[uint32][]int{}
+	items := map[uint32]*heifItem{}
+	var idat []byte
+	for _, box := range readHEIFBoxes(metaBox) {
+		switch box.kind {
+		case "pitm":
+			primary = readHEIFPrimary(box.data)
+		case "iinf":
+			readHEIFItemInfo(box.data, items)
+		case "iloc":
+			readHEIFItemLocations(box.data, items)
+		case "idat":
+			idat = box.data
+		case "iprp":
+			for _, child := range readHEIFBoxes(box.data) {
+				switch child.kind {
+				case "ipco":
+					for _, property := range readHEIFBoxes(child.data) {
+						if property.kind == "colr" {
+							properties = append(properties, property.data)
+						} else {
+							properties = append(properties, nil)
+						}
+					}
+				case "ipma":
+					readHEIFAssociations(child.data, associations)
+				}
+			}
+		}
+	}
+
+	// Properties are numbered from 1 in the order of the ipco box
+	for _, index := range associations[primary] {
+		if index > 0 && index <= len(properties) {
+			if icc := heifICC(properties[index-1]); icc != nil {
+				meta.icc = icc
+				break
+			}
+		}
+	}
+	for _, property := range properties {
+		if meta.icc != nil {
+			break
+		}
+		meta.icc = heifICC(property)
+	}
+
+	for _, item := range items {
+		switch {
+		case item.kind == "Exif" && meta.exif == nil:
+			// The TIFF header follows an offset, usually past an "Exif\0\0" header
+			payload := item.read(data, idat)
+			if len(payload) < 4 {
+				continue
+			}
+			offset := uint64(binary.BigEndian.Uint32(payload)) + 4
+			if offset <= uint64(len(payload)) {
+				meta.exif = bytes.TrimPrefix(payload[offset:], exifHeader)
+			}
+		case item.kind == "mime" && item.contentType == heifXMPContentType && meta.xmp == nil:
+			meta.xmp = item.read(data, idat)
+		}
+	}
+}
+
+// heifICC returns the ICC profile of a colr property, or nil for colours
+// given as numbers (nclx) and other properties.
+func heifICC(colr []byte) []byte {
+	if len(colr) <= 4 {
+		return nil
+	}
+	switch string(colr[:4]) {
+	case "prof", "rICC":
+		return colr[4:]
+	}
+	return nil
+}
+
+// read returns the content of the item, or nil if it lies outside the file.
+func (item *heifItem) read(data, idat []byte) []byte {
+	source := data
+	if item.inIDat {
+		source = idat
+	}
+
+	var content []byte
+	for _, extent := range item.extents {
+		offset, length := extent[0], extent[1]
+		if length == 0 {
+			// The extent reaches to the end of the source
+			length = uint64(len(source)) - min(offset, uint64(len(source)))
+		}
+		if offset > uint64(len(source)) || length > uint64(len(source))-offset {
+			return nil
+		}
+		content = append(content, source[offset:offset+length]...)
+	}
+	return content
+}
+
+// heifReader reads the big-endian fields of a box and remembers whether it
+// ran past the end.
+type heifReader struct {
+	data []byte
+	bad  bool
+}
+
+// uint reads an unsigned integer of size bytes, which may be 0 to 8.
+func (r *heifReader) uint(size int) uint64 {
+	if size > len(r.data) {
+		r.bad = true
+		return 0
+	}
+	var value uint64
+	for _, b := range r.data[:size] {
+		value = value<<8 | uint64(b)
+	}
+	r.data = r.data[size:]
+	return value
+}
+
+// string reads a null-terminated string.
+func (r *heifReader) string() string {
+	s, rest, ok := bytes.Cut(r.data, []byte{0})
+	if !ok {
+		r.bad = true
+		return ""
+	}
+	r.data = rest
+	return string(s)
+}
+
+// readHEIFPrimary returns the item ID of the primary image from a pitm box.
+func readHEIFPrimary(data []byte) uint32 {
+	r := &heifReader{data: data}
+	size := 2
+	if r.uint(1) != 0 {
+		size = 4
+	}
+	r.uint(3)
+	return uint32(r.uint(size))
+}
+
+// readHEIFItemInfo reads the type of every item from an iinf box.
+func readHEIFItemInfo(data []byte, items map[uint32]*heifItem) {
+	r := &heifReader{data: data}
+	countSize := 2
+	if r.uint(1) != 0 {
+		countSize = 4
+	}
+	r.uint(3)
+	r.uint(countSize)
+	if r.bad {
+		return
+	}
+
+	for _, box := range readHEIFBoxes(r.data) {
+		if box.kind != "infe" {
+			continue
+		}
+		entry := &heifReader{data: box.data}
+		version := entry.uint(1)
+		entry.uint(3)
+		// Versions before 2 carry no item type
+		if version < 2 {
+			continue
+		}
+		idSize := 2
+		if version >= 3 {
+			idSize = 4
+		}
+		id := uint32(entry.uint(idSize))
+		entry.uint(2) // Protection index
+		if entry.bad || len(entry.data) < 4 {
+			continue
+		}
+		kind := string(entry.data[:4])
+		entry.data = entry.data[4:]
+		var contentType string
+		if kind == "mime" {
+			entry.string() // Item name
+			contentType = entry.string()
+		}
+		if entry.bad {
+			continue
+		}
+
+		item := items[id]
+		if item == nil {
+			item = &heifItem{}
+			items[id] = item
+		}
+		item.kind, item.contentType = kind, contentType
+	}
+}
+
+// readHEIFItemLocations reads where the content of every item is stored from
+// an iloc box. Items built from other items are left without extents.
+func readHEIFItemLocations(data []byte, items map[uint32]*heifItem) {
+	r := &heifReader{data: data}
+	version := r.uint(1)
+	r.uint(3)
+	sizes := r.uint(2)
+	offsetSize, lengthSize := int(sizes>>12), int(sizes>>8&0xF)
+	baseOffsetSize, indexSize := int(sizes>>4&0xF), 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xF)
+	}
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count := r.uint(idSize)
+
+	for i := uint64(0); i < count && !r.bad; i++ {
+		id := uint32(r.uint(idSize))
+		var method uint64
+		if version == 1 || version == 2 {
+			method = r.uint(2) & 0xF
+		}
+		r.uint(2) // Data reference index
+		base := r.uint(baseOffsetSize)
+		extentCount := r.uint(2)
+
+		var extents [][2]uint64
+		for j := uint64(0); j < extentCount && !r.bad; j++ {
+			r.uint(indexSize)
+			offset := r.uint(offsetSize)
+			length := r.uint(lengthSize)
+			extents = append(extents, [2]uint64{base + offset, length})
+		}
+		if r.bad || method > 1 {
+			continue
+		}
+
+		item := items[id]
+		if item == nil {
+			item = &heifItem{}
+			items[id] = item
+		}
+		item.extents, item.inIDat = extents, method == 1
+	}
+}
+
+// readHEIFAssociations reads which properties belong to which item from an
+// ipma box. Property indices start at 1, 0 means no property.
+func readHEIFAssociations(data []byte, associations map[uint32][]int) {
+	r := &heifReader{data: data}
+	version := r.uint(1)
+	flags := r.uint(3)
+	idSize := 2
+	if version >= 1 {
+		idSize = 4
+	}
+	count := r.uint(4)
+
+	for i := uint64(0); i < count && !r.bad; i++ {
+		id := uint32(r.uint(idSize))
+		n := r.uint(1)
+		for j := uint64(0); j < n && !r.bad; j++ {
+			// The top bit marks essential properties
+			if flags&1 != 0 {
+				associations[id] = append(associations[id], int(r.uint(2)&0x7FFF))
+			} else {
+				associations[id] = append(associations[id], int(r.uint(1)&0x7F))
+			}
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package converter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// Colour profile modes for sources with an ICC profile.
+const (
+	// ColorProfileEmbed keeps the pixels as they are and embeds the source
+	// profile into JPEG, PNG and WebP outputs. Other formats cannot store a
+	// profile, so their pixels are converted to sRGB instead.
+	ColorProfileEmbed = "embed"
+	// ColorProfileSRGB converts the pixels of sources with a non-sRGB profile
+	// to sRGB and writes no profile.
+	ColorProfileSRGB = "srgb"
+)
+
+// What happened to the non-sRGB profile of a source, see ConversionResult.ProfileAction.
+const (
+	ProfileEmbedded  = "embedded"
+	ProfileConverted = "converted to sRGB"
+	ProfileDropped   = "dropped, not convertible"
+)
+
+// srgbMatrix holds the colorants of sRGB adapted to the D50 white point of
+// the ICC connection space, as found in the sRGB IEC61966-2.1 profile.
+var srgbMatrix = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// iccProfile is the part of an ICC profile needed to tell sRGB apart and to
+// convert colours to sRGB. Only RGB profiles built from a matrix and tone
+// curves, such as Display P3 and Adobe RGB, can be converted.
+type iccProfile struct {
+	description string
+	colorSpace  string // Data colour space, "RGB " for RGB profiles
+	matrix      [3][3]float64
+	curves      [3]toneCurve
+	convertible bool // The matrix and curves are present
+}
+
+// toneCurve maps an encoded channel value in [0, 1] to linear light.
+type toneCurve func(float64) float64
+
+// colorProfileMode returns the configured mode, or embed for sessions saved
+// before it could be configured.
+func colorProfileMode(mode string) string {
+	if mode == "" {
+		return ColorProfileEmbed
+	}
+	return mode
+}
+
+// profileDecision records how the ICC profile of a source is handled.
+type profileDecision struct {
+	profile *iccProfile // Profile to convert the pixels from, nil to keep them
+	name    string      // Name of a non-sRGB profile, empty for sRGB sources
+	action  string      // What happened to a non-sRGB profile
+}
+
+// decideColorProfile decides how the ICC profile of a source is handled for
+// an output of format and updates the profile in out, the metadata written to
+// the output. sRGB and unreadable profiles are left to the metadata policy,
+// because outputs without a profile are shown as sRGB anyway. Non-sRGB
+// profiles follow the colour profile mode.
+func (ic *ImageConverter) decideColorProfile(icc []byte, format string, out *sourceMetadata) profileDecision {
+	if len(icc) == 0 {
+		return profileDecision{}
+	}
+	profile, err := parseICCProfile(icc)
+	if err != nil || profile.isSRGB() {
+		return profileDecision{}
+	}
+
+	decision := profileDecision{name: profile.name()}
+	switch {
+	case CanStoreMetadata(format) && (colorProfileMode(ic.options.ColorProfile) == ColorProfileEmbed || !profile.convertible):
+		// Profiles that cannot be converted are embedded in sRGB mode as well
+		out.icc = icc
+		decision.action = ProfileEmbedded
+	case profile.convertible:
+		out.icc = nil
+		decision.profile = profile
+		decision.action = ProfileConverted
+	default:
+		out.icc = nil
+		decision.action = ProfileDropped
+	}
+	return decision
+}
+
+// apply converts img to sRGB if the decision calls for it.
+func (d profileDecision) apply(img image.Image) image.Image {
+	if d.profile == nil {
+		return img
+	}
+	return convertToSRGB(img, d.profile)
+}
+
+// parseICCProfile reads the description, colorants and tone curves of an ICC profile.
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("malformed icc profile")
+	}
+
+	profile := &iccProfile{colorSpace: string(data[16:20])}
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count && 132+i*12+12 <= len(data); i++ {
+		entry := data[132+i*12:]
+		offset, size := binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:])
+		if uint64(offset)+uint64(size) > uint64(len(data)) {
+			return nil, fmt.Errorf("icc tag out of range")
+		}
+		tags[string(entry[0:4])] = data[offset : offset+size]
+	}
+
+	profile.description = iccText(tags["desc"])
+
+	if profile.colorSpace != "RGB " || string(data[20:24]) != "XYZ " {
+		return profile, nil
+	}
+	for i, name := range []string{"r", "g", "b"} {
+		xyz, ok := iccXYZ(tags[name+"XYZ"])
+		if !ok {
+			return profile, nil
+		}
+		curve, ok := iccCurve(tags[name+"TRC"])
+		if !ok {
+			return profile, nil
+		}
+		for row := range 3 {
+			profile.matrix[row][i] = xyz[row]
+		}
+		profile.curves[i] = curve
+	}
+	profile.convertible = true
+	return profile, nil
+}
+
+// isSRGB reports whether the profile describes sRGB, either by name or by
+// colorants and tone curves close to those of sRGB.
+func (p *iccProfile) isSRGB() bool {
+	if strings.Contains(p.description, "sRGB") {
+		return true
+	}
+	if p.colorSpace != "RGB " {
+		return true // Greyscale and CMYK profiles do not widen the gamut
+	}
+	if !p.convertible {
+		return false
+	}
+
+	for row := range 3 {
+		for col := range 3 {
+			if math.Abs(p.matrix[row][col]-srgbMatrix[row][col]) > 0.01 {
+				return false
+			}
+		}
+	}
+	for _, curve := range p.curves {
+		for _, v := range []float64{0.1, 0.3, 0.5, 0.7, 0.9} {
+			if math.Abs(curve(v)-srgbToLinear(v)) > 0.01 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// name returns the description of the profile, or a placeholder for profiles without one.
+func (p *iccProfile) name() string {
+	if p.description == "" {
+		return "unnamed ICC profile"
+	}
+	return p.description
+}
+
+// iccText decodes a textDescriptionType (ICC v2) or multiLocalizedUnicodeType
+// (ICC v4) tag, using the first record of the latter.
+func iccText(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+
+	switch string(tag[0:4]) {
+	case "desc":
+		length := binary.BigEndian.Uint32(tag[8:])
+		if uint64(length) > uint64(len(tag)-12) {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+length]), "\x00")
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+		length, offset := binary.BigEndian.Uint32(tag[20:]), binary.BigEndian.Uint32(tag[24:])
+		if uint64(offset)+uint64(length) > uint64(len(tag)) {
+			return ""
+		}
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[int(offset)+i*2:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
+
+// iccXYZ decodes an XYZType tag holding a single colorant.
+func iccXYZ(tag []byte) ([3]float64, bool) {
+	if len(tag) < 20 || string(tag[0:4]) != "XYZ " {
+		return [3]float64{}, false
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, true
+}
+
+// iccCurve decodes a curveType or parametricCurveType tag.
+func iccCurve(tag []byte) (toneCurve, bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+
+	switch string(tag[0:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case count == 0:
+			return func(v float64) float64 { return v }, true
+		case count == 1 && len(tag) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, gamma) }, true
+		case len(tag) >= 12+count*2:
+			table := make([]float64, count)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 65535
+			}
+			return func(v float64) float64 {
+				// Interpolate linearly between the sampled points
+				pos := v * float64(count-1)
+				i := min(int(pos), count-2)
+				if i < 0 {
+					return table[0]
+				}
+				return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+			}, true
+		}
+	case "para":
+		// Parameters g, a, b, c, d, e and f, as many as the function type needs
+		paramCounts := []int{1, 3, 4, 5, 7}
+		function := int(binary.BigEndian.Uint16(tag[8:]))
+		if function >= len(paramCounts) || len(tag) < 12+paramCounts[function]*4 {
+			return nil, false
+		}
+		var p [7]float64
+		for i := 0; i < paramCounts[function]; i++ {
+			p[i] = s15Fixed16(tag[12+i*4:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		switch function {
+		case 0:
+			return func(v float64) float64 { return math.Pow(v, g) }, true
+		case 1:
+			return func(v float64) float64 {
+				if a == 0 || v < -b/a {
+					return 0
+				}
+				return math.Pow(a*v+b, g)
+			}, true
+		case 2:
+			return func(v float64) float64 {
+				if a == 0 || v < -b/a {
+					return c
+				}
+				return math.Pow(a*v+b, g) + c
+			}, true
+		case 3:
+			return func(v float64) float64 {
+				if v < d {
+					return c * v
+				}
+				return math.Pow(a*v+b, g)
+			}, true
+		case 4:
+			return func(v float64) float64 {
+				if v < d {
+					return c*v + f
+				}
+				return math.Pow(a*v+b, g) + e
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// s15Fixed16 decodes a signed 15.16 fixed point number.
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// srgbToLinear decodes an sRGB channel value.
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB encodes a linear channel value as sRGB.
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// srgbEncodeTable maps linear values, scaled to 16 bits, to sRGB values
+// scaled to 16 bits. It is filled on first use.
+var (
+	srgbEncodeTable [65536]uint16
+	srgbEncodeOnce  sync.Once
+)
+
+// encodeSRGB encodes a linear value in [0, 1], clipping values out of range.
+func encodeSRGB(v float64) uint16 {
+	srgbEncodeOnce.Do(func() {
+		for i := range srgbEncodeTable {
+			srgbEncodeTable[i] = uint16(math.Round(linearToSRGB(float64(i)/65535) * 65535))
+		}
+	})
+	return srgbEncodeTable[int(math.Round(min(max(v, 0), 1)*65535))]
+}
+
+// convertToSRGB converts img from the colours of profile to sRGB. Images with
+// 16 bits per channel are converted to RGBA64, all others to RGBA.
+func convertToSRGB(img image.Image, profile *iccProfile) image.Image {
+	// Source RGB to XYZ, then XYZ to linear sRGB
+	m := multiply3x3(invert3x3(srgbMatrix), profile.matrix)
+
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		dst := image.NewRGBA64(img.Bounds())
+		draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+		convertPixels(dst.Pix, 2, profile, m)
+		return dst
+	}
+
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	convertPixels(dst.Pix, 1, profile, m)
+	return dst
+}
+
+// convertPixels converts premultiplied RGBA pixels with size bytes per channel
+// in place. The tone curves of the profile are sampled once per channel value.
+func convertPixels(pix []byte, size int, profile *iccProfile, m [3][3]float64) {
+	maxValue := float64(int(1)<<(8*size) - 1)
+	var decode [3][]float64
+	for c, curve := range profile.curves {
+		decode[c] = make([]float64, int(maxValue)+1)
+		for v := range decode[c] {
+			decode[c][v] = curve(float64(v) / maxValue)
+		}
+	}
+
+	read := func(b []byte) int {
+		if size == 1 {
+			return int(b[0])
+		}
+		return int(binary.BigEndian.Uint16(b))
+	}
+	write := func(b []byte, v uint16) {
+		if size == 1 {
+			b[0] = byte((uint32(v)*255 + 32767) / 65535)
+		} else {
+			binary.BigEndian.PutUint16(b, v)
+		}
+	}
+
+	stride := 4 * size
+	for i := 0; i+stride <= len(pix); i += stride {
+		alpha := read(pix[i+3*size:])
+		if alpha == 0 {
+			continue
+		}
+
+		// Undo the premultiplication before the curves apply
+		var linear [3]float64
+		for c := range 3 {
+			v := read(pix[i+c*size:])
+			if alpha != int(maxValue) {
+				v = min(int(math.Round(float64(v)*maxValue/float64(alpha))), int(maxValue))
+			}
+			linear[c] = decode[c][v]
+		}
+
+		a := float64(alpha) / maxValue
+		for c := range 3 {
+			v := m[c][0]*linear[0] + m[c][1]*linear[1] + m[c][2]*linear[2]
+			encoded := float64(encodeSRGB(v)) / 65535
+			write(pix[i+c*size:], uint16(math.Round(encoded*a*65535)))
+		}
+	}
+}
+
+// multiply3x3 returns the matrix product a·b.
+func multiply3x3(a, b [3][3]float64) [3][3]float64 {
+	var out [3][3]float64
+	for row := range 3 {
+		for col := range 3 {
+			for k := range 3 {
+				out[row][col] += a[row][k] * b[k][col]
+			}
+		}
+	}
+	return out
+}
+
+// invert3x3 returns the inverse of a non-singular matrix.
+func invert3x3(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+
+	return [3][3]float64{
+		{
+			(m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det,
+			(m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det,
+			(m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det,
+		},
+		{
+			(m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det,
+			(m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det,
+			(m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det,
+		},
+		{
+			(m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det,
+			(m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det,
+			(m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det,
+		},
+	}
+}
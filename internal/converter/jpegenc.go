@@ -0,0 +1,915 @@
+package converter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+	"math/bits"
+
+	"github.com/MostafaSensei106/GoPix/internal/config"
+)
+
+// encodeJPEG encodes img as JPEG at the given quality with the configured
+// subsampling, progression and Huffman tables. srcFormat is the format img was
+// decoded from, which the automatic subsampling takes into account. Baseline
+// 4:2:0 JPEGs with the standard tables are left to image/jpeg.
+func (ic *ImageConverter) encodeJPEG(w io.Writer, img image.Image, quality int, srcFormat string) error {
+	settings := ic.options.Encoders.JPEG
+	subsampling := ic.jpegSubsampling(img, srcFormat)
+	if !settings.Progressive && !settings.OptimizeHuffman && subsampling == config.Subsampling420 {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+	return writeJPEG(w, img, jpegOptions{
+		quality:     quality,
+		subsampling: subsampling,
+		progressive: settings.Progressive,
+		optimize:    settings.OptimizeHuffman,
+	})
+}
+
+// jpegSubsampling decides the chroma subsampling of img, decoded from
+// srcFormat. The automatic mode keeps full colour resolution for graphics
+// from lossless sources with only few colours, whose coloured edges and text
+// 4:2:0 smears, and subsamples photos.
+func (ic *ImageConverter) jpegSubsampling(img image.Image, srcFormat string) string {
+	subsampling := jpegSubsamplingName(ic.options.Encoders.JPEG.Subsampling)
+	if subsampling != config.SubsamplingAuto {
+		return subsampling
+	}
+	if losslessSourceFormats[srcFormat] && hasFewColors(img, autoLosslessMaxColors) {
+		return config.Subsampling444
+	}
+	return config.Subsampling420
+}
+
+// jpegSubsamplingName returns the configured chroma subsampling, or the
+// default 4:2:0 for sessions saved before it could be configured.
+func jpegSubsamplingName(subsampling string) string {
+	if subsampling == "" {
+		return config.Subsampling420
+	}
+	return subsampling
+}
+
+// jpegOptions configures writeJPEG.
+type jpegOptions struct {
+	quality     int
+	subsampling string // config.Subsampling444, Subsampling422 or Subsampling420
+	progressive bool
+	optimize    bool // Optimized Huffman tables, which progressive JPEGs always use
+}
+
+// JPEG markers written by writeJPEG besides those in metadata.go.
+const (
+	jpegMarkerSOF0 = 0xC0 // Baseline frame
+	jpegMarkerSOF2 = 0xC2 // Progressive frame
+	jpegMarkerDHT  = 0xC4
+	jpegMarkerDQT  = 0xDB
+)
+
+// Huffman table classes.
+const (
+	jpegDC = 0
+	jpegAC = 1
+)
+
+// jpegMaxEOBRun is the longest end-of-band run a progressive scan codes.
+const jpegMaxEOBRun = 0x7FFF
+
+// jpegMaxCorrectionBits is the number of correction bits refinement scans
+// buffer for an end-of-band run before the run is cut short, as in libjpeg.
+const jpegMaxCorrectionBits = 1000
+
+// jpegZigzag maps the zig-zag order of coefficients to their natural order.
+var jpegZigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegBaseQuant are the luminance and chrominance quantisation tables of
+// section K.1 of the JPEG specification in zig-zag order. They are scaled by
+// quality the same way image/jpeg scales them.
+var jpegBaseQuant = [2][64]byte{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// jpegHuffmanSpec is a Huffman table as a DHT segment stores it.
+type jpegHuffmanSpec struct {
+	counts [16]byte // Number of codes of each length from 1 to 16 bits
+	values []byte   // Symbols in the order of their codes
+}
+
+// jpegStandardTables are the Huffman tables of section K.3 of the JPEG
+// specification, indexed by class and by luminance (0) or chrominance (1).
+var jpegStandardTables = [2][2]jpegHuffmanSpec{
+	{
+		{
+			counts: [16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+			values: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		},
+		{
+			counts: [16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+			values: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		},
+	},
+	{
+		{
+			counts: [16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+			values: []byte{
+				0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+				0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+				0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+				0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+				0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+				0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+				0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+				0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+				0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+				0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+				0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+				0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+				0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+				0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+				0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+				0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+				0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+				0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+				0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+				0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+				0xf9, 0xfa,
+			},
+		},
+		{
+			counts: [16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+			values: []byte{
+				0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+				0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+				0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+				0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+				0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+				0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+				0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+				0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+				0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+				0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+				0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+				0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+				0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+				0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+				0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+				0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+				0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+				0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+				0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+				0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+				0xf9, 0xfa,
+			},
+		},
+	},
+}
+
+// jpegDCTCos holds the cosines of the forward DCT, scaled so that a row and a
+// column pass give the coefficients of section A.3.3 of the JPEG specification.
+var jpegDCTCos = func() (table [8][8]float64) {
+	for u := 0; u < 8; u++ {
+		for x := 0; x < 8; x++ {
+			c := math.Cos(float64((2*x+1)*u) * math.Pi / 16)
+			if u == 0 {
+				c *= math.Sqrt2 / 2
+			}
+			table[u][x] = c / 2
+		}
+	}
+	return table
+}()
+
+// jpegHuffman is a Huffman table ready for encoding.
+type jpegHuffman struct {
+	spec  jpegHuffmanSpec
+	codes [256]uint16
+	sizes [256]uint8
+}
+
+// newJPEGHuffman assigns the codes of spec as section C of the JPEG
+// specification does.
+func newJPEGHuffman(spec jpegHuffmanSpec) *jpegHuffman {
+	h := &jpegHuffman{spec: spec}
+	code, k := uint16(0), 0
+	for length := 1; length <= 16; length++ {
+		for i := 0; i < int(spec.counts[length-1]); i++ {
+			h.codes[spec.values[k]], h.sizes[spec.values[k]] = code, uint8(length)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return h
+}
+
+// optimalJPEGHuffman builds the Huffman table that codes symbols with the
+// given frequencies in the fewest bits, with codes of at most 16 bits, as
+// section K.2 of the JPEG specification describes.
+func optimalJPEGHuffman(freq [257]int) jpegHuffmanSpec {
+	used := false
+	for _, f := range freq[:256] {
+		used = used || f > 0
+	}
+	if !used {
+		freq[0] = 1 // A table needs at least one code
+	}
+	freq[256] = 1 // Reserves the code of only ones, which is not allowed
+
+	var codeSize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+	for {
+		// Merge the two least frequent subtrees, preferring higher symbols on ties
+		c1, c2 := -1, -1
+		for i, f := range freq {
+			if f > 0 && (c1 < 0 || f <= freq[c1]) {
+				c1 = i
+			}
+		}
+		for i, f := range freq {
+			if f > 0 && i != c1 && (c2 < 0 || f <= freq[c2]) {
+				c2 = i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+
+		freq[c1] += freq[c2]
+		freq[c2] = 0
+		codeSize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codeSize[c1]++
+		}
+		others[c1] = c2
+		codeSize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codeSize[c2]++
+		}
+	}
+
+	var counts [258]int
+	for _, size := range codeSize {
+		if size > 0 {
+			counts[size]++
+		}
+	}
+	// Move codes longer than 16 bits up the tree
+	for i := len(counts) - 1; i > 16; i-- {
+		for counts[i] > 0 {
+			j := i - 2
+			for counts[j] == 0 {
+				j--
+			}
+			counts[i] -= 2
+			counts[i-1]++
+			counts[j+1] += 2
+			counts[j]--
+		}
+	}
+	// Drop the reserved code, which is one of the longest
+	for i := 16; i > 0; i-- {
+		if counts[i] > 0 {
+			counts[i]--
+			break
+		}
+	}
+
+	var spec jpegHuffmanSpec
+	for i := 1; i <= 16; i++ {
+		spec.counts[i-1] = byte(counts[i])
+	}
+	for size := 1; size < len(codeSize); size++ {
+		for symbol := 0; symbol < 256; symbol++ {
+			if codeSize[symbol] == size {
+				spec.values = append(spec.values, byte(symbol))
+			}
+		}
+	}
+	return spec
+}
+
+// jpegComponent is a colour component of a JPEG image.
+type jpegComponent struct {
+	id      byte
+	h, v    int // Sampling factors
+	table   int // Quantisation and Huffman tables: 0 luminance, 1 chrominance
+	blocksX int // Blocks per row, covering whole MCUs
+	blocksY int
+	coefs   []int16 // Quantised coefficients of every block in zig-zag order
+}
+
+// block returns the coefficients of the block at bx, by.
+func (c *jpegComponent) block(bx, by int) []int16 {
+	i := (by*c.blocksX + bx) * 64
+	return c.coefs[i : i+64]
+}
+
+// jpegScan is a scan of a JPEG image. Sequential JPEGs have a single scan of
+// all components and coefficients, progressive JPEGs send bands of the
+// coefficients (spectral selection) and their bits from the most significant
+// on (successive approximation) in separate scans.
+type jpegScan struct {
+	components []int // Indexes of the components in the scan
+	ss, se     int   // First and last coefficient in zig-zag order
+	ah, al     int   // Bit position of the previous and of this scan
+}
+
+// jpegEncoder holds an image transformed into quantised coefficients.
+type jpegEncoder struct {
+	width, height int
+	options       jpegOptions
+	quant         [2][64]byte // Zig-zag order
+	components    []jpegComponent
+	hmax, vmax    int
+	mcusX, mcusY  int
+}
+
+// writeJPEG encodes img as a JPEG file. Images of type *image.Gray are stored
+// as grayscale, all others as YCbCr like image/jpeg does. Edge blocks are
+// padded by repeating the last row and column.
+func writeJPEG(w io.Writer, img image.Image, options jpegOptions) error {
+	bounds := img.Bounds()
+	e := &jpegEncoder{width: bounds.Dx(), height: bounds.Dy(), options: options}
+	if e.width < 1 || e.height < 1 || e.width > 0xFFFF || e.height > 0xFFFF {
+		return fmt.Errorf("image of %dx%d cannot be stored as jpeg", e.width, e.height)
+	}
+
+	quality := min(max(options.quality, 1), 100)
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	for t := range e.quant {
+		for i, base := range jpegBaseQuant[t] {
+			e.quant[t][i] = byte(min(max((int(base)*scale+50)/100, 1), 255))
+		}
+	}
+
+	if _, gray := img.(*image.Gray); gray {
+		e.components = []jpegComponent{{id: 1, h: 1, v: 1}}
+	} else {
+		h, v := 2, 2
+		switch options.subsampling {
+		case config.Subsampling444:
+			h, v = 1, 1
+		case config.Subsampling422:
+			v = 1
+		}
+		e.components = []jpegComponent{{id: 1, h: h, v: v}, {id: 2, h: 1, v: 1, table: 1}, {id: 3, h: 1, v: 1, table: 1}}
+	}
+	e.hmax, e.vmax = e.components[0].h, e.components[0].v
+	e.mcusX = (e.width + 8*e.hmax - 1) / (8 * e.hmax)
+	e.mcusY = (e.height + 8*e.vmax - 1) / (8 * e.vmax)
+
+	planes := e.readPlanes(img)
+	for i := range e.components {
+		e.transform(&e.components[i], planes[i])
+	}
+
+	out := bufio.NewWriterSize(w, 64*1024)
+	out.Write([]byte{0xFF, jpegMarkerSOI})
+	e.writeHeaders(out)
+	bw := &jpegBitWriter{w: out}
+	for _, scan := range e.scans() {
+		e.writeScan(out, bw, scan)
+	}
+	out.Write([]byte{0xFF, jpegMarkerEOI})
+	return out.Flush()
+}
+
+// readPlanes converts img into one plane per component, padded to whole MCUs.
+func (e *jpegEncoder) readPlanes(img image.Image) [][]uint8 {
+	bounds := img.Bounds()
+	stride, rows := e.mcusX*e.hmax*8, e.mcusY*e.vmax*8
+
+	var pixel func(x, y int) (uint8, uint8, uint8)
+	switch m := img.(type) {
+	case *image.Gray:
+		pixel = func(x, y int) (uint8, uint8, uint8) { return m.GrayAt(x, y).Y, 0, 0 }
+	case *image.YCbCr:
+		pixel = func(x, y int) (uint8, uint8, uint8) {
+			c := m.YCbCrAt(x, y)
+			return c.Y, c.Cb, c.Cr
+		}
+	case *image.RGBA:
+		pixel = func(x, y int) (uint8, uint8, uint8) {
+			p := m.Pix[m.PixOffset(x, y):]
+			return color.RGBToYCbCr(p[0], p[1], p[2])
+		}
+	default:
+		pixel = func(x, y int) (uint8, uint8, uint8) {
+			r, g, b, _ := img.At(x, y).RGBA()
+			return color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+		}
+	}
+
+	planes := make([][]uint8, len(e.components))
+	for i := range planes {
+		planes[i] = make([]uint8, stride*rows)
+	}
+	for y := 0; y < rows; y++ {
+		sy := bounds.Min.Y + min(y, e.height-1)
+		for x := 0; x < stride; x++ {
+			yy, cb, cr := pixel(bounds.Min.X+min(x, e.width-1), sy)
+			planes[0][y*stride+x] = yy
+			if len(planes) == 3 {
+				planes[1][y*stride+x], planes[2][y*stride+x] = cb, cr
+			}
+		}
+	}
+	return planes
+}
+
+// transform downsamples plane to the sampling factors of c, then applies the
+// forward DCT to every block and quantises the coefficients.
+func (e *jpegEncoder) transform(c *jpegComponent, plane []uint8) {
+	c.blocksX, c.blocksY = e.mcusX*c.h, e.mcusY*c.v
+	c.coefs = make([]int16, c.blocksX*c.blocksY*64)
+	srcStride := e.mcusX * e.hmax * 8
+	stride := c.blocksX * 8
+	fx, fy := e.hmax/c.h, e.vmax/c.v
+
+	// Average each fx by fy area of the full resolution plane
+	samples := plane
+	if fx > 1 || fy > 1 {
+		samples = make([]uint8, stride*c.blocksY*8)
+		n := fx * fy
+		for y := 0; y < c.blocksY*8; y++ {
+			for x := 0; x < stride; x++ {
+				sum := 0
+				for dy := 0; dy < fy; dy++ {
+					for dx := 0; dx < fx; dx++ {
+						sum += int(plane[(y*fy+dy)*srcStride+x*fx+dx])
+					}
+				}
+				samples[y*stride+x] = uint8((sum + n/2) / n)
+			}
+		}
+	}
+
+	quant := &e.quant[c.table]
+	var block [64]float64
+	for by := 0; by < c.blocksY; by++ {
+		for bx := 0; bx < c.blocksX; bx++ {
+			for y := 0; y < 8; y++ {
+				row := samples[(by*8+y)*stride+bx*8:]
+				for x := 0; x < 8; x++ {
+					block[y*8+x] = float64(row[x]) - 128
+				}
+			}
+			jpegFDCT(&block)
+
+			coefs := c.block(bx, by)
+			for zig, natural := range jpegZigzag {
+				coefs[zig] = int16(math.Round(block[natural] / float64(quant[zig])))
+			}
+		}
+	}
+}
+
+// jpegFDCT replaces the samples of block by their DCT coefficients.
+func jpegFDCT(block *[64]float64) {
+	var rows [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < 8; x++ {
+				sum += jpegDCTCos[u][x] * block[y*8+x]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			sum := 0.0
+			for y := 0; y < 8; y++ {
+				sum += jpegDCTCos[v][y] * rows[y*8+u]
+			}
+			block[v*8+u] = sum
+		}
+	}
+}
+
+// writeHeaders writes the quantisation tables and the frame header.
+func (e *jpegEncoder) writeHeaders(out *bufio.Writer) {
+	var dqt []byte
+	for t := 0; t < min(len(e.components), 2); t++ {
+		dqt = append(dqt, byte(t))
+		dqt = append(dqt, e.quant[t][:]...)
+	}
+	writeJPEGSegment(out, jpegMarkerDQT, dqt)
+
+	marker := byte(jpegMarkerSOF0)
+	if e.options.progressive {
+		marker = jpegMarkerSOF2
+	}
+	sof := []byte{8} // Bits per sample
+	sof = binary.BigEndian.AppendUint16(sof, uint16(e.height))
+	sof = binary.BigEndian.AppendUint16(sof, uint16(e.width))
+	sof = append(sof, byte(len(e.components)))
+	for _, c := range e.components {
+		sof = append(sof, c.id, byte(c.h<<4|c.v), byte(c.table))
+	}
+	writeJPEGSegment(out, marker, sof)
+}
+
+// scans returns the scans of the image. Progressive JPEGs use the scan script
+// of libjpeg: DC first, then low luma frequencies and chroma at reduced
+// precision, followed by the remaining bits.
+func (e *jpegEncoder) scans() []jpegScan {
+	all := []int{0}
+	if len(e.components) == 3 {
+		all = []int{0, 1, 2}
+	}
+	if !e.options.progressive {
+		return []jpegScan{{components: all, se: 63}}
+	}
+
+	if len(e.components) == 1 {
+		return []jpegScan{
+			{components: all, al: 1},
+			{components: all, ss: 1, se: 5, al: 2},
+			{components: all, ss: 6, se: 63, al: 2},
+			{components: all, ss: 1, se: 63, ah: 2, al: 1},
+			{components: all, ah: 1},
+			{components: all, ss: 1, se: 63, ah: 1},
+		}
+	}
+	y, cb, cr := []int{0}, []int{1}, []int{2}
+	return []jpegScan{
+		{components: all, al: 1},
+		{components: y, ss: 1, se: 5, al: 2},
+		{components: cr, ss: 1, se: 63, al: 1},
+		{components: cb, ss: 1, se: 63, al: 1},
+		{components: y, ss: 6, se: 63, al: 2},
+		{components: y, ss: 1, se: 63, ah: 2, al: 1},
+		{components: all, ah: 1},
+		{components: cr, ss: 1, se: 63, ah: 1},
+		{components: cb, ss: 1, se: 63, ah: 1},
+		{components: y, ss: 1, se: 63, ah: 1},
+	}
+}
+
+// writeScan writes the Huffman tables a scan uses, its header and its data.
+// Optimized tables are built from the symbols of a first pass over the scan.
+func (e *jpegEncoder) writeScan(out *bufio.Writer, bw *jpegBitWriter, scan jpegScan) {
+	var used [2][2]bool
+	for _, i := range scan.components {
+		table := e.components[i].table
+		used[jpegDC][table] = used[jpegDC][table] || (scan.ss == 0 && scan.ah == 0)
+		used[jpegAC][table] = used[jpegAC][table] || scan.se > 0
+	}
+
+	var tables [2][2]*jpegHuffman
+	var gathered *jpegScanCoder
+	if e.options.optimize || e.options.progressive {
+		gathered = &jpegScanCoder{scan: scan}
+		e.encodeScan(gathered)
+	}
+	var dht []byte
+	for class := range used {
+		for table := range used[class] {
+			if !used[class][table] {
+				continue
+			}
+			spec := jpegStandardTables[class][table]
+			if gathered != nil {
+				spec = optimalJPEGHuffman(gathered.freq[class][table])
+			}
+			tables[class][table] = newJPEGHuffman(spec)
+			dht = append(dht, byte(class<<4|table))
+			dht = append(dht, spec.counts[:]...)
+			dht = append(dht, spec.values...)
+		}
+	}
+	if len(dht) > 0 {
+		writeJPEGSegment(out, jpegMarkerDHT, dht)
+	}
+
+	sos := []byte{byte(len(scan.components))}
+	for _, i := range scan.components {
+		c := e.components[i]
+		sos = append(sos, c.id, byte(c.table<<4|c.table))
+	}
+	sos = append(sos, byte(scan.ss), byte(scan.se), byte(scan.ah<<4|scan.al))
+	writeJPEGSegment(out, jpegMarkerSOS, sos)
+
+	e.encodeScan(&jpegScanCoder{scan: scan, bw: bw, tables: tables})
+	bw.flush()
+}
+
+// encodeScan runs coder over the blocks of its scan. Scans of several
+// components interleave their blocks MCU by MCU, scans of a single component
+// only cover the blocks that hold part of the image.
+func (e *jpegEncoder) encodeScan(coder *jpegScanCoder) {
+	scan := coder.scan
+	if len(scan.components) == 1 {
+		i := scan.components[0]
+		c := &e.components[i]
+		coder.acTable = c.table
+		blocksX := ((e.width*c.h+e.hmax-1)/e.hmax + 7) / 8
+		blocksY := ((e.height*c.v+e.vmax-1)/e.vmax + 7) / 8
+		for by := 0; by < blocksY; by++ {
+			for bx := 0; bx < blocksX; bx++ {
+				coder.encodeBlock(i, c.table, c.block(bx, by))
+			}
+		}
+	} else {
+		for my := 0; my < e.mcusY; my++ {
+			for mx := 0; mx < e.mcusX; mx++ {
+				for _, i := range scan.components {
+					c := &e.components[i]
+					for by := 0; by < c.v; by++ {
+						for bx := 0; bx < c.h; bx++ {
+							coder.encodeBlock(i, c.table, c.block(mx*c.h+bx, my*c.v+by))
+						}
+					}
+				}
+			}
+		}
+	}
+	coder.flushEOBRun()
+}
+
+// jpegScanCoder entropy codes the blocks of a scan. Without a bit writer it
+// only counts the symbols the scan needs, for optimized Huffman tables.
+type jpegScanCoder struct {
+	scan   jpegScan
+	bw     *jpegBitWriter
+	freq   [2][2][257]int // Symbol frequencies by class and table
+	tables [2][2]*jpegHuffman
+
+	lastDC      [3]int // DC value of the previous block of each component
+	acTable     int    // Huffman table of the component of AC scans
+	eobrun      int    // Number of blocks in the pending end-of-band run
+	corrections []byte // Correction bits of the blocks in the end-of-band run
+	blockBits   []byte // Correction bits of the current block
+}
+
+// encodeBlock codes the part of a block that the scan holds.
+func (sc *jpegScanCoder) encodeBlock(component, table int, block []int16) {
+	scan := sc.scan
+	switch {
+	case scan.se == 63 && scan.ss == 0:
+		sc.encodeSequential(component, table, block)
+	case scan.ss == 0 && scan.ah == 0:
+		sc.encodeDC(component, table, int(block[0])>>scan.al)
+	case scan.ss == 0:
+		sc.bits(uint32(int(block[0])>>scan.al)&1, 1)
+	case scan.ah == 0:
+		sc.encodeACFirst(table, block)
+	default:
+		sc.encodeACRefine(table, block)
+	}
+}
+
+// encodeSequential codes all coefficients of a block of a baseline JPEG.
+func (sc *jpegScanCoder) encodeSequential(component, table int, block []int16) {
+	sc.encodeDC(component, table, int(block[0]))
+	run := 0
+	for _, coef := range block[1:] {
+		if coef == 0 {
+			run++
+			continue
+		}
+		for ; run > 15; run -= 16 {
+			sc.symbol(jpegAC, table, 0xF0)
+		}
+		size, value := jpegValue(int(coef))
+		sc.symbol(jpegAC, table, run<<4|size)
+		sc.bits(value, size)
+		run = 0
+	}
+	if run > 0 {
+		sc.symbol(jpegAC, table, 0x00)
+	}
+}
+
+// encodeDC codes the difference of dc to the DC value of the previous block.
+func (sc *jpegScanCoder) encodeDC(component, table, dc int) {
+	size, value := jpegValue(dc - sc.lastDC[component])
+	sc.lastDC[component] = dc
+	sc.symbol(jpegDC, table, size)
+	sc.bits(value, size)
+}
+
+// encodeACFirst codes the band of a block in the first scan of its bits.
+// Blocks whose band is empty join an end-of-band run.
+func (sc *jpegScanCoder) encodeACFirst(table int, block []int16) {
+	run := 0
+	for k := sc.scan.ss; k <= sc.scan.se; k++ {
+		coef := int(block[k])
+		if coef < 0 {
+			coef = -(-coef >> sc.scan.al)
+		} else {
+			coef >>= sc.scan.al
+		}
+		if coef == 0 {
+			run++
+			continue
+		}
+
+		sc.flushEOBRun()
+		for ; run > 15; run -= 16 {
+			sc.symbol(jpegAC, table, 0xF0)
+		}
+		size, value := jpegValue(coef)
+		sc.symbol(jpegAC, table, run<<4|size)
+		sc.bits(value, size)
+		run = 0
+	}
+
+	if run > 0 {
+		sc.eobrun++
+		if sc.eobrun == jpegMaxEOBRun {
+			sc.flushEOBRun()
+		}
+	}
+}
+
+// encodeACRefine codes the next bit of the band of a block. Coefficients that
+// become non-zero are coded like in a first scan, the bits of coefficients
+// that already are non-zero follow as correction bits, following section
+// G.1.2.3 of the JPEG specification and libjpeg.
+func (sc *jpegScanCoder) encodeACRefine(table int, block []int16) {
+	var magnitudes [64]int
+	eob := 0 // Last coefficient that becomes non-zero
+	for k := sc.scan.ss; k <= sc.scan.se; k++ {
+		coef := int(block[k])
+		if coef < 0 {
+			coef = -coef
+		}
+		magnitudes[k] = coef >> sc.scan.al
+		if magnitudes[k] == 1 {
+			eob = k
+		}
+	}
+
+	run := 0
+	sc.blockBits = sc.blockBits[:0]
+	for k := sc.scan.ss; k <= sc.scan.se; k++ {
+		if magnitudes[k] == 0 {
+			run++
+			continue
+		}
+
+		// Zero runs past the last new coefficient fold into the end of band
+		for run > 15 && k <= eob {
+			sc.flushEOBRun()
+			sc.symbol(jpegAC, table, 0xF0)
+			run -= 16
+			sc.emitBits(sc.blockBits)
+			sc.blockBits = sc.blockBits[:0]
+		}
+
+		if magnitudes[k] > 1 {
+			sc.blockBits = append(sc.blockBits, byte(magnitudes[k]&1))
+			continue
+		}
+
+		sc.flushEOBRun()
+		sc.symbol(jpegAC, table, run<<4|1)
+		sign := uint32(1)
+		if block[k] < 0 {
+			sign = 0
+		}
+		sc.bits(sign, 1)
+		sc.emitBits(sc.blockBits)
+		sc.blockBits = sc.blockBits[:0]
+		run = 0
+	}
+
+	if run > 0 || len(sc.blockBits) > 0 {
+		sc.eobrun++
+		sc.corrections = append(sc.corrections, sc.blockBits...)
+		if sc.eobrun == jpegMaxEOBRun || len(sc.corrections) > jpegMaxCorrectionBits-63 {
+			sc.flushEOBRun()
+		}
+	}
+}
+
+// flushEOBRun codes the pending end-of-band run and the correction bits of its
+// blocks.
+func (sc *jpegScanCoder) flushEOBRun() {
+	if sc.eobrun == 0 {
+		return
+	}
+	size := bits.Len(uint(sc.eobrun)) - 1
+	sc.symbol(jpegAC, sc.acTable, size<<4)
+	sc.bits(uint32(sc.eobrun), size)
+	sc.eobrun = 0
+	sc.emitBits(sc.corrections)
+	sc.corrections = sc.corrections[:0]
+}
+
+// symbol codes a Huffman symbol, or counts it while gathering statistics.
+func (sc *jpegScanCoder) symbol(class, table, symbol int) {
+	if sc.bw == nil {
+		sc.freq[class][table][symbol]++
+		return
+	}
+	h := sc.tables[class][table]
+	sc.bw.writeBits(uint32(h.codes[symbol]), int(h.sizes[symbol]))
+}
+
+// bits writes the n lowest bits of value unless statistics are gathered.
+func (sc *jpegScanCoder) bits(value uint32, n int) {
+	if sc.bw != nil && n > 0 {
+		sc.bw.writeBits(value, n)
+	}
+}
+
+// emitBits writes correction bits, one per byte.
+func (sc *jpegScanCoder) emitBits(bits []byte) {
+	for _, bit := range bits {
+		sc.bits(uint32(bit), 1)
+	}
+}
+
+// jpegValue returns the size category of v and the bits that code v within it.
+// Negative values are coded as their ones' complement.
+func jpegValue(v int) (size int, value uint32) {
+	magnitude := v
+	if v < 0 {
+		magnitude = -v
+		v--
+	}
+	size = bits.Len(uint(magnitude))
+	return size, uint32(v) & (1<<size - 1)
+}
+
+// jpegBitWriter writes entropy coded data, stuffing a zero byte after every
+// 0xFF so that it is not mistaken for a marker.
+type jpegBitWriter struct {
+	w     *bufio.Writer
+	acc   uint64
+	nbits int
+}
+
+// writeBits writes the n lowest bits of value, most significant first.
+func (bw *jpegBitWriter) writeBits(value uint32, n int) {
+	bw.acc = bw.acc<<n | uint64(value)&(1<<n-1)
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		b := byte(bw.acc >> (bw.nbits - 8))
+		bw.w.WriteByte(b)
+		if b == 0xFF {
+			bw.w.WriteByte(0)
+		}
+		bw.nbits -= 8
+	}
+	bw.acc &= 1<<bw.nbits - 1
+}
+
+// flush pads the last byte of a scan with one bits.
+func (bw *jpegBitWriter) flush() {
+	if bw.nbits > 0 {
+		bw.writeBits(0xFF, 8-bw.nbits)
+	}
+}
+
+// writeJPEGSegment writes a marker segment.
+func writeJPEGSegment(out *bufio.Writer, marker byte, payload []byte) {
+	out.Write([]byte{0xFF, marker})
+	out.Write(binary.BigEndian.AppendUint16(nil, uint16(2+len(payload))))
+	out.Write(payload)
+}
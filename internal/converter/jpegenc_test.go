@@ -0,0 +1,253 @@
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/MostafaSensei106/GoPix/internal/config"
+)
+
+// jpegTestImage returns a w x h image of smooth gradients with a little
+// noise, like a small photo.
+func jpegTestImage(w, h int, gray bool) image.Image {
+	rng := rand.New(rand.NewSource(int64(w*1000 + h)))
+	if gray {
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.SetGray(x, y, color.Gray{Y: uint8((x*255/max(w-1, 1)+y*64/max(h-1, 1))%256/2 + rng.Intn(16))})
+			}
+		}
+		return img
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(x*200/max(w-1, 1) + rng.Intn(32)),
+				G: uint8(y*200/max(h-1, 1) + rng.Intn(32)),
+				B: uint8(128 + rng.Intn(64)),
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+// jpegPSNR returns the peak signal-to-noise ratio of b against a in dB,
+// capped at 99 dB for identical images.
+func jpegPSNR(a, b image.Image) float64 {
+	var sum float64
+	var n int
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ca := color.RGBAModel.Convert(a.At(x, y)).(color.RGBA)
+			cb := color.RGBAModel.Convert(b.At(x, y)).(color.RGBA)
+			for _, d := range []int{int(ca.R) - int(cb.R), int(ca.G) - int(cb.G), int(ca.B) - int(cb.B)} {
+				sum += float64(d * d)
+				n++
+			}
+		}
+	}
+	if sum == 0 {
+		return 99
+	}
+	return min(10*math.Log10(255*255/(sum/float64(n))), 99)
+}
+
+// jpegSameImage reports whether two decoded JPEGs hold the same pixels.
+func jpegSameImage(a, b image.Image) bool {
+	bounds := a.Bounds()
+	if bounds != b.Bounds() {
+		return false
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if color.RGBAModel.Convert(a.At(x, y)) != color.RGBAModel.Convert(b.At(x, y)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestWriteJPEG(t *testing.T) {
+	sizes := []image.Point{{1, 1}, {7, 9}, {17, 33}}
+	subsamplings := []string{config.Subsampling444, config.Subsampling422, config.Subsampling420}
+	modes := []struct {
+		name        string
+		progressive bool
+		optimize    bool
+	}{
+		{"baseline", false, false},
+		{"optimized", false, true},
+		{"progressive", true, false},
+		{"progressive optimized", true, true},
+	}
+
+	type testCase struct {
+		name    string
+		img     image.Image
+		options jpegOptions
+	}
+	var tests []testCase
+	for _, size := range sizes {
+		for _, gray := range []bool{false, true} {
+			img := jpegTestImage(size.X, size.Y, gray)
+			for _, subsampling := range subsamplings {
+				for _, mode := range modes {
+					for _, quality := range []int{50, 90} {
+						name := fmt.Sprintf("%dx%d %s %s q%d", size.X, size.Y, subsampling, mode.name, quality)
+						if gray {
+							// Grayscale images have no chroma to subsample
+							if subsampling != config.Subsampling444 {
+								continue
+							}
+							name = fmt.Sprintf("%dx%d gray %s q%d", size.X, size.Y, mode.name, quality)
+						}
+						tests = append(tests, testCase{name, img, jpegOptions{
+							quality:     quality,
+							subsampling: subsampling,
+							progressive: mode.progressive,
+							optimize:    mode.optimize,
+						}})
+					}
+				}
+			}
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeJPEG(&buf, tt.img, tt.options); err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			decoded, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if decoded.Bounds() != tt.img.Bounds() {
+				t.Fatalf("bounds %v, want %v", decoded.Bounds(), tt.img.Bounds())
+			}
+			if _, gray := tt.img.(*image.Gray); gray {
+				if _, ok := decoded.(*image.Gray); !ok {
+					t.Errorf("decoded %T, want a grayscale image", decoded)
+				}
+			}
+
+			// The standard encoder subsamples 4:2:0, which no mode may fall far behind
+			var std bytes.Buffer
+			if err := jpeg.Encode(&std, tt.img, &jpeg.Options{Quality: tt.options.quality}); err != nil {
+				t.Fatalf("standard encode: %v", err)
+			}
+			stdDecoded, err := jpeg.Decode(&std)
+			if err != nil {
+				t.Fatalf("standard decode: %v", err)
+			}
+			got, want := jpegPSNR(tt.img, decoded), jpegPSNR(tt.img, stdDecoded)
+			if got < want-0.5 {
+				t.Errorf("PSNR %.2f dB, image/jpeg reaches %.2f dB", got, want)
+			}
+
+			// Progression and Huffman tables only change how the same coefficients are stored
+			if tt.options.progressive || tt.options.optimize {
+				baselineOptions := tt.options
+				baselineOptions.progressive, baselineOptions.optimize = false, false
+				var baseline bytes.Buffer
+				if err := writeJPEG(&baseline, tt.img, baselineOptions); err != nil {
+					t.Fatalf("baseline encode: %v", err)
+				}
+				baselineDecoded, err := jpeg.Decode(&baseline)
+				if err != nil {
+					t.Fatalf("baseline decode: %v", err)
+				}
+				if !jpegSameImage(decoded, baselineDecoded) {
+					t.Errorf("decodes differently from the baseline JPEG")
+				}
+			}
+		})
+	}
+}
+
+func TestOptimalJPEGHuffman(t *testing.T) {
+	fibonacci := [257]int{}
+	a, b := 1, 1
+	for i := 0; i < 40; i++ {
+		fibonacci[i] = a
+		a, b = b, a+b
+	}
+
+	uniform := [257]int{}
+	for i := 0; i < 256; i++ {
+		uniform[i] = 1
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	random := [257]int{}
+	for i := 0; i < 256; i++ {
+		if rng.Intn(3) > 0 {
+			random[i] = 1 + rng.Intn(1<<rng.Intn(20))
+		}
+	}
+
+	tests := []struct {
+		name string
+		freq [257]int
+	}{
+		{"empty", [257]int{}},
+		{"single symbol", [257]int{7: 100}},
+		{"two symbols", [257]int{0: 1, 255: 1000000}},
+		{"fibonacci", fibonacci},
+		{"uniform", uniform},
+		{"random", random},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := optimalJPEGHuffman(tt.freq)
+
+			// Every used symbol gets exactly one code
+			var used []byte
+			for symbol, f := range tt.freq[:256] {
+				if f > 0 {
+					used = append(used, byte(symbol))
+				}
+			}
+			if len(used) == 0 {
+				used = []byte{0}
+			}
+			total := 0
+			for _, count := range spec.counts {
+				total += int(count)
+			}
+			if total != len(spec.values) || total != len(used) {
+				t.Fatalf("%d codes for %d values, want %d", total, len(spec.values), len(used))
+			}
+			seen := map[byte]bool{}
+			for _, value := range spec.values {
+				if seen[value] || tt.freq[value] == 0 && len(used) > 1 {
+					t.Fatalf("unexpected value %d", value)
+				}
+				seen[value] = true
+			}
+
+			// Codes fit into 16 bits and leave the code of only ones unused
+			space := 0
+			for i, count := range spec.counts {
+				space += int(count) << (15 - i)
+			}
+			if space >= 1<<16 {
+				t.Errorf("code lengths overflow 16 bits: %v", spec.counts)
+			}
+			newJPEGHuffman(spec)
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package converter
+
+import (
+	"image"
+	"image/draw"
+)
+
+// autoLosslessMaxColors is the number of distinct colours up to which an image
+// from a lossless source counts as a graphic and is encoded losslessly in
+// auto mode. Lossy WebP smears the hard edges of logos, icons and screenshots
+// with few colours, while lossless WebP stores them smaller than lossy anyway.
+const autoLosslessMaxColors = 256
+
+// nearLosslessStep is the spacing of the colour values left by near-lossless
+// mode. Rounding to a multiple of 4 moves every channel by at most 2 levels,
+// which is invisible, while the lossless encoder finds far fewer distinct
+// values and residuals to store.
+const nearLosslessStep = 4
+
+// losslessSourceFormats are the decoded formats that can hold graphics worth
+// keeping pixel exact. JPEG sources are photos that already lost detail.
+var losslessSourceFormats = map[string]bool{
+	"png":  true,
+	"gif":  true,
+	"bmp":  true,
+	"tiff": true,
+}
+
+// webpLossless decides whether img, decoded from srcFormat, is encoded as
+// lossless WebP. In auto mode graphics from lossless sources that use
+// transparency or only few colours are kept lossless, photos are encoded lossy.
+func (ic *ImageConverter) webpLossless(img image.Image, srcFormat string) bool {
+	settings := ic.options.Encoders.WebP
+	if !settings.AutoLossless {
+		return settings.Lossless
+	}
+
+	if !losslessSourceFormats[srcFormat] {
+		return false
+	}
+	return hasTransparency(img) || hasFewColors(img, autoLosslessMaxColors)
+}
+
+// hasTransparency reports whether any pixel of img is not fully opaque.
+func hasTransparency(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return !opaque.Opaque()
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasFewColors reports whether img uses at most limit distinct colours. It stops
+// as soon as the limit is exceeded, which happens within a few rows for photos.
+func hasFewColors(img image.Image, limit int) bool {
+	if paletted, ok := img.(*image.Paletted); ok && len(paletted.Palette) <= limit {
+		return true
+	}
+
+	colors := make(map[[4]uint32]struct{}, limit+1)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			colors[[4]uint32{r, g, b, a}] = struct{}{}
+			if len(colors) > limit {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// nearLossless returns a copy of img with every colour channel rounded to a
+// multiple of nearLosslessStep, for near-lossless WebP output. Alpha is kept
+// exact, so the edges of transparent graphics do not move.
+func nearLossless(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	rounded := image.NewNRGBA(bounds)
+	draw.Draw(rounded, bounds, img, bounds.Min, draw.Src)
+
+	for i := 0; i < len(rounded.Pix); i += 4 {
+		for c := i; c < i+3; c++ {
+			v := (int(rounded.Pix[c]) + nearLosslessStep/2) / nearLosslessStep * nearLosslessStep
+			rounded.Pix[c] = uint8(min(v, 0xff))
+		}
+	}
+	return rounded
+}
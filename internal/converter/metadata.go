@@ -0,0 +1,304 @@
+package converter
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Metadata policies for EXIF, XMP and ICC data. Metadata is carried over
+// from JPEG, PNG, WebP, HEIC and AVIF files to JPEG, PNG and WebP files,
+// other formats never receive any. Non-sRGB
+// ICC profiles follow the colour profile mode instead, see ColorProfileEmbed.
+const (
+	// MetadataStripAll drops all metadata, only the pixels are converted.
+	MetadataStripAll = "strip-all"
+	// MetadataKeepAll copies EXIF, XMP and ICC data to the output.
+	MetadataKeepAll = "keep-all"
+	// MetadataKeepCopyright copies only the artist and copyright notices of
+	// EXIF and XMP, together with the ICC profile.
+	MetadataKeepCopyright = "keep-copyright-only"
+	// MetadataStripGPS copies all metadata except the GPS location.
+	MetadataStripGPS = "strip-gps"
+)
+
+// MetadataPolicies lists the accepted metadata policies.
+var MetadataPolicies = []string{MetadataStripAll, MetadataKeepAll, MetadataKeepCopyright, MetadataStripGPS}
+
+// Headers that identify metadata segments and chunks.
+var (
+	// exifHeader precedes the EXIF data in JPEG APP1 segments and, in files of
+	// some writers, in WebP EXIF chunks.
+	exifHeader = []byte("Exif\x00\x00")
+	// xmpHeader precedes the XMP packet in JPEG APP1 segments.
+	xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	// iccHeader precedes each part of the ICC profile in JPEG APP2 segments.
+	iccHeader = []byte("ICC_PROFILE\x00")
+	// pngSignature starts every PNG file.
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// pngXMPKeyword is the keyword of the PNG iTXt chunk that holds XMP.
+const pngXMPKeyword = "XML:com.adobe.xmp"
+
+// sourceMetadata holds the metadata blocks found in a source image.
+type sourceMetadata struct {
+	orientation int    // EXIF orientation, 1 = upright
+	exif        []byte // TIFF structure, without the exifHeader
+	xmp         []byte // XMP packet
+	icc         []byte // ICC profile
+}
+
+// empty reports whether there is no metadata to write.
+func (m *sourceMetadata) empty() bool {
+	return len(m.exif) == 0 && len(m.xmp) == 0 && len(m.icc) == 0
+}
+
+// metadataPolicy returns the configured policy, or strip-all for sessions
+// saved before metadata could be kept.
+func metadataPolicy(policy string) string {
+	if policy == "" {
+		return MetadataStripAll
+	}
+	return policy
+}
+
+// readMetadata extracts the metadata of the image at path, which was decoded
+// as format. Malformed metadata is ignored rather than failing the conversion.
+// Only the orientation is read from TIFF files, whose tags describe the file
+// layout as well.
+//
+// The orientation of HEIC and AVIF files is left to the container: the
+// rotation and mirroring it records supersede the EXIF tag.
+func readMetadata(path, format string) (*sourceMetadata, error) {
+	meta := &sourceMetadata{orientation: 1}
+	switch format {
+	case "jpeg", "png", "webp", "tiff", "heic", "heif", "avif":
+	default:
+		return meta, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "jpeg":
+		readJPEGMetadata(data, meta)
+	case "png":
+		readPNGMetadata(data, meta)
+	case "webp":
+		chunks, _ := readWebPChunks(data)
+		for _, chunk := range chunks {
+			switch chunk.id {
+			case "EXIF":
+				meta.exif = bytes.TrimPrefix(chunk.data, exifHeader)
+			case "XMP ":
+				meta.xmp = chunk.data
+			case "ICCP":
+				meta.icc = chunk.data
+			}
+		}
+	case "tiff":
+		meta.orientation = exifOrientation(data)
+		return meta, nil
+	case "heic", "heif", "avif":
+		readHEIFMetadata(data, meta)
+		return meta, nil
+	}
+
+	meta.orientation = exifOrientation(meta.exif)
+	return meta, nil
+}
+
+// readJPEGMetadata reads the APP1 and APP2 segments of a JPEG file. ICC
+// profiles may be split across several APP2 segments, which are numbered.
+func readJPEGMetadata(data []byte, meta *sourceMetadata) {
+	type iccPart struct {
+		seq  byte
+		data []byte
+	}
+	var parts []iccPart
+
+	for _, segment := range readJPEGSegments(data) {
+		switch {
+		case segment.marker == jpegMarkerAPP1 && bytes.HasPrefix(segment.data, exifHeader) && meta.exif == nil:
+			meta.exif = segment.data[len(exifHeader):]
+		case segment.marker == jpegMarkerAPP1 && bytes.HasPrefix(segment.data, xmpHeader) && meta.xmp == nil:
+			meta.xmp = segment.data[len(xmpHeader):]
+		case segment.marker == jpegMarkerAPP2 && bytes.HasPrefix(segment.data, iccHeader) && len(segment.data) > len(iccHeader)+2:
+			parts = append(parts, iccPart{seq: segment.data[len(iccHeader)], data: segment.data[len(iccHeader)+2:]})
+		}
+	}
+
+	sort.SliceStable(parts, func(i, j int) bool { return parts[i].seq < parts[j].seq })
+	for _, part := range parts {
+		meta.icc = append(meta.icc, part.data...)
+	}
+}
+
+// readPNGMetadata reads the eXIf, iTXt and iCCP chunks of a PNG file.
+func readPNGMetadata(data []byte, meta *sourceMetadata) {
+	for _, chunk := range readPNGChunks(data) {
+		switch chunk.id {
+		case "eXIf":
+			meta.exif = chunk.data
+		case "iTXt":
+			if xmp := pngXMP(chunk.data); xmp != nil {
+				meta.xmp = xmp
+			}
+		case "iCCP":
+			// Profile name, compression method and the zlib stream
+			name, rest, ok := bytes.Cut(chunk.data, []byte{0})
+			if ok && len(name) > 0 && len(rest) > 1 {
+				meta.icc, _ = inflate(rest[1:])
+			}
+		}
+	}
+}
+
+// pngXMP returns the XMP packet of an iTXt chunk, or nil for other text.
+func pngXMP(data []byte) []byte {
+	keyword, rest, ok := bytes.Cut(data, []byte{0})
+	if !ok || string(keyword) != pngXMPKeyword || len(rest) < 2 {
+		return nil
+	}
+	compressed := rest[0] == 1
+
+	// Skip the language tag and the translated keyword
+	parts := bytes.SplitN(rest[2:], []byte{0}, 3)
+	if len(parts) != 3 {
+		return nil
+	}
+	if compressed {
+		text, err := inflate(parts[2])
+		if err != nil {
+			return nil
+		}
+		return text
+	}
+	return parts[2]
+}
+
+// inflate decompresses a zlib stream.
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// outputMetadata applies the metadata policy to the metadata of a source. The
+// output is stored upright, so the EXIF and XMP orientation are reset.
+func (ic *ImageConverter) outputMetadata(meta *sourceMetadata) *sourceMetadata {
+	out := &sourceMetadata{orientation: 1}
+
+	switch metadataPolicy(ic.options.Metadata) {
+	case MetadataKeepAll:
+		out.exif = resetExifOrientation(meta.exif)
+		out.xmp = filterXMP(meta.xmp, keepXMPProperty)
+		out.icc = meta.icc
+	case MetadataStripGPS:
+		out.exif = stripExifGPS(resetExifOrientation(meta.exif))
+		out.xmp = filterXMP(meta.xmp, func(space, local string) bool {
+			return keepXMPProperty(space, local) && !(space == xmpNSExif && strings.HasPrefix(local, "GPS"))
+		})
+		out.icc = meta.icc
+	case MetadataKeepCopyright:
+		out.exif = copyrightExif(meta.exif)
+		out.xmp = filterXMP(meta.xmp, func(space, local string) bool {
+			return space == xmpNSRights || (space == xmpNSDC && (local == "rights" || local == "creator"))
+		})
+		out.icc = meta.icc
+	}
+
+	return out
+}
+
+// CanStoreMetadata reports whether metadata is written to outputs of format.
+func CanStoreMetadata(format string) bool {
+	switch format {
+	case "jpg", "jpeg", "png", "webp":
+		return true
+	}
+	return false
+}
+
+// JPEG markers.
+const (
+	jpegMarkerSOI  = 0xD8
+	jpegMarkerAPP1 = 0xE1
+	jpegMarkerAPP2 = 0xE2
+	jpegMarkerSOS  = 0xDA // Start of scan, the compressed image data follows
+	jpegMarkerEOI  = 0xD9
+)
+
+// jpegSegment is a marker segment of a JPEG file.
+type jpegSegment struct {
+	marker byte
+	data   []byte // Payload after the length field
+}
+
+// readJPEGSegments returns the marker segments of a JPEG file up to the start
+// of the image data. Reading stops at the first malformed segment.
+func readJPEGSegments(data []byte) []jpegSegment {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != jpegMarkerSOI {
+		return nil
+	}
+
+	var segments []jpegSegment
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			break
+		}
+		marker := data[i+1]
+		if marker == 0xFF { // Fill byte
+			i++
+			continue
+		}
+		if marker == jpegMarkerSOS || marker == jpegMarkerEOI {
+			break
+		}
+
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			break
+		}
+		segments = append(segments, jpegSegment{marker: marker, data: data[i+4 : i+2+size]})
+		i += 2 + size
+	}
+	return segments
+}
+
+// pngChunk is a chunk of a PNG file.
+type pngChunk struct {
+	id   string
+	data []byte
+}
+
+// readPNGChunks returns the chunks of a PNG file. Reading stops at the first
+// truncated chunk.
+func readPNGChunks(data []byte) []pngChunk {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil
+	}
+
+	var chunks []pngChunk
+	data = data[len(pngSignature):]
+	for len(data) >= 12 {
+		size := binary.BigEndian.Uint32(data)
+		if uint64(size) > uint64(len(data)-12) {
+			break
+		}
+		chunks = append(chunks, pngChunk{id: string(data[4:8]), data: data[8 : 8+size]})
+		data = data[12+size:]
+	}
+	return chunks
+}
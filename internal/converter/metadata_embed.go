@@ -0,0 +1,171 @@
+package converter
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/chai2010/webp"
+)
+
+// JPEG segments hold at most 65533 bytes after the marker and length.
+const jpegMaxSegment = 0xFFFF - 2
+
+// VP8X metadata flags.
+const (
+	webpFlagXMP  = 0x04
+	webpFlagEXIF = 0x08
+	webpFlagICC  = 0x20
+)
+
+// embedMetadata adds meta to data, an image freshly encoded as format, the way
+// that format stores metadata. Blocks too large for a JPEG segment are left
+// out, except for ICC profiles, which are split across several segments.
+func embedMetadata(data []byte, format string, meta *sourceMetadata) ([]byte, error) {
+	switch format {
+	case "jpg", "jpeg":
+		return embedJPEGMetadata(data, meta)
+	case "png":
+		return embedPNGMetadata(data, meta)
+	case "webp":
+		return embedWebPMetadata(data, meta)
+	}
+	return data, nil
+}
+
+// embedJPEGMetadata inserts APP1 segments for EXIF and XMP and APP2 segments
+// for the ICC profile right after the start of image marker.
+func embedJPEGMetadata(data []byte, meta *sourceMetadata) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != jpegMarkerSOI {
+		return nil, fmt.Errorf("not a jpeg file")
+	}
+
+	var segments []byte
+	if len(meta.exif) > 0 && len(exifHeader)+len(meta.exif) <= jpegMaxSegment {
+		segments = appendJPEGSegment(segments, jpegMarkerAPP1, exifHeader, meta.exif)
+	}
+	if len(meta.xmp) > 0 && len(xmpHeader)+len(meta.xmp) <= jpegMaxSegment {
+		segments = appendJPEGSegment(segments, jpegMarkerAPP1, xmpHeader, meta.xmp)
+	}
+	if len(meta.icc) > 0 {
+		// Each part is numbered, starting at 1, and carries the number of parts
+		partSize := jpegMaxSegment - len(iccHeader) - 2
+		parts := (len(meta.icc) + partSize - 1) / partSize
+		if parts > 255 {
+			return nil, fmt.Errorf("icc profile too large for jpeg")
+		}
+		for i := 0; i < parts; i++ {
+			part := meta.icc[i*partSize : min((i+1)*partSize, len(meta.icc))]
+			header := append(bytes.Clone(iccHeader), byte(i+1), byte(parts))
+			segments = appendJPEGSegment(segments, jpegMarkerAPP2, header, part)
+		}
+	}
+
+	out := make([]byte, 0, len(data)+len(segments))
+	out = append(out, data[:2]...)
+	out = append(out, segments...)
+	return append(out, data[2:]...), nil
+}
+
+// appendJPEGSegment appends a marker segment made of header and payload.
+func appendJPEGSegment(data []byte, marker byte, header, payload []byte) []byte {
+	data = append(data, 0xFF, marker)
+	data = binary.BigEndian.AppendUint16(data, uint16(2+len(header)+len(payload)))
+	data = append(data, header...)
+	return append(data, payload...)
+}
+
+// embedPNGMetadata inserts iCCP, eXIf and iTXt chunks right after the IHDR
+// chunk, ahead of the palette and image data as the PNG specification requires.
+func embedPNGMetadata(data []byte, meta *sourceMetadata) ([]byte, error) {
+	// Signature and the IHDR chunk with its 13 bytes of data
+	const ihdrEnd = 8 + 12 + 13
+	if len(data) < ihdrEnd || !bytes.HasPrefix(data, pngSignature) || string(data[12:16]) != "IHDR" {
+		return nil, fmt.Errorf("not a png file")
+	}
+
+	var chunks []byte
+	if len(meta.icc) > 0 {
+		var compressed bytes.Buffer
+		w := zlib.NewWriter(&compressed)
+		if _, err := w.Write(meta.icc); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		// Profile name and compression method 0 (zlib)
+		chunks = appendPNGChunk(chunks, "iCCP", append([]byte("ICC Profile\x00\x00"), compressed.Bytes()...))
+	}
+	if len(meta.exif) > 0 {
+		chunks = appendPNGChunk(chunks, "eXIf", meta.exif)
+	}
+	if len(meta.xmp) > 0 {
+		// Keyword, uncompressed, no language tag and no translated keyword
+		text := append([]byte(pngXMPKeyword+"\x00\x00\x00\x00\x00"), meta.xmp...)
+		chunks = appendPNGChunk(chunks, "iTXt", text)
+	}
+
+	out := make([]byte, 0, len(data)+len(chunks))
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, chunks...)
+	return append(out, data[ihdrEnd:]...), nil
+}
+
+// appendPNGChunk appends a chunk with its length and checksum.
+func appendPNGChunk(data []byte, id string, payload []byte) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(payload)))
+	start := len(data)
+	data = append(data, id...)
+	data = append(data, payload...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data[start:]))
+}
+
+// embedWebPMetadata adds ICCP, EXIF and XMP chunks to a WebP file. Simple
+// files are turned into the extended format, whose VP8X header announces the
+// metadata chunks.
+func embedWebPMetadata(data []byte, meta *sourceMetadata) ([]byte, error) {
+	chunks, err := readWebPChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("webp file has no chunks")
+	}
+
+	var header webpChunk
+	if chunks[0].id == "VP8X" {
+		header, chunks = chunks[0], chunks[1:]
+		header.data = bytes.Clone(header.data)
+	} else {
+		width, height, hasAlpha, err := webp.GetInfo(data)
+		if err != nil {
+			return nil, err
+		}
+		var flags byte
+		if hasAlpha {
+			flags |= webpFlagAlpha
+		}
+		header = webpChunk{id: "VP8X", data: vp8xData(flags, width, height)}
+	}
+
+	// The ICC profile precedes the image data, EXIF and XMP follow it
+	out := []webpChunk{header}
+	if len(meta.icc) > 0 {
+		header.data[0] |= webpFlagICC
+		out = append(out, webpChunk{id: "ICCP", data: meta.icc})
+	}
+	out = append(out, chunks...)
+	if len(meta.exif) > 0 {
+		header.data[0] |= webpFlagEXIF
+		out = append(out, webpChunk{id: "EXIF", data: meta.exif})
+	}
+	if len(meta.xmp) > 0 {
+		header.data[0] |= webpFlagXMP
+		out = append(out, webpChunk{id: "XMP ", data: meta.xmp})
+	}
+
+	return encodeWebPChunks(out)
+}
@@ -0,0 +1,57 @@
+package converter
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"os"
+	"time"
+)
+
+// OutputInfo describes the output of a source before it is converted, for
+// output names that depend on the image.
+type OutputInfo struct {
+	Width  int // Size of the output after orientation and resizing
+	Height int
+	// Date is when the photo was taken according to its EXIF data, or the
+	// modification time of the source if that is not recorded
+	Date time.Time
+}
+
+// OutputInfo reads the size and metadata of the image at path without
+// decoding its pixels and predicts the size of its output.
+func (ic *ImageConverter) OutputInfo(path string) (*OutputInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	config, format, err := image.DecodeConfig(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+	meta, err := readMetadata(path, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	// Orientations 5 to 8 turn the image by 90°
+	size := image.Pt(config.Width, config.Height)
+	if meta.orientation >= 5 {
+		size.X, size.Y = size.Y, size.X
+	}
+	_, size = ic.resizePlan(size, ic.options.Resize)
+
+	date := exifDate(meta.exif)
+	if date.IsZero() {
+		date = stat.ModTime()
+	}
+
+	return &OutputInfo{Width: size.X, Height: size.Y, Date: date}, nil
+}
@@ -0,0 +1,88 @@
+package converter
+
+import (
+	"image"
+)
+
+// orientImage applies an EXIF orientation to img, so that the pixels are
+// stored the way the image is meant to be displayed. Images with orientation
+// 1 or an unknown one are returned unchanged.
+//
+// Images with 8 or 16 bits per channel keep their pixel type, anything else,
+// such as the YCbCr images of the JPEG decoder, is converted to RGBA first.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	size := img.Bounds().Size()
+	rect := image.Rect(0, 0, size.X, size.Y)
+	if orientation >= 5 {
+		// Orientations 5 to 8 swap width and height
+		rect = image.Rect(0, 0, size.Y, size.X)
+	}
+
+	switch src := img.(type) {
+	case *image.NRGBA:
+		dst := image.NewNRGBA(rect)
+		transformPixels(dst.Pix, dst.Stride, src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.Stride, size, 4, orientation)
+		return dst
+	case *image.RGBA64:
+		dst := image.NewRGBA64(rect)
+		transformPixels(dst.Pix, dst.Stride, src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.Stride, size, 8, orientation)
+		return dst
+	case *image.NRGBA64:
+		dst := image.NewNRGBA64(rect)
+		transformPixels(dst.Pix, dst.Stride, src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.Stride, size, 8, orientation)
+		return dst
+	case *image.Gray:
+		dst := image.NewGray(rect)
+		transformPixels(dst.Pix, dst.Stride, src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.Stride, size, 1, orientation)
+		return dst
+	case *image.Gray16:
+		dst := image.NewGray16(rect)
+		transformPixels(dst.Pix, dst.Stride, src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.Stride, size, 2, orientation)
+		return dst
+	}
+
+	src := toRGBA(img)
+	dst := image.NewRGBA(rect)
+	transformPixels(dst.Pix, dst.Stride, src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.Stride, size, 4, orientation)
+	return dst
+}
+
+// transformPixels copies the pixels of a source of the given size into dst,
+// rotated and mirrored according to orientation. Both buffers start at their
+// top-left pixel and use bpp bytes per pixel.
+func transformPixels(dst []byte, dstStride int, src []byte, srcStride int, size image.Point, bpp, orientation int) {
+	w, h := size.X, size.Y
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	for dy := 0; dy < dh; dy++ {
+		row := dst[dy*dstStride:]
+		for dx := 0; dx < dw; dx++ {
+			// Find the source pixel shown at dx, dy
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				sx, sy = w-1-dx, dy
+			case 3: // Rotated by 180°
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // Mirrored vertically
+				sx, sy = dx, h-1-dy
+			case 5: // Transposed
+				sx, sy = dy, dx
+			case 6: // Rotated clockwise by 90°
+				sx, sy = dy, h-1-dx
+			case 7: // Transversed
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // Rotated counter-clockwise by 90°
+				sx, sy = w-1-dy, dx
+			}
+			copy(row[dx*bpp:dx*bpp+bpp], src[sy*srcStride+sx*bpp:])
+		}
+	}
+}
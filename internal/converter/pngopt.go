@@ -0,0 +1,511 @@
+package converter
+
+import (
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"slices"
+)
+
+// pngMaxPaletteColors is the number of colours a PNG palette holds.
+const pngMaxPaletteColors = 256
+
+// PNG colour types written to the IHDR chunk.
+const (
+	pngGray      = 0
+	pngRGB       = 2
+	pngPaletted  = 3
+	pngGrayAlpha = 4
+	pngRGBA      = 6
+)
+
+// pngFilterAdaptive is the filter strategy that picks the filter of every row
+// on its own. Strategies 0 to 4 apply the PNG filter of that type (None, Sub,
+// Up, Average, Paeth) to all rows.
+const pngFilterAdaptive = 5
+
+// pngSampleOffsets are the offsets of the samples a colour type stores within
+// a 16-bit RGBA pixel.
+var pngSampleOffsets = map[int][]int{
+	pngGray:      {0},
+	pngGrayAlpha: {0, 6},
+	pngRGB:       {0, 2, 4},
+	pngRGBA:      {0, 2, 4, 6},
+}
+
+// pngPixels are the pixels of an image as 16-bit non-premultiplied RGBA, with
+// the properties that decide how a PNG file can store them exactly.
+type pngPixels struct {
+	img    *image.NRGBA64
+	opaque bool
+	gray   bool
+	fits8  bool     // Every sample fits into 8 bits
+	colors []uint64 // Distinct colours, nil if there are more than fit a palette
+}
+
+// pngCandidate is a colour type and bit depth that stores pngPixels exactly.
+type pngCandidate struct {
+	colorType int
+	depth     int            // Bits per sample, or per palette index
+	palette   []uint64       // Colours of paletted candidates
+	index     map[uint64]int // Palette index of every colour
+}
+
+// encodeOptimizedPNG writes img as small a PNG file as it finds. Every colour
+// type and bit depth that stores the pixels exactly is tried with every row
+// filter strategy, ranked by a quick trial compression, and the best one is
+// compressed at the strongest zlib level. With quantize, images with more
+// colours than a palette holds are reduced to a dithered palette as well,
+// which is used if it compresses better than the exact pixels.
+//
+// Only the IHDR, PLTE, tRNS, IDAT and IEND chunks are written. Metadata is
+// added afterwards as the metadata policy asks.
+func encodeOptimizedPNG(w io.Writer, img image.Image, quantize bool) error {
+	pixels := readPNGPixels(img)
+	options := []*pngPixels{pixels}
+	if quantize && pixels.colors == nil {
+		options = append(options, readPNGPixels(quantizeImage(pixels.img, pngMaxPaletteColors)))
+	}
+
+	var (
+		best      pngCandidate
+		bestRows  []byte
+		bestTrial = math.MaxInt
+	)
+	for _, option := range options {
+		for _, candidate := range option.candidates() {
+			raw, stride, bpp := option.rawRows(candidate)
+			for strategy := 0; strategy <= pngFilterAdaptive; strategy++ {
+				rows := filterPNGRows(raw, stride, bpp, strategy)
+				trial, err := deflatePNGRows(rows, flate.BestSpeed)
+				if err != nil {
+					return err
+				}
+				if len(trial) < bestTrial {
+					best, bestRows, bestTrial = candidate, rows, len(trial)
+				}
+			}
+		}
+	}
+
+	idat, err := deflatePNGRows(bestRows, zlib.BestCompression)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buildPNG(pixels.img.Bounds().Size(), best, idat))
+	return err
+}
+
+// readPNGPixels converts img to 16-bit non-premultiplied RGBA and analyses it.
+// Images with 16-bit colour models keep all their precision. Other images are
+// rounded to 8 bits the way the standard PNG encoder rounds 8-bit RGBA images.
+// It writes YCbCr images such as decoded JPEGs with 16 bits per sample, but
+// their source holds no more precision than 8 bits.
+func readPNGPixels(img image.Image) *pngPixels {
+	deep := false
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model, color.Alpha16Model:
+		deep = true
+	}
+
+	bounds := img.Bounds()
+	rgba := image.NewNRGBA64(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var c color.NRGBA64
+			if deep {
+				c = color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			} else {
+				n := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				c = color.NRGBA64{R: uint16(n.R) * 0x101, G: uint16(n.G) * 0x101, B: uint16(n.B) * 0x101, A: uint16(n.A) * 0x101}
+			}
+			rgba.SetNRGBA64(x-bounds.Min.X, y-bounds.Min.Y, c)
+		}
+	}
+
+	pixels := &pngPixels{img: rgba, opaque: true, gray: true, fits8: true}
+	colors := make(map[uint64]struct{}, pngMaxPaletteColors+1)
+	for y := 0; y < bounds.Dy(); y++ {
+		row := rgba.Pix[y*rgba.Stride : y*rgba.Stride+bounds.Dx()*8]
+		for i := 0; i < len(row); i += 8 {
+			p := row[i : i+8]
+			r, g, b := binary.BigEndian.Uint16(p), binary.BigEndian.Uint16(p[2:]), binary.BigEndian.Uint16(p[4:])
+			pixels.opaque = pixels.opaque && binary.BigEndian.Uint16(p[6:]) == 0xffff
+			pixels.gray = pixels.gray && r == g && g == b
+			pixels.fits8 = pixels.fits8 && p[0] == p[1] && p[2] == p[3] && p[4] == p[5] && p[6] == p[7]
+			if colors != nil {
+				colors[binary.BigEndian.Uint64(p)] = struct{}{}
+				if len(colors) > pngMaxPaletteColors {
+					colors = nil
+				}
+			}
+		}
+	}
+
+	if colors != nil {
+		for c := range colors {
+			pixels.colors = append(pixels.colors, c)
+		}
+	}
+	return pixels
+}
+
+// candidates returns the colour types and bit depths that store the pixels
+// exactly: a palette if the colours fit one, and the smallest of grayscale or
+// truecolour, with alpha only if the image has transparency.
+func (p *pngPixels) candidates() []pngCandidate {
+	depth := 16
+	if p.fits8 {
+		depth = 8
+	}
+
+	colorType := pngRGB
+	if p.gray {
+		colorType = pngGray
+	}
+	if !p.opaque {
+		colorType += pngGrayAlpha // Gray+alpha is 4, RGBA is 6
+	}
+	candidates := []pngCandidate{{colorType: colorType, depth: depth}}
+
+	if p.colors != nil && p.fits8 {
+		// Transparent entries come first so that the tRNS chunk stays short
+		palette := slices.Clone(p.colors)
+		slices.SortFunc(palette, func(a, b uint64) int {
+			if opaqueA, opaqueB := a&0xffff == 0xffff, b&0xffff == 0xffff; opaqueA != opaqueB {
+				if opaqueB {
+					return -1
+				}
+				return 1
+			}
+			return cmp.Compare(a, b)
+		})
+		index := make(map[uint64]int, len(palette))
+		for i, c := range palette {
+			index[c] = i
+		}
+
+		depth := 8
+		switch {
+		case len(palette) <= 2:
+			depth = 1
+		case len(palette) <= 4:
+			depth = 2
+		case len(palette) <= 16:
+			depth = 4
+		}
+		candidates = append(candidates, pngCandidate{colorType: pngPaletted, depth: depth, palette: palette, index: index})
+	}
+	return candidates
+}
+
+// rawRows returns the unfiltered scanlines of the pixels as stored by
+// candidate, along with the length of a scanline and the number of bytes per
+// complete pixel that filters look back.
+func (p *pngPixels) rawRows(candidate pngCandidate) (raw []byte, stride, bpp int) {
+	width, height := p.img.Rect.Dx(), p.img.Rect.Dy()
+	offsets := pngSampleOffsets[candidate.colorType]
+	bitsPerPixel := candidate.depth
+	if candidate.colorType != pngPaletted {
+		bitsPerPixel *= len(offsets)
+	}
+	stride = (width*bitsPerPixel + 7) / 8
+	bpp = max(1, bitsPerPixel/8)
+
+	raw = make([]byte, stride*height)
+	for y := 0; y < height; y++ {
+		row := raw[y*stride : (y+1)*stride]
+		pix := p.img.Pix[y*p.img.Stride:]
+		i := 0
+		for x := 0; x < width; x++ {
+			px := pix[x*8 : x*8+8]
+			switch {
+			case candidate.colorType == pngPaletted:
+				bit := x * candidate.depth
+				row[bit/8] |= byte(candidate.index[binary.BigEndian.Uint64(px)] << (8 - candidate.depth - bit%8))
+			case candidate.depth == 8:
+				for _, offset := range offsets {
+					row[i] = px[offset]
+					i++
+				}
+			default:
+				for _, offset := range offsets {
+					row[i], row[i+1] = px[offset], px[offset+1]
+					i += 2
+				}
+			}
+		}
+	}
+	return raw, stride, bpp
+}
+
+// filterPNGRows prefixes every scanline of raw with its filter type and
+// filters it. The adaptive strategy picks the filter per row whose output has
+// the smallest sum of absolute values, the heuristic the PNG specification
+// suggests.
+func filterPNGRows(raw []byte, stride, bpp, strategy int) []byte {
+	height := len(raw) / stride
+	out := make([]byte, 0, (stride+1)*height)
+	prev := make([]byte, stride)
+	var scratch [pngFilterAdaptive][]byte
+	for y := 0; y < height; y++ {
+		row := raw[y*stride : (y+1)*stride]
+		if strategy != pngFilterAdaptive {
+			out = append(out, byte(strategy))
+			out = appendFilteredRow(out, row, prev, bpp, strategy)
+		} else {
+			best, bestSum := 0, math.MaxInt
+			for filter := range scratch {
+				scratch[filter] = appendFilteredRow(scratch[filter][:0], row, prev, bpp, filter)
+				sum := 0
+				for _, b := range scratch[filter] {
+					sum += abs(int(int8(b)))
+				}
+				if sum < bestSum {
+					best, bestSum = filter, sum
+				}
+			}
+			out = append(out, byte(best))
+			out = append(out, scratch[best]...)
+		}
+		prev = row
+	}
+	return out
+}
+
+// appendFilteredRow appends row filtered with the given PNG filter type. prev
+// is the unfiltered row above, all zero for the first row.
+func appendFilteredRow(out, row, prev []byte, bpp, filter int) []byte {
+	for i, x := range row {
+		var left, upLeft byte
+		if i >= bpp {
+			left, upLeft = row[i-bpp], prev[i-bpp]
+		}
+		up := prev[i]
+
+		switch filter {
+		case 1: // Sub
+			x -= left
+		case 2: // Up
+			x -= up
+		case 3: // Average
+			x -= byte((int(left) + int(up)) / 2)
+		case 4: // Paeth
+			x -= paeth(left, up, upLeft)
+		}
+		out = append(out, x)
+	}
+	return out
+}
+
+// paeth returns whichever of a (left), b (up) and c (upper left) is closest
+// to a+b-c.
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	default:
+		return c
+	}
+}
+
+// abs returns the absolute value of x.
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// deflatePNGRows compresses filtered scanlines into a zlib stream.
+func deflatePNGRows(rows []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(rows); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// buildPNG assembles a PNG file of the given size from the compressed image
+// data of candidate.
+func buildPNG(size image.Point, candidate pngCandidate, idat []byte) []byte {
+	data := slices.Clone(pngSignature)
+
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header, uint32(size.X))
+	binary.BigEndian.PutUint32(header[4:], uint32(size.Y))
+	header[8], header[9] = byte(candidate.depth), byte(candidate.colorType)
+	data = appendPNGChunk(data, "IHDR", header)
+
+	if candidate.colorType == pngPaletted {
+		var plte, trns []byte
+		for _, c := range candidate.palette {
+			plte = append(plte, byte(c>>56), byte(c>>40), byte(c>>24))
+			if alpha := byte(c >> 8); alpha != 0xff {
+				trns = append(trns, alpha)
+			}
+		}
+		data = appendPNGChunk(data, "PLTE", plte)
+		if len(trns) > 0 {
+			data = appendPNGChunk(data, "tRNS", trns)
+		}
+	}
+
+	// Chunk lengths are limited to 31 bits
+	for len(idat) > 0 {
+		n := min(len(idat), math.MaxInt32)
+		data = appendPNGChunk(data, "IDAT", idat[:n])
+		idat = idat[n:]
+	}
+	return appendPNGChunk(data, "IEND", nil)
+}
+
+// quantizeImage reduces img to a palette of at most size colours chosen by
+// median cut and maps it onto them with Floyd-Steinberg dithering.
+func quantizeImage(img image.Image, size int) *image.Paletted {
+	bounds := img.Bounds()
+	dst := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), medianCutPalette(img, size))
+	draw.FloydSteinberg.Draw(dst, dst.Bounds(), img, bounds.Min)
+	return dst
+}
+
+// weightedColor is a colour of the histogram medianCutPalette splits.
+type weightedColor struct {
+	rgba  [4]uint8 // Non-premultiplied
+	count int
+}
+
+// colorBox is a box of colours of the median cut.
+type colorBox struct {
+	colors  []weightedColor
+	pixels  int // Number of pixels of all colours
+	channel int // Channel whose values spread the most
+	spread  int
+}
+
+// newColorBox returns the box holding colors.
+func newColorBox(colors []weightedColor) colorBox {
+	box := colorBox{colors: colors}
+	for _, wc := range colors {
+		box.pixels += wc.count
+	}
+	for c := 0; c < 4; c++ {
+		low, high := 255, 0
+		for _, wc := range colors {
+			low, high = min(low, int(wc.rgba[c])), max(high, int(wc.rgba[c]))
+		}
+		if high-low > box.spread {
+			box.channel, box.spread = c, high-low
+		}
+	}
+	return box
+}
+
+// medianCutPalette returns at most size colours that represent img. The
+// colour box that spans the widest channel range, weighted by the number of
+// pixels in it, is split at the median of that channel until there are size
+// boxes. Every box contributes the average of its pixels. Fully transparent
+// pixels count as one colour whatever their RGB values.
+func medianCutPalette(img image.Image, size int) color.Palette {
+	histogram := make(map[[4]uint8]int)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				c = color.NRGBA{}
+			}
+			histogram[[4]uint8{c.R, c.G, c.B, c.A}]++
+		}
+	}
+
+	colors := make([]weightedColor, 0, len(histogram))
+	for rgba, count := range histogram {
+		colors = append(colors, weightedColor{rgba: rgba, count: count})
+	}
+	// Sort so the palette does not depend on the map order
+	slices.SortFunc(colors, func(a, b weightedColor) int {
+		return slices.Compare(a.rgba[:], b.rgba[:])
+	})
+
+	boxes := []colorBox{newColorBox(colors)}
+	for len(boxes) < size {
+		split, bestScore := -1, 0
+		for i, box := range boxes {
+			if score := box.spread * box.pixels; len(box.colors) > 1 && score > bestScore {
+				split, bestScore = i, score
+			}
+		}
+		if split < 0 {
+			break // Every box holds a single colour
+		}
+
+		box := boxes[split]
+		sortByChannel(box.colors, box.channel)
+		median, seen := 1, 0
+		for i, wc := range box.colors[:len(box.colors)-1] {
+			seen += wc.count
+			if seen*2 >= box.pixels {
+				median = i + 1
+				break
+			}
+		}
+		boxes[split] = newColorBox(box.colors[:median])
+		boxes = append(boxes, newColorBox(box.colors[median:]))
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		var sum [4]int
+		for _, wc := range box.colors {
+			for i, v := range wc.rgba {
+				sum[i] += int(v) * wc.count
+			}
+		}
+		half := box.pixels / 2
+		palette = append(palette, color.NRGBA{
+			R: uint8((sum[0] + half) / box.pixels),
+			G: uint8((sum[1] + half) / box.pixels),
+			B: uint8((sum[2] + half) / box.pixels),
+			A: uint8((sum[3] + half) / box.pixels),
+		})
+	}
+	return palette
+}
+
+// sortByChannel sorts colors by the value of channel with a stable counting
+// sort, which is much faster than comparison sorts on large boxes.
+func sortByChannel(colors []weightedColor, channel int) {
+	var starts [257]int
+	for _, wc := range colors {
+		starts[int(wc.rgba[channel])+1]++
+	}
+	for i := 1; i < len(starts); i++ {
+		starts[i] += starts[i-1]
+	}
+
+	sorted := make([]weightedColor, len(colors))
+	for _, wc := range colors {
+		sorted[starts[wc.rgba[channel]]] = wc
+		starts[wc.rgba[channel]]++
+	}
+	copy(colors, sorted)
+}
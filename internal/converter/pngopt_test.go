@@ -0,0 +1,201 @@
+package converter
+
+import (
+	"bytes"
+	"compress/flate"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+// pngTestPalette returns an image of size x size pixels that uses n distinct
+// colours, none of them gray.
+func pngTestPalette(n, size int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			i := (x*7 + y*3) % n
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(i), G: uint8(255 - i), B: uint8(i * 3), A: 255})
+		}
+	}
+	return img
+}
+
+// pngTestNoise returns an image with random colours, far more than a palette holds.
+func pngTestNoise(size int) image.Image {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.Intn(256))
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	return img
+}
+
+func TestEncodeOptimizedPNG(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 33, 17))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 5)
+	}
+
+	grayAlpha := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			grayAlpha.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 12), G: uint8(x * 12), B: uint8(x * 12), A: uint8(y * 13)})
+		}
+	}
+
+	deep := image.NewNRGBA64(image.Rect(0, 0, 24, 24))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 24; x++ {
+			deep.SetNRGBA64(x, y, color.NRGBA64{R: uint16(x * 2731), G: uint16(y * 2729), B: uint16(x*y + 1), A: 0xffff - uint16(x*97)})
+		}
+	}
+
+	gray16 := image.NewGray16(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			gray16.SetGray16(x, y, color.Gray16{Y: uint16(y*4096 + x*3)})
+		}
+	}
+
+	offset := image.NewNRGBA(image.Rect(-5, 7, 18, 30))
+	for y := offset.Rect.Min.Y; y < offset.Rect.Max.Y; y++ {
+		for x := offset.Rect.Min.X; x < offset.Rect.Max.X; x++ {
+			offset.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 9), G: uint8(y * 5), B: 40, A: 255})
+		}
+	}
+	sub := pngTestNoise(40).(*image.NRGBA).SubImage(image.Rect(11, 13, 29, 31))
+
+	tests := []struct {
+		name         string
+		img          image.Image
+		paletteDepth int  // Bit depth of the palette candidate, 0 if the colours do not fit one
+		manyColors   bool // More colours than a palette holds
+	}{
+		{"palette 1-bit", pngTestPalette(2, 19), 1, false},
+		{"palette 2-bit", pngTestPalette(4, 19), 2, false},
+		{"palette 4-bit", pngTestPalette(16, 19), 4, false},
+		{"palette 8-bit", pngTestPalette(256, 40), 8, false},
+		{"gray", gray, 8, false},
+		{"gray alpha", grayAlpha, 0, true},
+		{"16-bit rgba", deep, 0, true},
+		{"16-bit gray", gray16, 0, false},
+		{"non-zero origin", offset, 0, true},
+		{"sub image", sub, 0, true},
+		{"noise", pngTestNoise(48), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every colour type and bit depth offered must store the pixels exactly
+			pixels := readPNGPixels(tt.img)
+			paletteDepth := 0
+			for _, candidate := range pixels.candidates() {
+				if candidate.colorType == pngPaletted {
+					paletteDepth = candidate.depth
+				}
+				raw, stride, bpp := pixels.rawRows(candidate)
+				idat, err := deflatePNGRows(filterPNGRows(raw, stride, bpp, pngFilterAdaptive), flate.BestSpeed)
+				if err != nil {
+					t.Fatalf("deflate: %v", err)
+				}
+				data := buildPNG(pixels.img.Bounds().Size(), candidate, idat)
+				decoded, err := png.Decode(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("colour type %d at %d bits: decode: %v", candidate.colorType, candidate.depth, err)
+				}
+				if !pngSamePixels(tt.img, decoded) {
+					t.Errorf("colour type %d at %d bits: pixels differ from the source", candidate.colorType, candidate.depth)
+				}
+			}
+			if paletteDepth != tt.paletteDepth {
+				t.Errorf("palette of %d bits, want %d", paletteDepth, tt.paletteDepth)
+			}
+
+			for _, quantize := range []bool{false, true} {
+				var buf bytes.Buffer
+				if err := encodeOptimizedPNG(&buf, tt.img, quantize); err != nil {
+					t.Fatalf("quantize=%t: encode: %v", quantize, err)
+				}
+				decoded, err := png.Decode(bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatalf("quantize=%t: decode: %v", quantize, err)
+				}
+				if got, want := decoded.Bounds().Size(), tt.img.Bounds().Size(); got != want {
+					t.Fatalf("quantize=%t: size %v, want %v", quantize, got, want)
+				}
+
+				// Only images with more colours than a palette may lose any
+				exact := pngSamePixels(tt.img, decoded)
+				switch {
+				case !exact && (!quantize || !tt.manyColors):
+					t.Errorf("quantize=%t: pixels differ from the source", quantize)
+				case !exact && pngColorCount(decoded) > pngMaxPaletteColors:
+					t.Errorf("quantize=%t: %d colours after quantisation", quantize, pngColorCount(decoded))
+				}
+			}
+		})
+	}
+}
+
+// TestEncodeOptimizedPNGQuantizes checks that lossy optimisation reduces a
+// photo-like image to a palette.
+func TestEncodeOptimizedPNGQuantizes(t *testing.T) {
+	img := pngTestNoise(64)
+	var buf bytes.Buffer
+	if err := encodeOptimizedPNG(&buf, img, true); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if pngSamePixels(img, decoded) {
+		t.Errorf("pixels were not quantised")
+	}
+	if _, ok := decoded.(*image.Paletted); !ok {
+		t.Errorf("decoded %T, want a paletted image", decoded)
+	}
+}
+
+// pngSamePixels reports whether decoded holds exactly the pixels of src, at
+// 16 bits for 16-bit colour models and at 8 bits for all others.
+func pngSamePixels(src, decoded image.Image) bool {
+	deep := false
+	switch src.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model, color.Alpha16Model:
+		deep = true
+	}
+
+	bounds := src.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			want, got := src.At(x, y), decoded.At(x-bounds.Min.X, y-bounds.Min.Y)
+			if deep {
+				if color.NRGBA64Model.Convert(want) != color.NRGBA64Model.Convert(got) {
+					return false
+				}
+			} else if color.NRGBAModel.Convert(want) != color.NRGBAModel.Convert(got) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pngColorCount returns the number of distinct colours of img.
+func pngColorCount(img image.Image) int {
+	colors := map[color.NRGBA64]bool{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			colors[color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)] = true
+		}
+	}
+	return len(colors)
+}
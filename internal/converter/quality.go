@@ -0,0 +1,165 @@
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/chai2010/webp"
+)
+
+// Bounds of the quality search.
+const (
+	minSearchQuality = 1
+	maxSearchQuality = 100
+)
+
+// searchSimilaritySize is the longest side images are compared at while
+// searching for a similarity target. Compression artefacts vanish when images
+// are scaled down as far as for verification, so a larger size is used.
+const searchSimilaritySize = 2048
+
+// sizeUnits maps the accepted suffixes of target sizes to their factor. Like
+// the sizes in the report, kilo and mega are binary.
+var sizeUnits = []struct {
+	suffix string
+	factor float64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"kb", 1 << 10}, {"mb", 1 << 20},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"b", 1},
+}
+
+// ParseTargetSize parses a file size such as "200KB", "1.5MB" or "50000"
+// (bytes) and returns it in bytes.
+func ParseTargetSize(size string) (int64, error) {
+	number := strings.ToLower(strings.TrimSpace(size))
+	factor := 1.0
+	for _, unit := range sizeUnits {
+		if trimmed, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, factor = strings.TrimSpace(trimmed), unit.factor
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value*factor < 1 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 200KB, 1.5MB or a number of bytes)", size)
+	}
+	return int64(value * factor), nil
+}
+
+// qualitySearch is the outcome of the search for the quality of an output.
+type qualitySearch struct {
+	quality int
+	encoded []byte // Image encoded at quality, with its metadata
+	missed  bool   // No quality met the target, quality is the closest one
+}
+
+// searchesQuality reports whether the quality of an output of format is
+// searched for a target. Only lossy formats have a quality to choose.
+func (ic *ImageConverter) searchesQuality(format string, img image.Image, srcFormat string) bool {
+	if ic.options.TargetSize <= 0 && ic.options.TargetSimilarity <= 0 {
+		return false
+	}
+	switch strings.ToLower(format) {
+	case "jpg", "jpeg":
+		return true
+	case "webp":
+		return !ic.webpLossless(img, srcFormat)
+	default:
+		return false
+	}
+}
+
+// searchQuality binary-searches the quality img is encoded at. With a target
+// size it finds the highest quality whose output fits, with a target
+// similarity the lowest quality whose output reaches it. Larger qualities are
+// assumed to give larger and more similar outputs. srcFormat is the format
+// img was decoded from. Every candidate carries meta, so a target size counts
+// the embedded metadata as well.
+func (ic *ImageConverter) searchQuality(img image.Image, format, srcFormat string, meta *sourceMetadata) (*qualitySearch, error) {
+	format = strings.ToLower(format)
+	var reference plane
+	if ic.options.TargetSimilarity > 0 {
+		reference = lumaPlane(img, searchSimilaritySize)
+	}
+
+	// meets encodes img at quality and checks the result against the target
+	meets := func(quality int) ([]byte, bool, error) {
+		var buf bytes.Buffer
+		err := withMetadata(&buf, format, meta, func(w io.Writer) error {
+			return ic.encodeLossy(w, img, format, srcFormat, quality)
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		if ic.options.TargetSize > 0 {
+			return buf.Bytes(), int64(buf.Len()) <= ic.options.TargetSize, nil
+		}
+
+		decoded, err := decodeLossy(buf.Bytes(), format)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decode quality %d: %w", quality, err)
+		}
+		score := ssim(reference, lumaPlane(decoded, searchSimilaritySize))
+		return buf.Bytes(), score >= ic.options.TargetSimilarity, nil
+	}
+
+	// A size target is met by low qualities, a similarity target by high ones
+	bySize := ic.options.TargetSize > 0
+	var best *qualitySearch
+	low, high := minSearchQuality, maxSearchQuality
+	for low <= high {
+		mid := (low + high) / 2
+		encoded, ok, err := meets(mid)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			best = &qualitySearch{quality: mid, encoded: encoded}
+		}
+		if ok == bySize {
+			low = mid + 1
+		} else {
+			high = mid - 1
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+
+	// Nothing met the target, the closest is the smallest or the best output
+	closest := maxSearchQuality
+	if bySize {
+		closest = minSearchQuality
+	}
+	encoded, _, err := meets(closest)
+	if err != nil {
+		return nil, err
+	}
+	return &qualitySearch{quality: closest, encoded: encoded, missed: true}, nil
+}
+
+// encodeLossy encodes img, decoded from srcFormat, as JPEG or lossy WebP at
+// the given quality.
+func (ic *ImageConverter) encodeLossy(w io.Writer, img image.Image, format, srcFormat string, quality int) error {
+	if format == "webp" {
+		return webp.Encode(w, img, &webp.Options{
+			Quality: float32(quality),
+			Exact:   ic.options.Encoders.WebP.Exact,
+		})
+	}
+	return ic.encodeJPEG(w, img, quality, srcFormat)
+}
+
+// decodeLossy decodes an image written by encodeLossy.
+func decodeLossy(data []byte, format string) (image.Image, error) {
+	if format == "webp" {
+		return webp.Decode(bytes.NewReader(data))
+	}
+	return jpeg.Decode(bytes.NewReader(data))
+}
@@ -0,0 +1,214 @@
+package converter
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// Resize modes of ResizeSpec.
+const (
+	// ResizeExact scales to exactly Width x Height, ignoring the aspect ratio.
+	ResizeExact = "exact"
+	// ResizeFit scales to the largest size that fits into Width x Height.
+	ResizeFit = "fit"
+	// ResizeFill scales to the smallest size that covers Width x Height and
+	// crops the overhang evenly from both sides.
+	ResizeFill = "fill"
+	// ResizePercent scales both sides by Percent.
+	ResizePercent = "percent"
+	// ResizeWidth scales to Width, keeping the aspect ratio.
+	ResizeWidth = "width"
+)
+
+// Resampling filters.
+const (
+	FilterNearest  = "nearest"
+	FilterBilinear = "bilinear"
+	FilterBicubic  = "bicubic"
+	FilterLanczos  = "lanczos"
+)
+
+// Filters lists the accepted resampling filters.
+var Filters = []string{FilterNearest, FilterBilinear, FilterBicubic, FilterLanczos}
+
+// ResizeSpec describes how images are resized before MaxDimension applies.
+// The zero value keeps the size of the source.
+type ResizeSpec struct {
+	Mode    string  `json:"mode,omitempty"`
+	Width   int     `json:"width,omitempty"`
+	Height  int     `json:"height,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+}
+
+// ParseResizeSpec parses a resize specification given as "exact:WxH",
+// "fit:WxH", "fill:WxH", "width:W" or "N%". An empty spec keeps the size of
+// the source.
+func ParseResizeSpec(spec string) (ResizeSpec, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if spec == "" {
+		return ResizeSpec{}, nil
+	}
+
+	if percent, ok := strings.CutSuffix(spec, "%"); ok {
+		value, err := strconv.ParseFloat(percent, 64)
+		if err != nil || value <= 0 || value > 1000 {
+			return ResizeSpec{}, fmt.Errorf("invalid percentage %q (between 0 and 1000)", spec)
+		}
+		return ResizeSpec{Mode: ResizePercent, Percent: value}, nil
+	}
+
+	mode, box, ok := strings.Cut(spec, ":")
+	if ok && mode == ResizeWidth {
+		width, err := strconv.Atoi(box)
+		if err != nil || width < 1 {
+			return ResizeSpec{}, fmt.Errorf("invalid width %q in resize %q (pixels)", box, spec)
+		}
+		return ResizeSpec{Mode: ResizeWidth, Width: width}, nil
+	}
+	if !ok || (mode != ResizeExact && mode != ResizeFit && mode != ResizeFill) {
+		return ResizeSpec{}, fmt.Errorf("invalid resize %q (exact:WxH, fit:WxH, fill:WxH, width:W or N%%)", spec)
+	}
+	w, h, ok := strings.Cut(box, "x")
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if !ok || errW != nil || errH != nil || width < 1 || height < 1 {
+		return ResizeSpec{}, fmt.Errorf("invalid size %q in resize %q (WxH in pixels)", box, spec)
+	}
+	return ResizeSpec{Mode: mode, Width: width, Height: height}, nil
+}
+
+// String returns the spec in the form ParseResizeSpec accepts.
+func (s ResizeSpec) String() string {
+	switch s.Mode {
+	case "":
+		return ""
+	case ResizePercent:
+		return strconv.FormatFloat(s.Percent, 'f', -1, 64) + "%"
+	case ResizeWidth:
+		return fmt.Sprintf("%s:%d", s.Mode, s.Width)
+	default:
+		return fmt.Sprintf("%s:%dx%d", s.Mode, s.Width, s.Height)
+	}
+}
+
+// filterName returns the configured filter, or lanczos for sessions saved
+// before the filter could be chosen.
+func filterName(name string) string {
+	if name == "" {
+		return FilterLanczos
+	}
+	return name
+}
+
+// interpolation maps a filter name to the resampling function.
+func interpolation(name string) resize.InterpolationFunction {
+	switch filterName(name) {
+	case FilterNearest:
+		return resize.NearestNeighbor
+	case FilterBilinear:
+		return resize.Bilinear
+	case FilterBicubic:
+		return resize.Bicubic
+	default:
+		return resize.Lanczos3
+	}
+}
+
+// resizePlan computes the size a source of the given size is scaled to by
+// spec and the size it is cropped to afterwards, which is the output size.
+// The resize mode applies first, then MaxDimension scales the result down if
+// needed. With NoUpscale no side grows beyond the source.
+func (ic *ImageConverter) resizePlan(size image.Point, spec ResizeSpec) (scaled, cropped image.Point) {
+	w, h := float64(size.X), float64(size.Y)
+	scaleX, scaleY := 1.0, 1.0
+	cropW, cropH := w, h
+
+	switch spec.Mode {
+	case ResizeExact:
+		scaleX, scaleY = float64(spec.Width)/w, float64(spec.Height)/h
+		if ic.options.NoUpscale {
+			scaleX, scaleY = min(scaleX, 1), min(scaleY, 1)
+		}
+	case ResizeFit:
+		scaleX = min(float64(spec.Width)/w, float64(spec.Height)/h)
+		if ic.options.NoUpscale {
+			scaleX = min(scaleX, 1)
+		}
+		scaleY = scaleX
+	case ResizeFill:
+		scaleX = max(float64(spec.Width)/w, float64(spec.Height)/h)
+		if ic.options.NoUpscale {
+			scaleX = min(scaleX, 1)
+		}
+		scaleY = scaleX
+		// A source too small to cover the box is cropped to the part that fits
+		cropW, cropH = min(float64(spec.Width), w*scaleX), min(float64(spec.Height), h*scaleY)
+	case ResizePercent, ResizeWidth:
+		scaleX = spec.Percent / 100
+		if spec.Mode == ResizeWidth {
+			scaleX = float64(spec.Width) / w
+		}
+		if ic.options.NoUpscale {
+			scaleX = min(scaleX, 1)
+		}
+		scaleY = scaleX
+	}
+	if spec.Mode != ResizeFill {
+		cropW, cropH = w*scaleX, h*scaleY
+	}
+
+	// MaxDimension limits the output, so the crop box decides how far to shrink
+	if maxDim := float64(ic.options.MaxDimension); maxDim > 0 && max(cropW, cropH) > maxDim {
+		factor := maxDim / max(cropW, cropH)
+		scaleX, scaleY = scaleX*factor, scaleY*factor
+		cropW, cropH = cropW*factor, cropH*factor
+	}
+
+	scaled = image.Pt(roundSide(w*scaleX), roundSide(h*scaleY))
+	cropped = image.Pt(min(roundSide(cropW), scaled.X), min(roundSide(cropH), scaled.Y))
+	return scaled, cropped
+}
+
+// roundSide rounds a scaled side length to whole pixels, keeping at least one.
+func roundSide(v float64) int {
+	return max(int(math.Round(v)), 1)
+}
+
+// resizeImage applies spec and MaxDimension to img with the configured
+// filter. Images that keep their size are returned unchanged.
+func (ic *ImageConverter) resizeImage(img image.Image, spec ResizeSpec) image.Image {
+	size := img.Bounds().Size()
+	scaled, cropped := ic.resizePlan(size, spec)
+
+	if scaled != size {
+		img = resize.Resize(uint(scaled.X), uint(scaled.Y), img, interpolation(ic.options.Filter))
+	}
+	if cropped != scaled {
+		img = cropCenter(img, cropped)
+	}
+	return img
+}
+
+// cropCenter cuts a region of the given size from the middle of img. The
+// result starts at the origin like every decoded image.
+func cropCenter(img image.Image, size image.Point) image.Image {
+	bounds := img.Bounds()
+	offset := bounds.Min.Add(bounds.Size().Sub(size).Div(2))
+	rect := image.Rectangle{Max: size}
+
+	var dst draw.Image
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		dst = image.NewRGBA64(rect)
+	default:
+		dst = image.NewRGBA(rect)
+	}
+	draw.Draw(dst, rect, img, offset, draw.Src)
+	return dst
+}
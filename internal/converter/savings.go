@@ -0,0 +1,72 @@
+package converter
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ParseMinSavings parses the minimum savings of --only-if-smaller, a
+// percentage from 0 (any reduction) to below 100, e.g. "10" or "10%".
+func ParseMinSavings(savings string) (float64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(savings), "%"), 64)
+	if err != nil || value < 0 || value >= 100 {
+		return 0, fmt.Errorf("invalid minimum savings %q (percentage from 0 to below 100)", savings)
+	}
+	return value, nil
+}
+
+// notBeneficialError reports an output that does not save enough space to
+// replace its source. The output is discarded before it replaces anything.
+type notBeneficialError struct {
+	size       int64 // Size of the discarded output
+	sourceSize int64
+}
+
+// Error implements the error interface.
+func (e *notBeneficialError) Error() string {
+	return fmt.Sprintf("output of %d bytes does not save enough over the source of %d bytes", e.size, e.sourceSize)
+}
+
+// beneficial reports whether an output of size saves enough space over its
+// source: it must be smaller, and by at least MinSavings percent.
+func (ic *ImageConverter) beneficial(size, sourceSize int64) bool {
+	if size >= sourceSize {
+		return false
+	}
+	savings := 100 * float64(sourceSize-size) / float64(sourceSize)
+	return savings >= ic.options.MinSavings
+}
+
+// onlyIfSmaller wraps write, which encodes an output, so that with
+// OnlyIfSmaller an output that is not beneficial fails with a
+// *notBeneficialError once it is complete.
+func (ic *ImageConverter) onlyIfSmaller(sourceSize int64, write func(w io.Writer) error) func(w io.Writer) error {
+	if !ic.options.OnlyIfSmaller {
+		return write
+	}
+	return func(w io.Writer) error {
+		counter := &countingWriter{w: w}
+		if err := write(counter); err != nil {
+			return err
+		}
+		if !ic.beneficial(counter.n, sourceSize) {
+			return &notBeneficialError{size: counter.n, sourceSize: sourceSize}
+		}
+		return nil
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write implements io.Writer.
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
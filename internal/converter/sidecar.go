@@ -0,0 +1,51 @@
+package converter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// SidecarSuffix is appended to an output path to name its provenance sidecar.
+const SidecarSuffix = ".gopix.json"
+
+// Sidecar is the provenance record written next to an output. The hashes are
+// hex encoded SHA-256 digests of the file contents, so tools can prove which
+// source produced which output even after files were moved or renamed.
+type Sidecar struct {
+	SourcePath   string    `json:"source_path"`
+	SourceSHA256 string    `json:"source_sha256"`
+	OutputPath   string    `json:"output_path"`
+	OutputSHA256 string    `json:"output_sha256"`
+	Format       string    `json:"format"`
+	Settings     string    `json:"settings"`
+	Created      time.Time `json:"created"`
+}
+
+// writeSidecar atomically writes the provenance sidecar of an output that was
+// written with the given conversion settings.
+func (ic *ImageConverter) writeSidecar(sourcePath, sourceHash, outputPath, outputHash, format, settings string) error {
+	sidecar := Sidecar{
+		SourcePath:   absPath(sourcePath),
+		SourceSHA256: sourceHash,
+		OutputPath:   absPath(outputPath),
+		OutputSHA256: outputHash,
+		Format:       format,
+		Settings:     settings,
+		Created:      time.Now(),
+	}
+
+	data, err := json.MarshalIndent(&sidecar, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal sidecar: %w", err)
+	}
+
+	if err := ic.writeFileAtomic(outputPath+SidecarSuffix, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to write sidecar: %w", err)
+	}
+	return nil
+}
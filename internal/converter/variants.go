@@ -0,0 +1,136 @@
+package converter
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultVariantTemplate names variant outputs after the source, the variant
+// and the format, e.g. "photo-640.webp".
+const DefaultVariantTemplate = "{name}-{variant}.{format}"
+
+// Variant is one rendition of a source, such as a 640 pixels wide WebP of a
+// responsive image set. All variants of a source are written from a single
+// decode. The Resize of a variant replaces the Resize option, MaxDimension,
+// Filter and NoUpscale still apply.
+type Variant struct {
+	Name   string     `json:"name"` // Label used in file names, e.g. "640"
+	Format string     `json:"format"`
+	Resize ResizeSpec `json:"resize"`
+}
+
+// label identifies the variant in results and statistics, e.g. "640 webp".
+// It is empty for the single output of a conversion without variants.
+func (v Variant) label() string {
+	if v.Name == "" {
+		return ""
+	}
+	return v.Name + " " + v.Format
+}
+
+// VariantOutput is a variant together with the path it is written to.
+type VariantOutput struct {
+	Variant
+	Path string
+}
+
+// ParseVariants builds the variants for every combination of the given sizes
+// and formats. sizes is a comma separated list of widths in pixels or resize
+// specifications (see ParseResizeSpec), optionally named as "name=spec", for
+// example "320,640,thumb=fill:128x128".
+func ParseVariants(sizes string, formats []string) ([]Variant, error) {
+	var variants []Variant
+	seen := make(map[string]bool)
+
+	for _, size := range strings.Split(sizes, ",") {
+		size = strings.TrimSpace(size)
+		if size == "" {
+			continue
+		}
+
+		name, spec, named := strings.Cut(size, "=")
+		if !named {
+			spec = size
+			// "640:480" would not survive as a file name, "fill-640x480" does
+			name = strings.NewReplacer(":", "-", "%", "pct").Replace(size)
+		}
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("invalid variant name %q", name)
+		}
+
+		// A bare number is a width, the usual unit of responsive images
+		if strings.Trim(spec, "0123456789") == "" {
+			spec = ResizeWidth + ":" + spec
+		}
+		resize, err := ParseResizeSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if resize.Mode == "" {
+			return nil, fmt.Errorf("variant %q has no size", name)
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate variant %q", name)
+		}
+		seen[name] = true
+
+		for _, format := range formats {
+			variants = append(variants, Variant{Name: name, Format: strings.ToLower(format), Resize: resize})
+		}
+	}
+
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("no variant sizes given")
+	}
+	return variants, nil
+}
+
+// ValidateVariantTemplate checks that template yields a distinct file name for
+// every variant: it must name the variant if there are several sizes and the
+// format if there are several formats.
+func ValidateVariantTemplate(template string, variants []Variant) error {
+	if strings.ContainsAny(template, `/\`) {
+		return fmt.Errorf("variant name template %q must be a file name without directories", template)
+	}
+
+	names := make(map[string]bool)
+	formats := make(map[string]bool)
+	for _, v := range variants {
+		names[v.Name] = true
+		formats[v.Format] = true
+	}
+	if len(names) > 1 && !strings.Contains(template, "{variant}") {
+		return fmt.Errorf("variant name template %q must contain {variant}", template)
+	}
+	if len(formats) > 1 && !strings.Contains(template, "{format}") {
+		return fmt.Errorf("variant name template %q must contain {format}", template)
+	}
+	return nil
+}
+
+// VariantOutputs returns the configured variants of the source whose single
+// output would be written to outputPath. They are placed next to that output
+// and named by the variant template, where {name} is its file name without
+// the extension. It returns nil if no variants are configured.
+func (ic *ImageConverter) VariantOutputs(outputPath string) []VariantOutput {
+	if len(ic.options.Variants) == 0 {
+		return nil
+	}
+
+	template := ic.options.VariantTemplate
+	if template == "" {
+		template = DefaultVariantTemplate
+	}
+
+	dir, base := filepath.Split(outputPath)
+	name := strings.TrimSuffix(base, filepath.Ext(base))
+
+	outputs := make([]VariantOutput, 0, len(ic.options.Variants))
+	for _, v := range ic.options.Variants {
+		file := strings.NewReplacer("{name}", name, "{variant}", v.Name, "{format}", v.Format).Replace(template)
+		outputs = append(outputs, VariantOutput{Variant: v, Path: filepath.Join(dir, file)})
+	}
+	return outputs
+}
@@ -0,0 +1,187 @@
+package converter
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"math"
+	"os"
+
+	"github.com/nfnt/resize"
+)
+
+// Verification failure reasons reported by VerificationError.
+const (
+	VerifyReasonDecode     = "unreadable output"
+	VerifyReasonDimensions = "dimension mismatch"
+	VerifyReasonFrames     = "frame count mismatch"
+	VerifyReasonSimilarity = "low similarity"
+)
+
+// similaritySize is the longest side both images are scaled to before the
+// similarity score is computed. It keeps the check fast on large photos while
+// still catching visible damage such as shifted or missing regions.
+const similaritySize = 512
+
+// VerificationError is returned when a converted output does not pass the
+// checks that run before the original is deleted. The original is kept.
+type VerificationError struct {
+	Reason string // One of the VerifyReason constants
+	Detail string
+}
+
+// Error implements the error interface.
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("output verification failed (%s): %s, original kept", e.Reason, e.Detail)
+}
+
+// verifyOutput re-decodes the output at path and compares it against the
+// image that was handed to the encoder. The reference is already resized, so
+// its bounds are exactly the dimensions the output must have.
+// Animated outputs must hold the given number of frames and are compared by
+// their first frame. If MinSimilarity is set, the structural similarity of
+// both images must reach it as well.
+func (ic *ImageConverter) verifyOutput(path string, reference image.Image, frames int) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return &VerificationError{Reason: VerifyReasonDecode, Detail: err.Error()}
+	}
+	defer file.Close()
+
+	bufferedReader := bufio.NewReaderSize(file, 64*1024)
+	anim, err := decodeAnimation(bufferedReader)
+	if err != nil {
+		return &VerificationError{Reason: VerifyReasonDecode, Detail: err.Error()}
+	}
+
+	var output image.Image
+	outputFrames := 1
+	if anim != nil {
+		output, outputFrames = anim.frames[0], len(anim.frames)
+	} else {
+		output, _, err = image.Decode(bufferedReader)
+		if err != nil {
+			return &VerificationError{Reason: VerifyReasonDecode, Detail: err.Error()}
+		}
+	}
+
+	if outputFrames != frames {
+		return &VerificationError{
+			Reason: VerifyReasonFrames,
+			Detail: fmt.Sprintf("got %d, expected %d", outputFrames, frames),
+		}
+	}
+
+	want, got := reference.Bounds().Size(), output.Bounds().Size()
+	if want != got {
+		return &VerificationError{
+			Reason: VerifyReasonDimensions,
+			Detail: fmt.Sprintf("got %dx%d, expected %dx%d", got.X, got.Y, want.X, want.Y),
+		}
+	}
+
+	if ic.options.MinSimilarity > 0 {
+		score := Similarity(reference, output)
+		if score < ic.options.MinSimilarity {
+			return &VerificationError{
+				Reason: VerifyReasonSimilarity,
+				Detail: fmt.Sprintf("score %.3f below %.3f", score, ic.options.MinSimilarity),
+			}
+		}
+	}
+
+	return nil
+}
+
+// Similarity returns the structural similarity (SSIM) of the luma channels of
+// two images of the same size, between 0 (unrelated) and 1 (identical).
+//
+// Both images are scaled down to at most similaritySize pixels on the longest
+// side and compared in non-overlapping 8x8 windows, which is a good enough
+// perceptual approximation to tell a faithful conversion from a broken one.
+func Similarity(a, b image.Image) float64 {
+	return ssim(lumaPlane(a, similaritySize), lumaPlane(b, similaritySize))
+}
+
+// ssim computes the structural similarity of two luma planes in
+// non-overlapping 8x8 windows. Planes of different sizes score 0.
+func ssim(la, lb plane) float64 {
+	if len(la.pix) == 0 || la.width != lb.width || la.height != lb.height {
+		return 0
+	}
+
+	const (
+		window = 8
+		c1     = (0.01 * 255) * (0.01 * 255)
+		c2     = (0.03 * 255) * (0.03 * 255)
+	)
+
+	var total float64
+	var windows int
+	for y := 0; y < la.height; y += window {
+		for x := 0; x < la.width; x += window {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			var n float64
+			for wy := y; wy < y+window && wy < la.height; wy++ {
+				for wx := x; wx < x+window && wx < la.width; wx++ {
+					va := la.pix[wy*la.width+wx]
+					vb := lb.pix[wy*lb.width+wx]
+					sumA += va
+					sumB += vb
+					sumAA += va * va
+					sumBB += vb * vb
+					sumAB += va * vb
+					n++
+				}
+			}
+
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			covar := sumAB/n - meanA*meanB
+
+			total += ((2*meanA*meanB + c1) * (2*covar + c2)) /
+				((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+
+	return math.Max(0, total/float64(windows))
+}
+
+// plane is a single 8-bit channel stored as float64 for the similarity math.
+type plane struct {
+	pix    []float64
+	width  int
+	height int
+}
+
+// lumaPlane scales img down to at most maxSize pixels on the longest side and
+// extracts its BT.601 luma. Transparent pixels are composited onto black so
+// that invisible colour data does not influence the score.
+func lumaPlane(img image.Image, maxSize uint) plane {
+	size := img.Bounds().Size()
+	if uint(size.X) > maxSize || uint(size.Y) > maxSize {
+		if size.X >= size.Y {
+			img = resize.Resize(maxSize, 0, img, resize.Bilinear)
+		} else {
+			img = resize.Resize(0, maxSize, img, resize.Bilinear)
+		}
+	}
+
+	bounds := img.Bounds()
+	p := plane{
+		pix:    make([]float64, 0, bounds.Dx()*bounds.Dy()),
+		width:  bounds.Dx(),
+		height: bounds.Dy(),
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			p.pix = append(p.pix, (0.299*float64(r)+0.587*float64(g)+0.114*float64(b))/257)
+		}
+	}
+
+	return p
+}
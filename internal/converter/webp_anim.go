@@ -0,0 +1,297 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// The bundled WebP library only encodes and decodes still images, so animated
+// WebP files are assembled and taken apart here. Each frame is a still WebP
+// bitstream wrapped in an ANMF chunk of the extended RIFF container, see
+// https://developers.google.com/speed/webp/docs/riff_container.
+
+// VP8X feature flags.
+const (
+	webpFlagAnimation = 0x02
+	webpFlagAlpha     = 0x10
+)
+
+// ANMF frame flags.
+const (
+	webpFrameDispose = 0x01 // Dispose to the background colour after the frame
+	webpFrameNoBlend = 0x02 // Overwrite the canvas instead of alpha-blending
+)
+
+// webpChunk is a single chunk of a RIFF container.
+type webpChunk struct {
+	id   string
+	data []byte
+}
+
+// isAnimatedWebP reports whether header, the first 21 bytes of a file, starts
+// an extended WebP container with the animation flag set.
+func isAnimatedWebP(header []byte) bool {
+	return len(header) >= 21 &&
+		string(header[0:4]) == "RIFF" &&
+		string(header[8:16]) == "WEBPVP8X" &&
+		header[20]&webpFlagAnimation != 0
+}
+
+// decodeWebPAnimation decodes every frame of an animated WebP and composes it
+// onto the canvas, honouring the blending and disposal of each frame.
+func decodeWebPAnimation(data []byte) (*animation, error) {
+	chunks, err := readWebPChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := 0
+	for _, chunk := range chunks {
+		if chunk.id == "ANMF" {
+			frames++
+		}
+	}
+
+	anim := &animation{format: "webp"}
+	var canvas *image.RGBA
+	var dispose image.Rectangle
+
+	for _, chunk := range chunks {
+		switch chunk.id {
+		case "VP8X":
+			if len(chunk.data) < 10 {
+				return nil, fmt.Errorf("malformed webp VP8X chunk")
+			}
+			width, height := uint24(chunk.data[4:])+1, uint24(chunk.data[7:])+1
+			if err := checkAnimationSize(frames, image.Rect(0, 0, width, height)); err != nil {
+				return nil, err
+			}
+			canvas = image.NewRGBA(image.Rect(0, 0, width, height))
+		case "ANIM":
+			if len(chunk.data) < 6 {
+				return nil, fmt.Errorf("malformed webp ANIM chunk")
+			}
+			anim.loops = int(binary.LittleEndian.Uint16(chunk.data[4:]))
+		case "ANMF":
+			if canvas == nil || len(chunk.data) < 16 {
+				return nil, fmt.Errorf("malformed webp ANMF chunk")
+			}
+
+			// The previous frame is disposed of right before the next one is drawn
+			if !dispose.Empty() {
+				draw.Draw(canvas, dispose, image.Transparent, image.Point{}, draw.Src)
+				dispose = image.Rectangle{}
+			}
+
+			x, y := uint24(chunk.data[0:])*2, uint24(chunk.data[3:])*2
+			width, height := uint24(chunk.data[6:])+1, uint24(chunk.data[9:])+1
+			duration := uint24(chunk.data[12:])
+			flags := chunk.data[15]
+
+			frame, err := decodeWebPFrame(chunk.data[16:], width, height)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode frame %d: %w", len(anim.frames)+1, err)
+			}
+
+			rect := frame.Bounds().Add(image.Pt(x, y))
+			op := draw.Over
+			if flags&webpFrameNoBlend != 0 {
+				op = draw.Src
+			}
+			draw.Draw(canvas, rect, frame, frame.Bounds().Min, op)
+
+			anim.frames = append(anim.frames, cloneRGBA(canvas))
+			anim.delays = append(anim.delays, duration)
+
+			if flags&webpFrameDispose != 0 {
+				dispose = rect
+			}
+		}
+	}
+
+	if len(anim.frames) == 0 {
+		return nil, fmt.Errorf("animated webp has no frames")
+	}
+	return anim, nil
+}
+
+// decodeWebPFrame decodes the bitstream chunks of a single ANMF frame of the
+// given size by wrapping them into a still WebP file.
+func decodeWebPFrame(data []byte, width, height int) (*image.RGBA, error) {
+	chunks, err := readChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var frame []webpChunk
+	var flags byte
+	for _, chunk := range chunks {
+		switch chunk.id {
+		case "ALPH":
+			flags |= webpFlagAlpha
+			frame = append(frame, chunk)
+		case "VP8 ", "VP8L":
+			frame = append(frame, chunk)
+		}
+	}
+	if len(frame) == 0 {
+		return nil, fmt.Errorf("frame has no image data")
+	}
+
+	// A lossy bitstream with a separate alpha channel needs the extended header
+	if flags != 0 {
+		frame = append([]webpChunk{{id: "VP8X", data: vp8xData(flags, width, height)}}, frame...)
+	}
+
+	still, err := encodeWebPChunks(frame)
+	if err != nil {
+		return nil, err
+	}
+	return webp.DecodeRGBA(still)
+}
+
+// encodeWebPAnimation writes anim as an animated WebP. Every frame is encoded
+// as a still image with options and stored whole, without blending, so the
+// disposal of the source is already reflected in the frames themselves.
+func encodeWebPAnimation(w io.Writer, anim *animation, options *webp.Options) error {
+	bounds := anim.frames[0].Bounds()
+	var flags byte = webpFlagAnimation
+
+	// Transparent background colour followed by the loop count
+	chunks := []webpChunk{
+		{id: "VP8X"},
+		{id: "ANIM", data: binary.LittleEndian.AppendUint16([]byte{0, 0, 0, 0}, uint16(min(anim.loops, 0xffff)))},
+	}
+
+	for i, frame := range anim.frames {
+		var encoded bytes.Buffer
+		if err := webp.Encode(&encoded, frame, options); err != nil {
+			return fmt.Errorf("failed to encode frame %d: %w", i+1, err)
+		}
+
+		frameChunks, err := readWebPChunks(encoded.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed to read frame %d: %w", i+1, err)
+		}
+
+		// Frame header: offset, size, duration and flags, followed by the bitstream
+		anmf := make([]byte, 16, 16+encoded.Len())
+		putUint24(anmf[6:], frame.Bounds().Dx()-1)
+		putUint24(anmf[9:], frame.Bounds().Dy()-1)
+		putUint24(anmf[12:], min(anim.delays[i], 0xffffff))
+		anmf[15] = webpFrameNoBlend
+
+		for _, chunk := range frameChunks {
+			switch chunk.id {
+			case "ALPH":
+				flags |= webpFlagAlpha
+			case "VP8L":
+				if !frame.Opaque() {
+					flags |= webpFlagAlpha
+				}
+			case "VP8 ": // Lossy bitstream without alpha
+			default:
+				continue // Skip the VP8X header and metadata of the still image
+			}
+			anmf = appendChunk(anmf, chunk)
+		}
+
+		chunks = append(chunks, webpChunk{id: "ANMF", data: anmf})
+	}
+
+	chunks[0].data = vp8xData(flags, bounds.Dx(), bounds.Dy())
+
+	data, err := encodeWebPChunks(chunks)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// readWebPChunks returns the chunks of a WebP RIFF container.
+func readWebPChunks(data []byte) ([]webpChunk, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("not a webp file")
+	}
+
+	size := int(binary.LittleEndian.Uint32(data[4:])) + 8
+	if size > len(data) {
+		return nil, fmt.Errorf("truncated webp file")
+	}
+	return readChunks(data[12:size])
+}
+
+// readChunks splits data into RIFF chunks. Chunk payloads are padded to an
+// even length.
+func readChunks(data []byte) ([]webpChunk, error) {
+	var chunks []webpChunk
+	for len(data) >= 8 {
+		size := int(binary.LittleEndian.Uint32(data[4:]))
+		if size > len(data)-8 {
+			return nil, fmt.Errorf("truncated %q chunk", data[0:4])
+		}
+		chunks = append(chunks, webpChunk{id: string(data[0:4]), data: data[8 : 8+size]})
+
+		next := 8 + size + size&1
+		if next > len(data) {
+			break
+		}
+		data = data[next:]
+	}
+	return chunks, nil
+}
+
+// encodeWebPChunks wraps chunks into a WebP RIFF container.
+func encodeWebPChunks(chunks []webpChunk) ([]byte, error) {
+	body := []byte("WEBP")
+	for _, chunk := range chunks {
+		body = appendChunk(body, chunk)
+	}
+	if uint64(len(body)) > 0xfffffffe {
+		return nil, fmt.Errorf("webp file too large")
+	}
+
+	data := make([]byte, 0, 8+len(body))
+	data = append(data, "RIFF"...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(body)))
+	return append(data, body...), nil
+}
+
+// appendChunk appends chunk to data in RIFF layout.
+func appendChunk(data []byte, chunk webpChunk) []byte {
+	data = append(data, chunk.id...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(chunk.data)))
+	data = append(data, chunk.data...)
+	if len(chunk.data)&1 == 1 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// vp8xData returns the payload of a VP8X chunk.
+func vp8xData(flags byte, width, height int) []byte {
+	data := make([]byte, 10)
+	data[0] = flags
+	putUint24(data[4:], width-1)
+	putUint24(data[7:], height-1)
+	return data
+}
+
+// uint24 reads a 24-bit little-endian integer.
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+// putUint24 writes a 24-bit little-endian integer.
+func putUint24(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
@@ -0,0 +1,156 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"maps"
+	"strings"
+)
+
+// XMP namespaces.
+const (
+	xmpNSRDF    = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmpNSDC     = "http://purl.org/dc/elements/1.1/"
+	xmpNSRights = "http://ns.adobe.com/xap/1.0/rights/"
+	xmpNSExif   = "http://ns.adobe.com/exif/1.0/"
+	xmpNSTIFF   = "http://ns.adobe.com/tiff/1.0/"
+)
+
+// xmlEscaper escapes character data and attribute values.
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+// keepXMPProperty drops the orientation, which no longer applies once the
+// pixels are stored upright, and keeps every other property.
+func keepXMPProperty(space, local string) bool {
+	return !(space == xmpNSTIFF && local == "Orientation")
+}
+
+// filterXMP returns a copy of an XMP packet that holds only the properties
+// keep accepts, identified by namespace and local name. Properties are the
+// children and attributes of rdf:Description elements. It returns nil if
+// no property is left or the packet is not well-formed.
+//
+// The packet is rewritten token by token with the prefixes of the source, so
+// everything but the dropped properties stays as it was.
+func filterXMP(packet []byte, keep func(space, local string) bool) []byte {
+	if len(packet) == 0 {
+		return nil
+	}
+
+	type element struct {
+		namespaces  map[string]string // Prefix -> namespace, including inherited ones
+		description bool
+	}
+
+	var out bytes.Buffer
+	var stack []element
+	root := map[string]string{"xml": "http://www.w3.org/XML/1998/namespace"}
+	skip, properties := 0, 0
+
+	decoder := xml.NewDecoder(bytes.NewReader(packet))
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if skip > 0 {
+				skip++
+				continue
+			}
+
+			// Declarations of this element apply to its own name already
+			scope := root
+			if len(stack) > 0 {
+				scope = stack[len(stack)-1].namespaces
+			}
+			for _, attr := range t.Attr {
+				prefix, declaration := "", false
+				switch {
+				case attr.Name.Space == "xmlns":
+					prefix, declaration = attr.Name.Local, true
+				case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+					declaration = true
+				}
+				if declaration {
+					scope = maps.Clone(scope)
+					scope[prefix] = attr.Value
+				}
+			}
+
+			space := scope[t.Name.Space]
+			parentIsDescription := len(stack) > 0 && stack[len(stack)-1].description
+			if parentIsDescription {
+				if !keep(space, t.Name.Local) {
+					skip = 1
+					continue
+				}
+				properties++
+			}
+
+			description := space == xmpNSRDF && t.Name.Local == "Description"
+			out.WriteString("<" + qualifiedName(t.Name))
+			for _, attr := range t.Attr {
+				// Attributes of rdf:Description are properties in their short form
+				if description && attr.Name.Space != "" && attr.Name.Space != "xmlns" && attr.Name.Space != "xml" {
+					attrSpace := scope[attr.Name.Space]
+					if attrSpace != xmpNSRDF {
+						if !keep(attrSpace, attr.Name.Local) {
+							continue
+						}
+						properties++
+					}
+				}
+				out.WriteString(" " + qualifiedName(attr.Name) + `="` + xmlEscaper.Replace(attr.Value) + `"`)
+			}
+			out.WriteString(">")
+
+			stack = append(stack, element{namespaces: scope, description: description})
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if len(stack) == 0 {
+				return nil
+			}
+			stack = stack[:len(stack)-1]
+			out.WriteString("</" + qualifiedName(t.Name) + ">")
+		case xml.CharData:
+			if skip == 0 {
+				out.WriteString(xmlEscaper.Replace(string(t)))
+			}
+		case xml.Comment:
+			if skip == 0 {
+				out.WriteString("<!--" + string(t) + "-->")
+			}
+		case xml.ProcInst:
+			if skip == 0 {
+				out.WriteString("<?" + t.Target + " " + string(t.Inst) + "?>")
+			}
+		case xml.Directive:
+			if skip == 0 {
+				out.WriteString("<!" + string(t) + ">")
+			}
+		}
+	}
+
+	if properties == 0 || len(stack) != 0 {
+		return nil
+	}
+	return out.Bytes()
+}
+
+// qualifiedName returns name as written in the source, with its prefix.
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
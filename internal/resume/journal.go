@@ -0,0 +1,154 @@
+package resume
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Outcome is the final state of a single file within a conversion session.
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailed  Outcome = "failed"
+	OutcomeSkipped Outcome = "skipped"
+)
+
+// JournalEntry is a single line of the session journal.
+type JournalEntry struct {
+	Path    string    `json:"path"`
+	Outcome Outcome   `json:"outcome"`
+	Output  string    `json:"output,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+
+	// Variants holds the outputs written besides Output, one per further variant
+	Variants []string `json:"variants,omitempty"`
+}
+
+// Journal is an append-only log of per-file outcomes for a session.
+//
+// Every result is written as one JSON line as soon as it is known, so a run
+// that crashes or is killed loses at most the line that was being written.
+// Appending keeps the cost of recording a result constant no matter how many
+// files the session contains.
+type Journal struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// OpenJournal opens (or creates) the journal for the given session in append mode.
+func OpenJournal(sessionID string) (*Journal, error) {
+	stateDir := getStateDir()
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(getJournalPath(sessionID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+
+	return &Journal{
+		file: file,
+		enc:  json.NewEncoder(file),
+	}, nil
+}
+
+// Record appends the outcome of a single file to the journal.
+func (j *Journal) Record(entry JournalEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.enc.Encode(&entry)
+}
+
+// Sync flushes the journal contents to stable storage.
+func (j *Journal) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Sync()
+}
+
+// Close syncs and closes the journal file.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
+
+// LoadJournal reads the journal of the given session and returns the latest
+// recorded entry for every file, keyed by path.
+//
+// If the journal does not exist, the function returns an empty map and no error.
+// A trailing line that was cut short by a crash is ignored.
+func LoadJournal(sessionID string) (map[string]JournalEntry, error) {
+	entries := make(map[string]JournalEntry)
+
+	file, err := os.Open(getJournalPath(sessionID))
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries[entry.Path] = entry
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	return entries, nil
+}
+
+// IsDone reports whether a file with this entry must not be processed again
+// when the session is resumed. Failed files are retried.
+func (e JournalEntry) IsDone() bool {
+	return e.Outcome == OutcomeSuccess || e.Outcome == OutcomeSkipped
+}
+
+// Outputs returns every output path recorded for the file.
+func (e JournalEntry) Outputs() []string {
+	if e.Output == "" {
+		return e.Variants
+	}
+	return append([]string{e.Output}, e.Variants...)
+}
+
+// ClearJournal removes the journal of the given session.
+func ClearJournal(sessionID string) error {
+	err := os.Remove(getJournalPath(sessionID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// getJournalPath returns the path of the journal file for the given session.
+func getJournalPath(sessionID string) string {
+	return filepath.Join(getStateDir(), sessionID+".journal")
+}
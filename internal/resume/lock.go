@@ -0,0 +1,150 @@
+package resume
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrSessionLocked is returned when another running gopix process owns a session.
+var ErrSessionLocked = errors.New("session is in use by another gopix process")
+
+// Lock marks a session as owned by the current process so that two processes
+// never convert the files of the same session at the same time.
+type Lock struct {
+	path string
+}
+
+// AcquireLock takes the lock of the given session.
+//
+// The lock is a file named "<session id>.lock" holding the PID of its owner.
+// It is written under a temporary name and hard-linked into place, which fails
+// if the lock exists, so the lock file never exists without its PID. A lock
+// left behind by a process that no longer runs is considered stale and taken
+// over. If a live process holds the lock, or the lock file cannot be read, the
+// function returns an error wrapping ErrSessionLocked.
+func AcquireLock(sessionID string) (*Lock, error) {
+	if err := validateSessionID(sessionID); err != nil {
+		return nil, err
+	}
+
+	stateDir := getStateDir()
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, err
+	}
+
+	lockPath := getLockPath(sessionID)
+	for attempt := 0; attempt < 2; attempt++ {
+		err := createLockFile(lockPath)
+		if err == nil {
+			return &Lock{path: lockPath}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create lock file: %w", err)
+		}
+
+		pid, err := readLockPID(lockPath)
+		if os.IsNotExist(err) {
+			// Released in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: unreadable lock file %s, remove it if no gopix process uses the session: %v", ErrSessionLocked, lockPath, err)
+		}
+		if pid == os.Getpid() || processAlive(pid) {
+			return nil, fmt.Errorf("%w (pid %d)", ErrSessionLocked, pid)
+		}
+
+		// Stale lock from a process that died, remove it and try again
+		if err := breakStaleLock(lockPath, pid); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("%w: could not acquire lock", ErrSessionLocked)
+}
+
+// createLockFile writes the PID of the current process to a temporary file
+// and links it to lockPath. The error satisfies os.IsExist if the lock is held.
+func createLockFile(lockPath string) error {
+	file, err := os.CreateTemp(filepath.Dir(lockPath), filepath.Base(lockPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+	defer os.Remove(tempPath)
+
+	_, werr := file.WriteString(strconv.Itoa(os.Getpid()))
+	serr := file.Sync()
+	cerr := file.Close()
+	if err := errors.Join(werr, serr, cerr); err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+
+	return os.Link(tempPath, lockPath)
+}
+
+// breakStaleLock removes the lock at lockPath left behind by the dead process
+// pid. The lock is moved aside before it is removed, so that a lock another
+// process took over in the meantime is put back instead of deleted.
+func breakStaleLock(lockPath string, pid int) error {
+	stalePath := fmt.Sprintf("%s.%d.stale", lockPath, os.Getpid())
+	if err := os.Rename(lockPath, stalePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to remove stale lock: %w", err)
+	}
+	defer os.Remove(stalePath)
+
+	if owner, err := readLockPID(stalePath); err != nil || owner != pid {
+		os.Link(stalePath, lockPath)
+		return fmt.Errorf("%w: lock taken over by another process", ErrSessionLocked)
+	}
+	return nil
+}
+
+// Release removes the lock file.
+func (l *Lock) Release() error {
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// LockOwner returns the PID of the process holding the lock of the given
+// session and whether that process is still running. A lock file that exists
+// but cannot be read counts as held, with PID 0.
+func LockOwner(sessionID string) (int, bool) {
+	pid, err := readLockPID(getLockPath(sessionID))
+	if os.IsNotExist(err) {
+		return 0, false
+	}
+	if err != nil {
+		return 0, true
+	}
+
+	return pid, pid == os.Getpid() || processAlive(pid)
+}
+
+// readLockPID returns the PID stored in a lock file.
+func readLockPID(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid %q", strings.TrimSpace(string(data)))
+	}
+	return pid, nil
+}
+
+// getLockPath returns the path of the lock file for the given session.
+func getLockPath(sessionID string) string {
+	return filepath.Join(getStateDir(), sessionID+".lock")
+}
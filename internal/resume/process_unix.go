@@ -0,0 +1,17 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package resume
+
+import (
+	"syscall"
+)
+
+// processAlive reports whether a process with the given PID is running.
+// Sending signal 0 performs the existence and permission checks without
+// actually delivering a signal; EPERM means the process exists but belongs to
+// another user.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
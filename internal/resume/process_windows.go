@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package resume
+
+import (
+	"os"
+)
+
+// processAlive reports whether a process with the given PID is running.
+// On Windows os.FindProcess opens a handle to the process and fails if it does not exist.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
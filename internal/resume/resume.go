@@ -2,23 +2,34 @@ package resume
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
+
+	"github.com/MostafaSensei106/GoPix/internal/config"
+	"github.com/MostafaSensei106/GoPix/internal/converter"
 )
 
+// ConversionState describes a conversion session. Together with the session
+// journal it holds everything needed to continue an interrupted run with the
+// exact same settings it was started with.
 type ConversionState struct {
-	ProcessedFiles []string  `json:"processed_files"`
-	StartTime      time.Time `json:"start_time"`
-	InputDir       string    `json:"input_dir"`
-	TargetFormat   string    `json:"target_format"`
-	TotalFiles     int       `json:"total_files"`
-	SessionID      string    `json:"session_id"`
+	StartTime    time.Time                `json:"start_time"`
+	InputDir     string                   `json:"input_dir"`
+	TargetFormat string                   `json:"target_format"`
+	TotalFiles   int                      `json:"total_files"`
+	SessionID    string                   `json:"session_id"`
+	Options      converter.ConvertOptions `json:"options"`
+	Batch        config.BatchConfig       `json:"batch"`
+	Workers      uint8                    `json:"workers"`
+	RateLimit    float64                  `json:"rate_limit"`
 }
 
-// SaveState writes the current conversion state to a JSON file in the user's
-// state directory. The file is named "conversion_state.json" and is used to
-// resume the conversion process when the user restarts the program.
+// SaveState writes the conversion state to a JSON file in the user's state
+// directory. Every session has its own file named "<session id>.json", so
+// several gopix runs on different folders never overwrite each other's state.
 //
 // The state is marshalled to JSON using the json.MarshalIndent function, which
 // indents the JSON data with two spaces for readability. The resulting data is
@@ -26,57 +37,114 @@ type ConversionState struct {
 //
 // If any error occurs during the writing process, the function returns the error.
 func SaveState(state *ConversionState) error {
+	if err := validateSessionID(state.SessionID); err != nil {
+		return err
+	}
+
 	stateDir := getStateDir()
 	if err := os.MkdirAll(stateDir, 0755); err != nil {
 		return err
 	}
 
-	statePath := filepath.Join(stateDir, "conversion_state.json")
 	data, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(statePath, data, 0644)
+	return os.WriteFile(getStatePath(state.SessionID), data, 0644)
 }
 
-// LoadState reads the current conversion state from a JSON file in the user's
-// state directory. The file is named "conversion_state.json" and is used to
-// resume the conversion process when the user restarts the program.
+// LoadState reads the state of the given session from the user's state directory.
 //
-// If the file does not exist, the function returns nil and no error. If any
+// If the session does not exist, the function returns nil and no error. If any
 // error occurs during the reading or unmarshalling process, the function
 // returns the error.
-func LoadState() (*ConversionState, error) {
-	statePath := filepath.Join(getStateDir(), "conversion_state.json")
+func LoadState(sessionID string) (*ConversionState, error) {
+	if err := validateSessionID(sessionID); err != nil {
+		return nil, err
+	}
 
-	if _, err := os.Stat(statePath); os.IsNotExist(err) {
+	state, err := readState(getStatePath(sessionID))
+	if os.IsNotExist(err) {
 		return nil, nil // No saved state
 	}
+	return state, err
+}
 
-	data, err := os.ReadFile(statePath)
+// ListStates returns the states of all saved sessions, most recent first.
+// State files that cannot be read are skipped.
+func ListStates() ([]*ConversionState, error) {
+	paths, err := filepath.Glob(filepath.Join(getStateDir(), "*.json"))
 	if err != nil {
 		return nil, err
 	}
 
-	var state ConversionState
-	if err := json.Unmarshal(data, &state); err != nil {
-		return nil, err
+	states := make([]*ConversionState, 0, len(paths))
+	for _, path := range paths {
+		state, err := readState(path)
+		if err != nil || getStatePath(state.SessionID) != path {
+			continue
+		}
+		states = append(states, state)
 	}
 
-	return &state, nil
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].StartTime.After(states[j].StartTime)
+	})
+
+	return states, nil
 }
 
-// ClearState removes the saved conversion state file from the user's state directory.
+// ClearState removes the saved state and the journal of the given session from
+// the user's state directory.
 //
 // This is typically used after a successful conversion to remove the saved state
 // and prevent the user from resuming the conversion again.
 //
-// If the file does not exist, the function returns nil and no error. If any
+// If the files do not exist, the function returns nil and no error. If any
 // error occurs during the removal process, the function returns the error.
-func ClearState() error {
-	statePath := filepath.Join(getStateDir(), "conversion_state.json")
-	return os.Remove(statePath)
+func ClearState(sessionID string) error {
+	if err := validateSessionID(sessionID); err != nil {
+		return err
+	}
+
+	if err := os.Remove(getStatePath(sessionID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ClearJournal(sessionID)
+}
+
+// readState reads and unmarshals a single state file.
+func readState(path string) (*ConversionState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state ConversionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// validateSessionID makes sure a session ID cannot be used to escape the state directory.
+func validateSessionID(sessionID string) error {
+	if sessionID == "" {
+		return fmt.Errorf("session id is required")
+	}
+	for _, r := range sessionID {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("invalid session id: %s", sessionID)
+		}
+	}
+	return nil
+}
+
+// getStatePath returns the path of the state file for the given session.
+func getStatePath(sessionID string) string {
+	return filepath.Join(getStateDir(), sessionID+".json")
 }
 
 // getStateDir returns the path to the state directory where conversion state files are saved.
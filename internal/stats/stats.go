@@ -1,8 +1,10 @@
 package stats
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -29,13 +31,59 @@ type ConversionStatistics struct {
 	BatchMode            bool
 	RecursiveSearch      bool
 	PreserveStructure    bool
+	// Files whose output failed verification, so the original was kept
+	VerificationFailures uint32
+	// Files skipped because the cache holds an up-to-date output
+	CacheHits uint32
+	// Outputs discarded because they did not save enough space, so the source was kept
+	NotBeneficialFiles uint32
+	// Those outputs: output path -> size it would have had and size of the source
+	NotBeneficial map[string]string
+	// Converted files with a non-sRGB colour profile: source path -> profile and what happened to it
+	NonSRGBProfiles map[string]string
+	// Outcomes of each variant when several renditions are written per source
+	Variants map[string]*VariantStatistics
+	// Converted files whose transparency was flattened for a format without alpha: source path -> background colour
+	FlattenedTransparency map[string]string
+	// Outputs whose quality was searched for a target size or similarity: output path -> quality found
+	ChosenQualities map[string]ChosenQuality
+	// Sources whose output clashed with another output or an existing file: source path -> decision
+	Conflicts map[string]string
+
+	// variantOrder lists the variants in the order they were first seen, which
+	// is the order they were configured in
+	variantOrder []string
+	// sizedSources holds the sources whose size is already part of TotalSizeBefore,
+	// so a source with several variants counts once
+	sizedSources map[string]struct{}
+}
+
+// ChosenQuality is the quality found for an output by the quality search.
+type ChosenQuality struct {
+	Quality int
+	Missed  bool // No quality met the target, Quality is the closest one
+}
+
+// VariantStatistics holds the outcomes of one variant, e.g. "640 webp".
+type VariantStatistics struct {
+	Converted uint32
+	Skipped   uint32
+	Failed    uint32
+	SizeAfter uint64 // Total size of the converted outputs
 }
 
 // NewConversionStatistics creates a new ConversionStatistics instance, with the FailureReasons map initialized to hold conversion error reasons and counts.
 func NewConversionStatistics() *ConversionStatistics {
 	return &ConversionStatistics{
-		FailureReasons:       make(map[string]uint32, 10), // Pre-allocate for common error types
-		DirectoriesProcessed: make(map[string]int, 50),    // Pre-allocate for typical directory count
+		FailureReasons:        make(map[string]uint32, 10), // Pre-allocate for common error types
+		DirectoriesProcessed:  make(map[string]int, 50),    // Pre-allocate for typical directory count
+		NonSRGBProfiles:       make(map[string]string),
+		Variants:              make(map[string]*VariantStatistics),
+		Conflicts:             make(map[string]string),
+		FlattenedTransparency: make(map[string]string),
+		ChosenQualities:       make(map[string]ChosenQuality),
+		NotBeneficial:         make(map[string]string),
+		sizedSources:          make(map[string]struct{}),
 	}
 }
 
@@ -43,24 +91,94 @@ func NewConversionStatistics() *ConversionStatistics {
 // If the result contains an error, it increments the failed files count and adds the error to the failure reasons map.
 // If the result indicates that the file was skipped, it increments the skipped files count.
 // Otherwise, it increments the converted files count and adds the original and new file sizes to the total sizes.
+// Results of variants are counted per output and per variant as well, but the size of their source only once.
+// Sources whose output conflicted are recorded with the decision of the conflict policy.
 func (cs *ConversionStatistics) AddResult(result *converter.ConversionResult) {
 	cs.TotalFiles++
 	cs.TotalDuration += result.Duration
 
+	if result.Conflict != "" {
+		cs.Conflicts[result.OriginalPath] = result.Conflict
+	}
+
+	var variant *VariantStatistics
+	if result.Variant != "" {
+		variant = cs.Variants[result.Variant]
+		if variant == nil {
+			variant = &VariantStatistics{}
+			cs.Variants[result.Variant] = variant
+			cs.variantOrder = append(cs.variantOrder, result.Variant)
+		}
+	}
+
 	if result.Error != nil {
 		cs.FailedFiles++
+		if variant != nil {
+			variant.Failed++
+		}
+
+		// Group verification failures by reason rather than by their per-file detail
+		var verifyErr *converter.VerificationError
+		if errors.As(result.Error, &verifyErr) {
+			cs.VerificationFailures++
+			cs.FailureReasons["output verification failed, original kept: "+verifyErr.Reason]++
+			return
+		}
+
 		cs.FailureReasons[result.Error.Error()]++
 		return
 	}
 
-	if result.OriginalPath == "" && result.NewSize == 0 {
+	if result.Skipped || (result.OriginalPath == "" && result.NewSize == 0) {
 		cs.SkippedFiles++
+		if variant != nil {
+			variant.Skipped++
+		}
+		return
+	}
+
+	// Outputs that would not have saved space were discarded
+	if result.NotBeneficial {
+		cs.NotBeneficialFiles++
+		cs.NotBeneficial[result.NewPath] = fmt.Sprintf("%s, source %s", FormatBytes(result.NewSize), FormatBytes(result.OriginalSize))
+		if variant != nil {
+			variant.Skipped++
+		}
+		return
+	}
+
+	// Outputs reused from the cache were not converted again
+	if result.CacheHit {
+		cs.SkippedFiles++
+		cs.CacheHits++
+		if variant != nil {
+			variant.Skipped++
+		}
 		return
 	}
 
 	cs.ConvertedFiles++
-	cs.TotalSizeBefore += uint64(result.OriginalSize)
+	if _, sized := cs.sizedSources[result.OriginalPath]; !sized {
+		cs.TotalSizeBefore += uint64(result.OriginalSize)
+		if variant != nil {
+			cs.sizedSources[result.OriginalPath] = struct{}{}
+		}
+	}
 	cs.TotalSizeAfter += uint64(result.NewSize)
+	if variant != nil {
+		variant.Converted++
+		variant.SizeAfter += uint64(result.NewSize)
+	}
+
+	if result.SourceProfile != "" {
+		cs.NonSRGBProfiles[result.OriginalPath] = result.SourceProfile + " (" + result.ProfileAction + ")"
+	}
+	if result.Background != "" {
+		cs.FlattenedTransparency[result.OriginalPath] = result.Background
+	}
+	if result.Quality > 0 {
+		cs.ChosenQualities[result.NewPath] = ChosenQuality{Quality: result.Quality, Missed: result.QualityMissed}
+	}
 
 	// Track directory information for batch processing
 	if cs.BatchMode {
@@ -88,8 +206,12 @@ func (cs *ConversionStatistics) Calculate() {
 // skipped, and failed files, the total conversion time, the average time per
 // file, and the effective processing speed. It also displays the original and
 // new total sizes of the files and the space saved (or increased) as a result
-// of the conversion. Finally, it lists the failure reasons and the number of
-// files that failed for each reason.
+// of the conversion, the outcomes of each variant, followed by the files whose
+// colour profile was not sRGB, the files whose transparency was flattened, the
+// qualities found for a target size or similarity, the outputs discarded as not
+// beneficial and the files whose output conflicted.
+// Finally, it lists the failure reasons and the number of files that failed
+// for each reason.
 func (cs *ConversionStatistics) PrintReport() {
 	cs.Calculate()
 
@@ -99,7 +221,16 @@ func (cs *ConversionStatistics) PrintReport() {
 	// File statistics
 	color.Green("✅ Converted: %d", cs.ConvertedFiles)
 	color.Yellow("⏭️ Skipped: %d", cs.SkippedFiles)
+	if cs.CacheHits > 0 {
+		color.Yellow("♻️ Unchanged (reused from cache): %d", cs.CacheHits)
+	}
+	if cs.NotBeneficialFiles > 0 {
+		color.Yellow("🚫 Not beneficial (original kept): %d", cs.NotBeneficialFiles)
+	}
 	color.Red("❌ Failed: %d", cs.FailedFiles)
+	if cs.VerificationFailures > 0 {
+		color.Red("🛡️ Originals kept (verification failed): %d", cs.VerificationFailures)
+	}
 	color.Cyan("📁 Total processed: %d", cs.TotalFiles)
 
 	// Time statistics
@@ -116,16 +247,16 @@ func (cs *ConversionStatistics) PrintReport() {
 	if cs.TotalSizeBefore > 0 {
 		color.Cyan("\n💾 Size Analysis")
 		color.Cyan(strings.Repeat("=", 50))
-		color.White("🗂️ Original total size: %s", formatBytes(int64(cs.TotalSizeBefore)))
-		color.White("🆕 New total size: %s", formatBytes(int64(cs.TotalSizeAfter)))
+		color.White("🗂️ Original total size: %s", FormatBytes(int64(cs.TotalSizeBefore)))
+		color.White("🆕 New total size: %s", FormatBytes(int64(cs.TotalSizeAfter)))
 
 		if cs.SpaceSaved > 0 {
 			color.Green("💰 Space saved: %s (%.1f%% reduction)",
-				formatBytes(int64(cs.SpaceSaved)),
+				FormatBytes(int64(cs.SpaceSaved)),
 				(1-cs.CompressionRatio)*100)
 		} else if cs.SpaceSaved < 0 {
 			color.Red("📈 Size increased: %s (%.1f%% increase)",
-				formatBytes(-int64(cs.SpaceSaved)),
+				FormatBytes(-int64(cs.SpaceSaved)),
 				(cs.CompressionRatio-1)*100)
 		}
 	}
@@ -153,6 +284,101 @@ func (cs *ConversionStatistics) PrintReport() {
 		}
 	}
 
+	// Responsive image sets, one line per size and format
+	if len(cs.Variants) > 0 {
+		color.Cyan("\n🖼️ Variants")
+		color.Cyan(strings.Repeat("=", 50))
+		for _, name := range cs.variantOrder {
+			variant := cs.Variants[name]
+			color.White("  • %s: %d converted (%s), %d skipped, %d failed",
+				name, variant.Converted, FormatBytes(int64(variant.SizeAfter)), variant.Skipped, variant.Failed)
+		}
+	}
+
+	// Wide-gamut sources, whose colours depend on the profile handling
+	if len(cs.NonSRGBProfiles) > 0 {
+		color.Cyan("\n🎨 Non-sRGB Colour Profiles")
+		color.Cyan(strings.Repeat("=", 50))
+		paths := make([]string, 0, len(cs.NonSRGBProfiles))
+		for path := range cs.NonSRGBProfiles {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			color.White("  • %s: %s", path, cs.NonSRGBProfiles[path])
+		}
+	}
+
+	// Transparent sources written to formats without alpha
+	if len(cs.FlattenedTransparency) > 0 {
+		color.Cyan("\n🔲 Transparency Flattened")
+		color.Cyan(strings.Repeat("=", 50))
+		paths := make([]string, 0, len(cs.FlattenedTransparency))
+		for path := range cs.FlattenedTransparency {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			color.Yellow("  • %s: onto %s", path, cs.FlattenedTransparency[path])
+		}
+	}
+
+	// Qualities found per output, with the range first
+	if len(cs.ChosenQualities) > 0 {
+		color.Cyan("\n🎚️ Chosen Qualities")
+		color.Cyan(strings.Repeat("=", 50))
+		paths := make([]string, 0, len(cs.ChosenQualities))
+		lowest, highest, sum, missed := 100, 0, 0, 0
+		for path, chosen := range cs.ChosenQualities {
+			paths = append(paths, path)
+			lowest, highest, sum = min(lowest, chosen.Quality), max(highest, chosen.Quality), sum+chosen.Quality
+			if chosen.Missed {
+				missed++
+			}
+		}
+		color.White("📊 Quality: %d to %d, average %.1f", lowest, highest, float64(sum)/float64(len(paths)))
+		if missed > 0 {
+			color.Yellow("⚠️ Target not reached: %d files", missed)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			chosen := cs.ChosenQualities[path]
+			if chosen.Missed {
+				color.Yellow("  • %s: %d (target not reached)", path, chosen.Quality)
+			} else {
+				color.White("  • %s: %d", path, chosen.Quality)
+			}
+		}
+	}
+
+	// Outputs that would have been larger than allowed
+	if len(cs.NotBeneficial) > 0 {
+		color.Cyan("\n🚫 Not Beneficial")
+		color.Cyan(strings.Repeat("=", 50))
+		paths := make([]string, 0, len(cs.NotBeneficial))
+		for path := range cs.NotBeneficial {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			color.Yellow("  • %s: %s", path, cs.NotBeneficial[path])
+		}
+	}
+
+	// Outputs that clashed, with what the conflict policy did about them
+	if len(cs.Conflicts) > 0 {
+		color.Cyan("\n⚔️ Output Conflicts")
+		color.Cyan(strings.Repeat("=", 50))
+		paths := make([]string, 0, len(cs.Conflicts))
+		for path := range cs.Conflicts {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			color.Yellow("  • %s: %s", path, cs.Conflicts[path])
+		}
+	}
+
 	// Failure analysis
 	if len(cs.FailureReasons) > 0 {
 		color.Red("\n🔍 Failure Analysis")
@@ -163,11 +389,11 @@ func (cs *ConversionStatistics) PrintReport() {
 	}
 }
 
-// formatBytes converts a size in bytes to a human-readable string using binary prefixes (e.g., KB, MB).
+// FormatBytes converts a size in bytes to a human-readable string using binary prefixes (e.g., KB, MB).
 // It returns the size formatted with one decimal place and the appropriate unit, starting from bytes.
 // For example, 1024 bytes is converted to "1.0 KB". This function supports units up to exabytes (EB).
 
-func formatBytes(bytes int64) string {
+func FormatBytes(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {
 		// Use strconv for better performance than fmt.Sprintf for simple integers
@@ -13,12 +13,15 @@ type Job struct {
 	Path       string
 	Format     string
 	OutputPath string // Optional custom output path for batch processing
+	// Variants are written from a single decode of Path instead of one
+	// output in Format
+	Variants []conv.VariantOutput
 }
 
 type WorkerPool struct {
 	workers   uint8
 	jobs      chan Job
-	results   chan *conv.ConversionResult
+	results   chan []*conv.ConversionResult
 	converter *conv.ImageConverter
 	limiter   *rate.Limiter
 	ctx       context.Context
@@ -28,12 +31,13 @@ type WorkerPool struct {
 
 // NewWorkerPool creates a new WorkerPool with the specified number of workers,
 // an ImageConverter for handling image conversion jobs, and an optional rate
-// limit to control the processing rate. The function initializes a context with
-// cancellation, sets up job and result channels, and configures rate limiting
-// if a positive rateLimit is provided.
+// limit to control the processing rate. The pool's context is derived from the
+// given parent, so cancelling the parent (for example on SIGINT) stops workers
+// from picking up new jobs. The function sets up job and result channels, and
+// configures rate limiting if a positive rateLimit is provided.
 
-func NewWorkerPool(workers uint8, converter *conv.ImageConverter, rateLimit float64) *WorkerPool {
-	ctx, cancel := context.WithCancel(context.Background())
+func NewWorkerPool(parent context.Context, workers uint8, converter *conv.ImageConverter, rateLimit float64) *WorkerPool {
+	ctx, cancel := context.WithCancel(parent)
 
 	var limiter *rate.Limiter
 	if rateLimit > 0 {
@@ -46,7 +50,7 @@ func NewWorkerPool(workers uint8, converter *conv.ImageConverter, rateLimit floa
 	return &WorkerPool{
 		workers:   workers,
 		jobs:      make(chan Job, bufferSize),
-		results:   make(chan *conv.ConversionResult, bufferSize),
+		results:   make(chan []*conv.ConversionResult, bufferSize),
 		converter: converter,
 		limiter:   limiter,
 		ctx:       ctx,
@@ -70,7 +74,8 @@ func (wp *WorkerPool) Start() {
 // waiting for all ongoing tasks to complete, and then closing the results
 // channel. It also cancels the context, signaling that no further processing
 // should occur. This ensures that all resources are released properly and
-// no new jobs are processed.
+// no new jobs are processed. Stop must only be called once, after the last
+// job has been added, and the results channel must be drained concurrently.
 
 func (wp *WorkerPool) Stop() {
 	close(wp.jobs)
@@ -79,25 +84,29 @@ func (wp *WorkerPool) Stop() {
 	wp.cancel()
 }
 
-// AddJob adds a job to the job channel. If the context is cancelled, it will not add the job and return immediately.
-func (wp *WorkerPool) AddJob(job Job) {
+// AddJob adds a job to the job channel. If the context is cancelled, it will not add the job and return false.
+func (wp *WorkerPool) AddJob(job Job) bool {
 	select {
 	case wp.jobs <- job:
+		return true
 	case <-wp.ctx.Done():
+		return false
 	}
 }
 
 // Results returns a receive-only channel of ConversionResult pointers.
-// This channel provides the results of processed jobs. It can be used
-// to retrieve conversion results as they become available.
+// This channel provides the results of processed jobs, one per output of
+// the job. It can be used to retrieve conversion results as they become
+// available.
 
-func (wp *WorkerPool) Results() <-chan *conv.ConversionResult {
+func (wp *WorkerPool) Results() <-chan []*conv.ConversionResult {
 	return wp.results
 }
 
 // worker is a goroutine function that continuously processes jobs from the job channel.
-// It applies rate limiting if a limiter is configured and handles job cancellations gracefully.
-// Upon processing each job, it sends the conversion result to the results channel.
+// It applies rate limiting if a limiter is configured and handles job cancellations gracefully:
+// once the context is cancelled no new job is started, but the result of the job that is
+// currently being converted is always sent to the results channel.
 // The function exits when the job channel is closed or the context is cancelled.
 
 func (wp *WorkerPool) worker() {
@@ -110,40 +119,31 @@ func (wp *WorkerPool) worker() {
 				return
 			}
 
-			// Apply rate limiting if configured - use non-blocking approach
-			if wp.limiter != nil {
-				if !wp.limiter.Allow() {
-					// If rate limited, put job back and continue
-					select {
-					case wp.jobs <- job:
-					case <-wp.ctx.Done():
-						return
-					}
-					continue
-				}
+			// Jobs still queued when the pool is cancelled are left for a resumed run
+			if wp.ctx.Err() != nil {
+				return
 			}
 
-			var result *conv.ConversionResult
-			if job.OutputPath != "" {
-				result = wp.converter.ConvertWithOutputPath(job.Path, job.Format, job.OutputPath)
-			} else {
-				result = wp.converter.Convert(job.Path, job.Format)
+			// Apply rate limiting if configured, waiting for a token unless cancelled
+			if wp.limiter != nil {
+				if err := wp.limiter.Wait(wp.ctx); err != nil {
+					return
+				}
 			}
 
-			// Send result with timeout to avoid blocking
-			select {
-			case wp.results <- result:
-			case <-wp.ctx.Done():
-				return
+			var results []*conv.ConversionResult
+			switch {
+			case len(job.Variants) > 0:
+				results = wp.converter.ConvertVariants(job.Path, job.Variants)
+			case job.OutputPath != "":
+				results = []*conv.ConversionResult{wp.converter.ConvertWithOutputPath(job.Path, job.Format, job.OutputPath)}
 			default:
-				// If results channel is full, try again with context
-				select {
-				case wp.results <- result:
-				case <-wp.ctx.Done():
-					return
-				}
+				results = []*conv.ConversionResult{wp.converter.Convert(job.Path, job.Format)}
 			}
 
+			// Always deliver the results of a started job so its outcome is recorded
+			wp.results <- results
+
 		case <-wp.ctx.Done():
 			return
 		}